@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,6 +45,33 @@ type AppConfig struct {
 	// Directory into which application state will be read/written.  The permissions
 	// of this directory must allow file read/write/delete.
 	DataDir string
+
+	// Each save of the application state creates a new snapshot within DataDir.
+	// SnapshotKeepLast determines how many of the most recent snapshots are kept,
+	// and SnapshotKeepDays determines for how many days the newest snapshot of
+	// each day is kept in addition to those.
+	SnapshotKeepLast int
+	SnapshotKeepDays int
+
+	// Keys used to encrypt the data files written to DataDir (see Keyring).  Both
+	// settings contain entries in the format "<key id>:<hex-encoded key>";
+	// EncryptionKey holds comma-separated entries, and the file named by
+	// EncryptionKeyFile holds one entry per line.  New files are encrypted with
+	// the first key listed, and the others are only used to read older files.
+	// If neither is set, data files are written unencrypted.
+	EncryptionKey     Secret
+	EncryptionKeyFile string
+
+	// Maximum size (in megabytes) of the cache of all_entity_info responses
+	// (see ResultCache).  Setting this to 0 disables the cache.
+	ResultCacheSizeMB int
+
+	// Limits on the cost of each all_entity_info query (see QueryBudget): the
+	// most disjuncts, and (possibly negated) entities across them, that a
+	// filter query may have, and how long it may run for.
+	QueryMaxDisjuncts int
+	QueryMaxConjuncts int
+	QueryTimeout      time.Duration
 }
 
 // Loads application configuration parameters from shell environment variables
@@ -52,12 +80,20 @@ type AppConfig struct {
 func MakeAppConfig() AppConfig {
 	// Seed this map with default configuration values.
 	config := map[string]string{
-		"SYNTHOS_MEMDB_CONN":         "",
-		"SYNTHOS_REFRESH_INTERVAL":   "20s",
-		"SYNTHOS_PREFETCH_WINDOW":    "5m",
-		"SYNTHOS_TIME_RANGES":        "1h, 2h, 8h, 24h",
-		"SYNTHOS_HTTPS_REDIRECT_URL": "",
-		"SYNTHOS_DATA_DIR":           "/tmp/synthos/data/",
+		"SYNTHOS_MEMDB_CONN":          "",
+		"SYNTHOS_REFRESH_INTERVAL":    "20s",
+		"SYNTHOS_PREFETCH_WINDOW":     "5m",
+		"SYNTHOS_TIME_RANGES":         "1h, 2h, 8h, 24h",
+		"SYNTHOS_HTTPS_REDIRECT_URL":  "",
+		"SYNTHOS_DATA_DIR":            "/tmp/synthos/data/",
+		"SYNTHOS_SNAPSHOT_KEEP_LAST":  "10",
+		"SYNTHOS_SNAPSHOT_KEEP_DAYS":  "7",
+		"SYNTHOS_ENCRYPTION_KEY":      "",
+		"SYNTHOS_ENCRYPTION_KEY_FILE": "",
+		"SYNTHOS_RESULT_CACHE_MB":     "64",
+		"SYNTHOS_QUERY_MAX_DISJUNCTS": "100",
+		"SYNTHOS_QUERY_MAX_CONJUNCTS": "500",
+		"SYNTHOS_QUERY_TIMEOUT":       "30s",
 	}
 
 	// Load shell environment vars starting with "SYNTHOS_" into a key/value map.
@@ -77,6 +113,14 @@ func MakeAppConfig() AppConfig {
 		return d
 	}
 
+	parseIntOrPanic := func(s string) int {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing integer '%v': %v", s, err))
+		}
+		return i
+	}
+
 	timeRangeStrings := strings.Split(config["SYNTHOS_TIME_RANGES"], ",")
 	timeRanges := []time.Duration{}
 	for _, timeRangeString := range timeRangeStrings {
@@ -90,9 +134,22 @@ func MakeAppConfig() AppConfig {
 		MemDbConn:          config["SYNTHOS_MEMDB_CONN"],
 		HttpsRedirectUrl:   config["SYNTHOS_HTTPS_REDIRECT_URL"],
 		DataDir:            config["SYNTHOS_DATA_DIR"],
+		SnapshotKeepLast:   parseIntOrPanic(config["SYNTHOS_SNAPSHOT_KEEP_LAST"]),
+		SnapshotKeepDays:   parseIntOrPanic(config["SYNTHOS_SNAPSHOT_KEEP_DAYS"]),
+		EncryptionKey:      Secret(config["SYNTHOS_ENCRYPTION_KEY"]),
+		EncryptionKeyFile:  config["SYNTHOS_ENCRYPTION_KEY_FILE"],
+		ResultCacheSizeMB:  parseIntOrPanic(config["SYNTHOS_RESULT_CACHE_MB"]),
+		QueryMaxDisjuncts:  parseIntOrPanic(config["SYNTHOS_QUERY_MAX_DISJUNCTS"]),
+		QueryMaxConjuncts:  parseIntOrPanic(config["SYNTHOS_QUERY_MAX_CONJUNCTS"]),
+		QueryTimeout:       parseDurationOrPanic(config["SYNTHOS_QUERY_TIMEOUT"]),
 	}
 }
 
+// Returns the limits on the cost of each all_entity_info query.
+func (me *AppConfig) QueryBudget() QueryBudget {
+	return QueryBudget{MaxDisjuncts: me.QueryMaxDisjuncts, MaxConjuncts: me.QueryMaxConjuncts, Timeout: me.QueryTimeout}
+}
+
 // Returns true only if the app should use mock data instead of querying the
 // live content.
 func (me *AppConfig) UseMockData() bool {
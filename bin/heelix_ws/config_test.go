@@ -14,6 +14,11 @@ func TestMakeAppConfig(t *testing.T) {
 	os.Setenv("SYNTHOS_TIME_RANGES", "1h,2h,3h")
 	os.Setenv("SYNTHOS_HTTPS_REDIRECT_URL", "https://foo/bar")
 	os.Setenv("SYNTHOS_DATA_DIR", "/foo/bar/baz/")
+	os.Setenv("SYNTHOS_SNAPSHOT_KEEP_LAST", "5")
+	os.Setenv("SYNTHOS_SNAPSHOT_KEEP_DAYS", "30")
+	os.Setenv("SYNTHOS_ENCRYPTION_KEY_FILE", "/foo/keys.txt")
+	os.Setenv("SYNTHOS_RESULT_CACHE_MB", "16")
+	os.Setenv("SYNTHOS_QUERY_TIMEOUT", "5s")
 
 	cfg := MakeAppConfig()
 
@@ -24,6 +29,11 @@ func TestMakeAppConfig(t *testing.T) {
 	assert.Equal(t, []time.Duration{1 * time.Hour, 2 * time.Hour, 3 * time.Hour}, cfg.TimeRanges)
 	assert.Equal(t, "https://foo/bar", cfg.HttpsRedirectUrl)
 	assert.Equal(t, "/foo/bar/baz/", cfg.DataDir)
+	assert.Equal(t, 5, cfg.SnapshotKeepLast)
+	assert.Equal(t, 30, cfg.SnapshotKeepDays)
+	assert.Equal(t, "/foo/keys.txt", cfg.EncryptionKeyFile)
+	assert.Equal(t, 16, cfg.ResultCacheSizeMB)
+	assert.Equal(t, QueryBudget{MaxDisjuncts: 100, MaxConjuncts: 500, Timeout: 5 * time.Second}, cfg.QueryBudget())
 }
 
 func TestUseMockData(t *testing.T) {
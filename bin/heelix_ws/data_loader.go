@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"strings"
+	"time"
+)
+
+// Name of the directory (within AppConfig.DataDir) that corrupt data files
+// are moved to.
+const quarantineDirName = "quarantine"
+
+// Describes a saved data file (or set of files) that couldn't be loaded at
+// startup.
+type DataIssue struct {
+	// Which kind of data couldn't be loaded (globalDataKind or userDataKind).
+	Kind string
+	// Directory the data was being loaded from.
+	Dir   string
+	Error string
+	// Where the offending files were moved to.  Empty if they were left in
+	// place (e.g. because they're encrypted with a key that isn't configured).
+	QuarantinedFiles []string `json:",omitempty"`
+	Time             time.Time
+}
+
+// Describes how the saved data was loaded at startup.  If any of the saved
+// data couldn't be loaded, the app is running in a degraded state: it fell
+// back to older data, or to no saved data at all.
+type DataHealth struct {
+	Degraded bool
+	// Directory the global data was loaded from, or empty if the content
+	// buffer was filled directly from the content source.
+	GlobalDataDir string
+	// Directory the user data was loaded from, or empty if no saved user data
+	// could be loaded.
+	UserDataDir string
+	Issues      []DataIssue
+}
+
+// Returns true if data of the specified kind was found, but couldn't be
+// loaded.
+func (me DataHealth) HasIssues(kind string) bool {
+	for _, issue := range me.Issues {
+		if issue.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the application's saved data at startup.  If a data file turns out
+// to be corrupt or unreadable, it's moved to <DataDir>/quarantine/<timestamp>,
+// and the data is loaded from the newest snapshot that's still good instead.
+// In strict mode, the first error causes a panic instead, so that the app
+// fails fast and leaves the data as is.
+type DataLoader struct {
+	dataDir   string
+	snapshots *SnapshotStore
+	keyring   *Keyring
+	strict    bool
+	health    DataHealth
+
+	// Returns the current time.  Tests may override this.
+	now func() time.Time
+}
+
+// Creates a DataLoader for the data saved in dataDir.
+func NewDataLoader(dataDir string, snapshots *SnapshotStore, keyring *Keyring, strict bool) *DataLoader {
+	return &DataLoader{
+		dataDir:   dataDir,
+		snapshots: snapshots,
+		keyring:   keyring,
+		strict:    strict,
+		health:    DataHealth{Issues: []DataIssue{}},
+		now:       time.Now,
+	}
+}
+
+// Returns a summary of any problems found while loading the saved data.
+func (me *DataLoader) Health() DataHealth {
+	return me.health
+}
+
+// Loads the user db from loadDir or, failing that, from the newest older
+// snapshot that contains good user data.  Returns false if no saved user
+// data could be loaded.
+func (me *DataLoader) LoadUserDb(loadDir string) (userDb *UserDb, loaded bool) {
+	dir, loaded := me.load(userDataKind, loadDir, func(dir string) (err error) {
+		userDb, err = LoadUserDb(filepath.Join(dir, userDataFileName), me.keyring)
+		return err
+	})
+	me.health.UserDataDir = dir
+	return userDb, loaded
+}
+
+// Loads the global data (content buffer and entity DAOs) into the entity
+// manager from loadDir or, failing that, from the newest older snapshot that
+// contains good global data.  Returns false if no saved global data could be
+// loaded.
+func (me *DataLoader) LoadGlobalData(entityManager *server.EntityManager, loadDir string, now unixtime.Time) bool {
+	dir, loaded := me.load(globalDataKind, loadDir, func(dir string) error {
+		decryptedDir, cleanup, err := me.keyring.DecryptedDir(dir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		logger.Printf("Loading saved content from %v", dir)
+		err = callAndRecover(func() {
+			entityManager.LoadState(decryptedDir, now)
+			entityManager.ContentDAO.Load(decryptedDir)
+		})
+		if err == nil {
+			err = entityTypes.LoadDAOs(entityManager.ContentDAO, decryptedDir)
+		}
+		if err != nil {
+			// Don't leave partially loaded content behind.
+			entityManager.ContentBuffer().Clear()
+		}
+		return err
+	})
+	me.health.GlobalDataDir = dir
+	return loaded
+}
+
+// Tries to load data of the specified kind from each candidate directory in
+// turn (see candidateDirs()), until the load func succeeds.  Returns the
+// directory the data was loaded from.
+func (me *DataLoader) load(kind string, loadDir string, load func(dir string) error) (string, bool) {
+	for _, dir := range me.candidateDirs(kind, loadDir) {
+		err := me.verify(dir, kind)
+		if err == nil {
+			err = callAndRecover(func() {
+				if err := load(dir); err != nil {
+					panic(err)
+				}
+			})
+		}
+		if err == nil {
+			return dir, true
+		}
+
+		if me.strict {
+			panic(errors.New(fmt.Sprintf("Error loading %v data from %v: %v", kind, dir, err)))
+		}
+		logger.Printf("ERROR: couldn't load %v data from %v: %v", kind, dir, err)
+		me.reportIssue(kind, dir, err)
+	}
+
+	return "", false
+}
+
+// Returns the directories that data of the specified kind may be loaded
+// from, in order of preference: loadDir, followed by the other snapshots
+// that contain data of that kind, newest first, and finally the legacy data
+// saved directly in the data directory before snapshots were introduced.
+func (me *DataLoader) candidateDirs(kind string, loadDir string) []string {
+	dirs := []string{}
+	if containsData(loadDir, kind) {
+		dirs = append(dirs, loadDir)
+	}
+
+	snapshots, err := me.snapshots.List()
+	if err != nil {
+		logger.Printf("ERROR: couldn't list snapshots: %v", err)
+		return dirs
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Dir != loadDir && containsData(snapshot.Dir, kind) {
+			dirs = append(dirs, snapshot.Dir)
+		}
+	}
+	if me.dataDir != loadDir && containsData(me.dataDir, kind) {
+		dirs = append(dirs, me.dataDir)
+	}
+	return dirs
+}
+
+// Checks the files of the specified kind in dir against the checksums in
+// its manifest.  Directories without a manifest (i.e. the legacy data
+// directory) can't be verified up front.
+func (me *DataLoader) verify(dir string, kind string) error {
+	if !server.FileExists(filepath.Join(dir, snapshotManifestFileName)) {
+		return nil
+	}
+
+	manifest, err := readSnapshotManifest(dir)
+	if err != nil {
+		return &corruptManifestError{err}
+	}
+	if corruptFiles := findCorruptFiles(dir, manifest, kind); len(corruptFiles) > 0 {
+		return &corruptFilesError{corruptFiles}
+	}
+	return nil
+}
+
+// Records the failure to load data of the specified kind from dir, and moves
+// the offending files into quarantine.
+func (me *DataLoader) reportIssue(kind string, dir string, loadErr error) {
+	issue := DataIssue{Kind: kind, Dir: dir, Error: loadErr.Error(), Time: me.now()}
+
+	if _, isMissingKey := loadErr.(*MissingKeyError); !isMissingKey {
+		quarantinedFiles, err := me.quarantine(kind, dir, loadErr)
+		if err != nil {
+			logger.Printf("ERROR: couldn't quarantine %v data in %v: %v", kind, dir, err)
+		}
+		issue.QuarantinedFiles = quarantinedFiles
+	}
+
+	me.health.Degraded = true
+	me.health.Issues = append(me.health.Issues, issue)
+}
+
+// Moves the files that caused loadErr into the quarantine directory, and
+// returns their new paths.  If the specific files aren't known, all files of
+// the specified kind are moved.  Snapshots with an unreadable manifest are
+// moved in their entirety.
+func (me *DataLoader) quarantine(kind string, dir string, loadErr error) ([]string, error) {
+	quarantineDir := filepath.Join(me.dataDir, quarantineDirName, me.now().UTC().Format(snapshotNameFormat))
+
+	if _, isCorruptManifest := loadErr.(*corruptManifestError); isCorruptManifest {
+		dest := filepath.Join(quarantineDir, filepath.Base(dir))
+		logger.Printf("Quarantining snapshot %v to %v", dir, dest)
+		return []string{dest}, me.snapshots.RemoveSnapshot(dir, quarantineDir)
+	}
+
+	names, err := me.filesToQuarantine(kind, dir, loadErr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are grouped by the directory they were quarantined from.
+	destDir := filepath.Join(quarantineDir, filepath.Base(dir))
+	quarantinedFiles := []string{}
+	for _, name := range names {
+		logger.Printf("Quarantining %v to %v", filepath.Join(dir, name), filepath.Join(destDir, name))
+		quarantinedFiles = append(quarantinedFiles, filepath.Join(destDir, name))
+	}
+
+	if server.FileExists(filepath.Join(dir, snapshotManifestFileName)) {
+		return quarantinedFiles, me.snapshots.RemoveFiles(dir, names, destDir)
+	}
+	for _, name := range names {
+		if err := moveFile(filepath.Join(dir, name), filepath.Join(destDir, name)); err != nil {
+			return quarantinedFiles, err
+		}
+	}
+	return quarantinedFiles, nil
+}
+
+// Returns the names (relative to dir) of the files that caused loadErr.
+func (me *DataLoader) filesToQuarantine(kind string, dir string, loadErr error) ([]string, error) {
+	if corruptFilesErr, ok := loadErr.(*corruptFilesError); ok {
+		return corruptFilesErr.names, nil
+	}
+	if kind == userDataKind {
+		return []string{userDataFileName}, nil
+	}
+
+	// Global data consists of several files, and the one that caused the error
+	// isn't known.
+	if manifest, err := readSnapshotManifest(dir); err == nil {
+		names := []string{}
+		for _, f := range manifest.Files {
+			if f.Kind == kind {
+				names = append(names, f.Name)
+			}
+		}
+		return names, nil
+	}
+	return legacyGlobalDataFiles(dir)
+}
+
+// Returns the global data files in a legacy (pre-snapshot) data directory,
+// i.e. all of its files except for the user data and the data version.
+func legacyGlobalDataFiles(dataDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		isGlobalDataFile := !entry.IsDir() && entry.Name() != userDataFileName && !unencryptedFileNames[entry.Name()]
+		if isGlobalDataFile {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Calls f, converting any panic into an error.
+func callAndRecover(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = errors.New(fmt.Sprintf("%v", r))
+			}
+		}
+	}()
+	f()
+	return nil
+}
+
+type corruptManifestError struct {
+	err error
+}
+
+func (me *corruptManifestError) Error() string {
+	return fmt.Sprintf("Unreadable snapshot manifest: %v", me.err)
+}
+
+type corruptFilesError struct {
+	names []string
+}
+
+func (me *corruptFilesError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for %v", strings.Join(me.names, ", "))
+}
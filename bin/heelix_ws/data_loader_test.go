@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDataLoader_LoadUserDb(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	saveUserDbSnapshot(t, store, "good@example.com")
+	store.now = advanceClock(store.now, time.Minute)
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	userDb, loaded := loader.LoadUserDb(latest.Dir)
+	assert.True(t, loaded)
+	_, exists := userDb.GetUserByEmail("latest@example.com")
+	assert.True(t, exists)
+
+	health := loader.Health()
+	assert.False(t, health.Degraded)
+	assert.Equal(t, latest.Dir, health.UserDataDir)
+	assert.Equal(t, 0, len(health.Issues))
+}
+
+func TestDataLoader_LoadUserDb_fallsBackToOlderSnapshot(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	older := saveUserDbSnapshot(t, store, "good@example.com")
+	store.now = advanceClock(store.now, time.Minute)
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+
+	// Corrupt the latest user data.
+	ioutil.WriteFile(filepath.Join(latest.Dir, userDataFileName), []byte("[{garbage"), 0644)
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	userDb, loaded := loader.LoadUserDb(latest.Dir)
+	assert.True(t, loaded)
+	_, exists := userDb.GetUserByEmail("good@example.com")
+	assert.True(t, exists)
+
+	health := loader.Health()
+	assert.True(t, health.Degraded)
+	assert.Equal(t, older.Dir, health.UserDataDir)
+	assert.Equal(t, 1, len(health.Issues))
+	assert.Equal(t, userDataKind, health.Issues[0].Kind)
+	assert.Equal(t, latest.Dir, health.Issues[0].Dir)
+
+	// The corrupt file was quarantined, and removed from the snapshot.
+	quarantinedFile := filepath.Join(dataDir, quarantineDirName, "20261001T000100.000Z", latest.Name, userDataFileName)
+	assert.Equal(t, []string{quarantinedFile}, health.Issues[0].QuarantinedFiles)
+	assert.Equal(t, "[{garbage", readTestFile(t, filepath.Dir(quarantinedFile), userDataFileName))
+	assert.False(t, containsData(latest.Dir, userDataKind))
+	assert.Nil(t, verifySnapshot(latest))
+}
+
+func TestDataLoader_LoadUserDb_corruptManifest(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	older := saveUserDbSnapshot(t, store, "good@example.com")
+	store.now = advanceClock(store.now, time.Minute)
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+	ioutil.WriteFile(filepath.Join(latest.Dir, snapshotManifestFileName), []byte("{"), 0644)
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	_, loaded := loader.LoadUserDb(latest.Dir)
+	assert.True(t, loaded)
+	assert.Equal(t, older.Dir, loader.Health().UserDataDir)
+
+	// The whole snapshot was quarantined.
+	snapshots, _ := store.List()
+	assert.Equal(t, []Snapshot{older}, snapshots)
+	assert.False(t, fileExists(latest.Dir))
+}
+
+func TestDataLoader_LoadUserDb_noGoodData(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	// Legacy user data file, directly in the data directory.
+	ioutil.WriteFile(filepath.Join(dataDir, userDataFileName), []byte("not json"), 0644)
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	_, loaded := loader.LoadUserDb(dataDir)
+	assert.False(t, loaded)
+	assert.True(t, loader.Health().Degraded)
+	assert.Equal(t, "", loader.Health().UserDataDir)
+	assert.False(t, fileExists(filepath.Join(dataDir, userDataFileName)))
+}
+
+func TestDataLoader_LoadUserDb_fallsBackToLegacyData(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	legacyUserDb := NewUserDb()
+	legacyUserDb.AddUser("legacy@example.com", "password")
+	legacyUserDb.Save(filepath.Join(dataDir, userDataFileName), NewKeyring())
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+	ioutil.WriteFile(filepath.Join(latest.Dir, userDataFileName), []byte("[{garbage"), 0644)
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	userDb, loaded := loader.LoadUserDb(latest.Dir)
+	assert.True(t, loaded)
+	_, exists := userDb.GetUserByEmail("legacy@example.com")
+	assert.True(t, exists)
+	assert.Equal(t, dataDir, loader.Health().UserDataDir)
+}
+
+func TestCreateUserDb(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	// No user data was ever saved, so the test users are loaded.
+	userDb := createUserDb(dataDir, newDataLoaderForTest(dataDir, store, false))
+	_, exists := userDb.GetUserByEmail("support@synthostech.com")
+	assert.True(t, exists)
+
+	// The saved user data is corrupt, so no users at all are loaded.
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+	ioutil.WriteFile(filepath.Join(latest.Dir, userDataFileName), []byte("[{garbage"), 0644)
+	loader := newDataLoaderForTest(dataDir, store, false)
+	userDb = createUserDb(latest.Dir, loader)
+	_, exists = userDb.GetUserByEmail("support@synthostech.com")
+	assert.False(t, exists)
+	assert.True(t, loader.Health().Degraded)
+}
+
+func TestDataLoader_LoadUserDb_missingKey(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	userDb := NewUserDb()
+	userDb.Save(filepath.Join(dataDir, userDataFileName), newKeyringForTest(t, testKey1))
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	_, loaded := loader.LoadUserDb(dataDir)
+	assert.False(t, loaded)
+
+	// Files encrypted with an unknown key aren't corrupt, so they're left in place.
+	health := loader.Health()
+	assert.True(t, health.Degraded)
+	assert.Equal(t, 0, len(health.Issues[0].QuarantinedFiles))
+	assert.True(t, fileExists(filepath.Join(dataDir, userDataFileName)))
+}
+
+func TestDataLoader_strict(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	latest := saveUserDbSnapshot(t, store, "latest@example.com")
+	ioutil.WriteFile(filepath.Join(latest.Dir, userDataFileName), []byte("[{garbage"), 0644)
+
+	loader := newDataLoaderForTest(dataDir, store, true)
+	assert.Panics(t, func() { loader.LoadUserDb(latest.Dir) })
+
+	// Nothing was quarantined.
+	assert.Equal(t, "[{garbage", readTestFile(t, latest.Dir, userDataFileName))
+}
+
+func TestDataLoader_load_recoversFromPanic(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	older, _ := store.Save(globalDataKind, writeTestFile("docs.dat", "older"))
+	store.now = advanceClock(store.now, time.Minute)
+	latest, _ := store.Save(globalDataKind, writeTestFile("docs.dat", "latest"))
+
+	loader := newDataLoaderForTest(dataDir, store, false)
+	dir, loaded := loader.load(globalDataKind, latest.Dir, func(dir string) error {
+		if dir == latest.Dir {
+			panic(errors.New("unexpected EOF"))
+		}
+		return nil
+	})
+	assert.True(t, loaded)
+	assert.Equal(t, older.Dir, dir)
+	assert.Equal(t, "unexpected EOF", loader.Health().Issues[0].Error)
+
+	// The file that caused the panic isn't known, so all global data files were quarantined.
+	assert.False(t, containsData(latest.Dir, globalDataKind))
+	assert.False(t, fileExists(filepath.Join(latest.Dir, "docs.dat")))
+}
+
+func TestDataLoader_upgradeFromLegacyData(t *testing.T) {
+	for _, savedKind := range dataKinds {
+		store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+		defer os.RemoveAll(dataDir)
+
+		// Data saved before snapshots existed, directly in the data directory.
+		legacyUserDb := NewUserDb()
+		legacyUserDb.AddUser("legacy@example.com", "password")
+		assert.Nil(t, legacyUserDb.Save(filepath.Join(dataDir, userDataFileName), NewKeyring()))
+		assert.Nil(t, writeTestFile("docs.dat", "docs-legacy")(dataDir))
+
+		// The first save after the upgrade only writes one kind of data...
+		if savedKind == userDataKind {
+			saveUserDbSnapshot(t, store, "new@example.com")
+		} else {
+			_, err := store.Save(globalDataKind, writeTestFile("docs.dat", "docs-new"))
+			assert.Nil(t, err)
+		}
+
+		// ...but after a restart, the other kind is still loaded from the legacy data.
+		loadDir, _ := store.ResolveLoadDir("", dataDir)
+		assert.NotEqual(t, dataDir, loadDir)
+		assert.True(t, containsData(loadDir, globalDataKind), savedKind)
+		assert.True(t, containsData(loadDir, userDataKind), savedKind)
+		latest, _ := store.Latest()
+		assert.Nil(t, verifySnapshot(latest))
+
+		userDb, loaded := newDataLoaderForTest(dataDir, store, false).LoadUserDb(loadDir)
+		assert.True(t, loaded)
+		if savedKind == userDataKind {
+			_, exists := userDb.GetUserByEmail("new@example.com")
+			assert.True(t, exists)
+			assert.Equal(t, "docs-legacy", readTestFile(t, loadDir, "docs.dat"))
+		} else {
+			_, exists := userDb.GetUserByEmail("legacy@example.com")
+			assert.True(t, exists)
+			assert.Equal(t, "docs-new", readTestFile(t, loadDir, "docs.dat"))
+		}
+	}
+}
+
+//
+// TEST HELPERS
+//
+
+func newDataLoaderForTest(dataDir string, store *SnapshotStore, strict bool) *DataLoader {
+	loader := NewDataLoader(dataDir, store, NewKeyring(), strict)
+	loader.now = store.now
+	return loader
+}
+
+func saveUserDbSnapshot(t *testing.T, store *SnapshotStore, email string) Snapshot {
+	userDb := NewUserDb()
+	userDb.AddUser(email, "password")
+	snapshot, err := store.Save(userDataKind, func(dir string) error {
+		return userDb.Save(filepath.Join(dir, userDataFileName), NewKeyring())
+	})
+	assert.Nil(t, err)
+	return snapshot
+}
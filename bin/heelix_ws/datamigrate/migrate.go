@@ -24,17 +24,19 @@ func WriteDataVersion(dataDir string) {
 	server.Must(ioutil.WriteFile(getVersionFilePath(dataDir), []byte(DATA_VERSION), 0644))
 }
 
-func Migrate(dataDir string) {
+// Migrates the data in dataDir to DATA_VERSION, in place.  Returns false if
+// there was nothing to migrate.
+func Migrate(dataDir string) bool {
 	if !server.FileExists(dataDir) {
 		logger.Printf("Data directory '%v' doesn't appear to exist, so aborting migration.", dataDir)
-		return
+		return false
 	}
 
 	logger.Printf("Migrating data in %v to version %v", dataDir, DATA_VERSION)
 	deployedDataVersion := readDataVersion(dataDir)
 	if deployedDataVersion == DATA_VERSION {
 		logger.Printf("Actually, data format was already up-to-date, so skipping migration.")
-		return
+		return false
 	}
 
 	migrateEntityGraph(dataDir, "person")
@@ -52,6 +54,7 @@ func Migrate(dataDir string) {
 	WriteDataVersion(dataDir)
 
 	logger.Printf("Data in %v successfully migrated to version %v", dataDir, DATA_VERSION)
+	return true
 }
 
 func migrateEntityGraph(dataDir string, entityType string) {
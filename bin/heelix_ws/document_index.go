@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the file that the document index is saved to, alongside the rest
+// of the global data (see SaveGlobalData).
+const documentIndexFileName = "document_index.json"
+
+// Indexes the documents in the content buffer by the document fields that
+// the ContentBuffer doesn't expose (e.g. their headlines and sources), so that
+// queries can filter on them.  Documents are added as they're fetched from
+// the content source (see IndexingContentSource), and removed once they've
+// been dropped from the content buffer (see RemoveDocumentsOlderThan).
+type DocumentIndex struct {
+	lock sync.RWMutex
+	docs map[int]*indexedDocument
+	// Maps each (lower-case) headline token to the documents whose headline
+	// contains it.
+	headlineTokens map[string]*server.IntSet
+}
+
+// The indexed fields of a single document.
+type indexedDocument struct {
+	InsertDate int32
+	Url        string
+	Source     string
+	Headline   string
+
+	// The headline's tokens, in order (see tokenizeText).
+	headlineTokens []string
+}
+
+// Returns the indexed fields as the document with the specified id.
+func (me *indexedDocument) document(docId int) server.Document {
+	return server.Document{
+		Id:         docId,
+		InsertDate: unixtime.Unix(me.InsertDate),
+		Url:        me.Url,
+		Source:     me.Source,
+		Headline:   me.Headline,
+	}
+}
+
+// Creates an empty DocumentIndex.
+func NewDocumentIndex() *DocumentIndex {
+	return &DocumentIndex{
+		docs:           map[int]*indexedDocument{},
+		headlineTokens: map[string]*server.IntSet{},
+	}
+}
+
+// Adds the documents to the index.  Documents that are already indexed are
+// replaced.
+func (me *DocumentIndex) AddDocuments(docs []server.Document) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for _, doc := range docs {
+		me.add(doc.Id, &indexedDocument{InsertDate: doc.InsertDate.Unix(), Url: doc.Url, Source: doc.Source, Headline: doc.Headline})
+	}
+}
+
+func (me *DocumentIndex) add(docId int, doc *indexedDocument) {
+	if _, exists := me.docs[docId]; exists {
+		me.remove(docId)
+	}
+
+	doc.headlineTokens = tokenizeText(doc.Headline)
+	me.docs[docId] = doc
+	for _, token := range doc.headlineTokens {
+		docIds, exists := me.headlineTokens[token]
+		if !exists {
+			docIds = server.NewIntSet()
+			me.headlineTokens[token] = docIds
+		}
+		docIds.Put(docId)
+	}
+}
+
+func (me *DocumentIndex) remove(docId int) {
+	doc, exists := me.docs[docId]
+	if !exists {
+		return
+	}
+
+	delete(me.docs, docId)
+	for _, token := range doc.headlineTokens {
+		if docIds, exists := me.headlineTokens[token]; exists {
+			docIds.Remove(docId)
+			if docIds.Size() == 0 {
+				delete(me.headlineTokens, token)
+			}
+		}
+	}
+}
+
+// Removes the documents inserted before t, i.e. the ones that the content
+// buffer no longer holds.
+func (me *DocumentIndex) RemoveDocumentsOlderThan(t unixtime.Time) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for docId, doc := range me.docs {
+		if doc.InsertDate < t.Unix() {
+			me.remove(docId)
+		}
+	}
+}
+
+// Returns the ids of the indexed documents inserted at or after t.
+func (me *DocumentIndex) DocumentIdsInsertedSince(t unixtime.Time) *server.IntSet {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	docIds := server.NewIntSet()
+	for docId, doc := range me.docs {
+		if doc.InsertDate >= t.Unix() {
+			docIds.Put(docId)
+		}
+	}
+	return docIds
+}
+
+// Returns the number of indexed documents.
+func (me *DocumentIndex) DocumentCount() int {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	return len(me.docs)
+}
+
+// Returns a copy of g with only the documents that match the keyword query.
+// Documents that aren't in the index can't match (see copyDocuments).
+func (me *DocumentIndex) FilterOnKeywords(g *server.ContentBuffer, query keywordQuery) *server.ContentBuffer {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	return me.copyDocuments(g, me.matchKeywords(query))
+}
+
+// Returns a copy of g with only the documents from the included sources (if
+// any are specified), and without the documents from the excluded sources.
+// Documents that aren't in the index only pass if no sources are included.
+func (me *DocumentIndex) FilterOnSources(g *server.ContentBuffer, included []string, excluded []string) *server.ContentBuffer {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	toSet := func(sources []string) map[string]bool {
+		set := map[string]bool{}
+		for _, source := range sources {
+			set[normalizeSource(source)] = true
+		}
+		return set
+	}
+	includedSet, excludedSet := toSet(included), toSet(excluded)
+
+	if len(includedSet) == 0 {
+		// Most of g passes, so it's cheaper to remove the excluded documents
+		// from a copy of it.
+		result := server.NewContentBuffer().Union(g)
+		for docId, doc := range me.docs {
+			if excludedSet[normalizeSource(doc.Source)] {
+				result.RemoveDocument(docId)
+			}
+		}
+		return result
+	}
+
+	matches := server.NewIntSet()
+	for docId, doc := range me.docs {
+		source := normalizeSource(doc.Source)
+		if includedSet[source] && !excludedSet[source] {
+			matches.Put(docId)
+		}
+	}
+	return me.copyDocuments(g, matches)
+}
+
+// Number of indexed documents from a news source.
+type SourceCount struct {
+	Source        string
+	DocumentCount int
+}
+
+// Returns the news sources of the indexed documents, with the number of
+// documents from each, most documents first.
+func (me *DocumentIndex) CountSources() []SourceCount {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	counts := map[string]*SourceCount{}
+	for _, doc := range me.docs {
+		if doc.Source == "" {
+			continue
+		}
+		// Variants of a name that differ only in case are counted together.
+		key := normalizeSource(doc.Source)
+		if _, exists := counts[key]; !exists {
+			counts[key] = &SourceCount{Source: doc.Source}
+		}
+		counts[key].DocumentCount++
+	}
+
+	sourceCounts := []SourceCount{}
+	for _, count := range counts {
+		sourceCounts = append(sourceCounts, *count)
+	}
+	sort.Sort(byDocumentCount(sourceCounts))
+	return sourceCounts
+}
+
+// Sorts source counts by descending document count, then by source name.
+type byDocumentCount []SourceCount
+
+func (a byDocumentCount) Len() int      { return len(a) }
+func (a byDocumentCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDocumentCount) Less(i, j int) bool {
+	if a[i].DocumentCount != a[j].DocumentCount {
+		return a[i].DocumentCount > a[j].DocumentCount
+	}
+	return a[i].Source < a[j].Source
+}
+
+func normalizeSource(source string) string {
+	return strings.ToLower(strings.TrimSpace(source))
+}
+
+// Returns a copy of g with only the documents whose ids are given, and that
+// are in the index (see copyDocuments).
+func (me *DocumentIndex) KeepDocuments(g *server.ContentBuffer, docIds *server.IntSet) *server.ContentBuffer {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	return me.copyDocuments(g, docIds)
+}
+
+// Returns a new content buffer with the documents of g whose ids are given,
+// which are rebuilt from the index and g's entity graphs.  Documents that
+// aren't in the index are left out, as are the ones that don't mention any
+// entities, since g doesn't tell whether it holds those.  Must be called with
+// the lock held.
+func (me *DocumentIndex) copyDocuments(g *server.ContentBuffer, docIds *server.IntSet) *server.ContentBuffer {
+	result := server.NewContentBuffer()
+	docIds.ForEach(func(docId int) {
+		doc, exists := me.docs[docId]
+		if !exists || entityTypes.MentionCount(g, docId) == 0 {
+			return
+		}
+		result.AddNewsArticle(server.NewsArticle{
+			Document: doc.document(docId),
+			Persons:  makeEntities(g.PersonGraph.EntityIdsForDocument(docId).Items()),
+			Orgs:     makeEntities(g.OrgGraph.EntityIdsForDocument(docId).Items()),
+			Places:   makeEntities(g.PlaceGraph.EntityIdsForDocument(docId).Items()),
+		})
+	})
+	return result
+}
+
+// Saves the index to the specified file, encrypting it if the keyring is
+// enabled.
+func (me *DocumentIndex) Save(filePath string, keyring *Keyring) error {
+	me.lock.RLock()
+	b, err := json.Marshal(me.docs)
+	me.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return keyring.WriteFile(filePath, b)
+}
+
+// Adds the documents saved in the specified file (see Save()) to the index.
+func (me *DocumentIndex) Load(filePath string, keyring *Keyring) error {
+	b, err := keyring.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	docs := map[int]*indexedDocument{}
+	if err := json.Unmarshal(b, &docs); err != nil {
+		return errors.New(fmt.Sprintf("Error decoding %v: %v", filePath, err))
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	for docId, doc := range docs {
+		// Documents fetched since startup are more recent than the saved ones.
+		if _, exists := me.docs[docId]; !exists {
+			me.add(docId, doc)
+		}
+	}
+	return nil
+}
+
+// A ContentSource that adds the documents it fetches to a DocumentIndex, and
+// the places they mention to a PlaceIndex, on their way to the content buffer.
+type IndexingContentSource struct {
+	TargetContentSource server.ContentSource
+	Index               *DocumentIndex
+	Places              *PlaceIndex
+}
+
+func (me *IndexingContentSource) FetchNewsArticles(startTime unixtime.Time, endTime unixtime.Time) []server.NewsArticle {
+	newsArticles := me.TargetContentSource.FetchNewsArticles(startTime, endTime)
+
+	docs := make([]server.Document, 0, len(newsArticles))
+	for _, newsArticle := range newsArticles {
+		docs = append(docs, newsArticle.Document)
+		me.Places.AddPlaces(newsArticle.Places)
+	}
+	me.Index.AddDocuments(docs)
+
+	return newsArticles
+}
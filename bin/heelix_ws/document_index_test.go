@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+)
+
+func TestDocumentIndex_FilterOnKeywords(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Headline: "Boeing workers strike"},
+		server.Document{Id: 2, Headline: "Strike ends"},
+		server.Document{Id: 3, Headline: "Boeing unveils new jet"},
+		server.Document{Id: 5, Headline: "Strike called off"},
+	})
+
+	// Doc 4 isn't indexed, and doc 5 isn't in g, so they can't match.
+	query, _ := parseKeywordQuery("strike")
+	result := docIndex.FilterOnKeywords(g, query)
+	assert.Equal(t, 2, result.DocumentCount())
+	assert.Equal(t, []int{1, 2}, result.OrgGraph.DocumentIdsForEntity(1).Items())
+	assert.Equal(t, []int{2}, result.OrgGraph.DocumentIdsForEntity(2).Items())
+	assert.Equal(t, 4, g.DocumentCount())
+}
+
+func TestDocumentIndex_FilterOnSources(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Source: "Reuters"},
+		server.Document{Id: 2, Source: "BBC News"},
+		server.Document{Id: 3, Source: "The Onion"},
+	})
+
+	// Doc 4 isn't indexed, so its source is unknown.
+	assert.Equal(t, 2, docIndex.FilterOnSources(g, []string{"reuters", " BBC News"}, nil).DocumentCount())
+	assert.Equal(t, 3, docIndex.FilterOnSources(g, nil, []string{"The Onion"}).DocumentCount())
+	assert.Equal(t, 1, docIndex.FilterOnSources(g, []string{"Reuters", "BBC News"}, []string{"BBC news"}).DocumentCount())
+
+	result := docIndex.FilterOnSources(g, []string{"BBC News"}, nil)
+	assert.Equal(t, []int{2}, result.OrgGraph.DocumentIdsForEntity(1).Items())
+	assert.Equal(t, []int{2}, result.OrgGraph.DocumentIdsForEntity(2).Items())
+}
+
+func TestDocumentIndex_CountSources(t *testing.T) {
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Source: "Reuters"},
+		server.Document{Id: 2, Source: "BBC News"},
+		server.Document{Id: 3, Source: "reuters"},
+		server.Document{Id: 4, Source: "Wired.com"},
+		server.Document{Id: 5},
+	})
+
+	sourceCounts := docIndex.CountSources()
+	assert.Equal(t, 3, len(sourceCounts))
+	assert.Equal(t, 2, sourceCounts[0].DocumentCount)
+	assert.Equal(t, SourceCount{Source: "BBC News", DocumentCount: 1}, sourceCounts[1])
+	assert.Equal(t, SourceCount{Source: "Wired.com", DocumentCount: 1}, sourceCounts[2])
+}
+
+func TestDocumentIndex_RemoveDocumentsOlderThan(t *testing.T) {
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Headline: "Old news", InsertDate: unixtime.Unix(1000)},
+		server.Document{Id: 2, Headline: "New news", InsertDate: unixtime.Unix(2000)},
+	})
+
+	docIndex.RemoveDocumentsOlderThan(unixtime.Unix(1500))
+	assert.Equal(t, 1, docIndex.DocumentCount())
+	_, exists := docIndex.headlineTokens["old"]
+	assert.False(t, exists)
+	assert.Equal(t, 1, docIndex.headlineTokens["news"].Size())
+}
+
+func TestDocumentIndex_saveAndLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "heelix_document_index")
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, documentIndexFileName)
+
+	for _, keyring := range []*Keyring{NewKeyring(), newKeyringForTest(t, testKey1)} {
+		docIndex := NewDocumentIndex()
+		docIndex.AddDocuments([]server.Document{server.Document{Id: 1, Headline: "Boeing workers strike", Source: "Reuters"}})
+		assert.Nil(t, docIndex.Save(filePath, keyring))
+
+		// Documents fetched before the saved index was loaded take precedence.
+		loadedIndex := NewDocumentIndex()
+		loadedIndex.AddDocuments([]server.Document{server.Document{Id: 1, Headline: "Boeing workers strike again"}})
+		assert.Nil(t, loadedIndex.Load(filePath, keyring))
+		assert.Equal(t, "Boeing workers strike again", loadedIndex.docs[1].Headline)
+
+		loadedIndex = NewDocumentIndex()
+		assert.Nil(t, loadedIndex.Load(filePath, keyring))
+		assert.Equal(t, "Reuters", loadedIndex.docs[1].Source)
+		assert.True(t, loadedIndex.headlineTokens["strike"].Contains(1))
+	}
+}
+
+func TestIndexingContentSource(t *testing.T) {
+	docIndex := NewDocumentIndex()
+	contentSource := &IndexingContentSource{TargetContentSource: &fakeContentSource{}, Index: docIndex, Places: NewPlaceIndex()}
+
+	newsArticles := contentSource.FetchNewsArticles(unixtime.Unix(0), unixtime.Unix(1000))
+	assert.Equal(t, 2, len(newsArticles))
+	assert.Equal(t, 2, docIndex.DocumentCount())
+}
+
+//
+// TEST HELPERS
+//
+
+type fakeContentSource struct{}
+
+func (me *fakeContentSource) FetchNewsArticles(startTime unixtime.Time, endTime unixtime.Time) []server.NewsArticle {
+	return []server.NewsArticle{
+		server.NewsArticle{Document: server.Document{Id: 1, Headline: "Boeing workers strike"}},
+		server.NewsArticle{Document: server.Document{Id: 2, Headline: "Strike ends"}},
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every encrypted data file starts with this magic string, which is how
+// encrypted files are told apart from legacy (plaintext) ones.
+const encryptedFileMagic = "HXENC"
+
+// Version of the encrypted file envelope format.
+const encryptedFileVersion = 1
+
+// Files that are never encrypted, because they're read by tooling that
+// doesn't know about encryption (e.g. the data migration tool) or only
+// contain metadata.
+var unencryptedFileNames = map[string]bool{
+	"version.txt":            true,
+	snapshotManifestFileName: true,
+}
+
+// Returned when data is encrypted with a key that isn't in the keyring.  This
+// usually means the keys are misconfigured, rather than that the data is
+// corrupt.
+type MissingKeyError struct {
+	KeyId    string
+	FilePath string
+}
+
+func (me *MissingKeyError) Error() string {
+	if me.FilePath == "" {
+		return fmt.Sprintf("Data is encrypted with key '%v', which isn't configured", me.KeyId)
+	}
+	return fmt.Sprintf("%v is encrypted with key '%v', which isn't configured", me.FilePath, me.KeyId)
+}
+
+// A string that's redacted when printed (e.g. when AppConfig is logged).
+type Secret string
+
+func (me Secret) String() string {
+	if me == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// Holds the keys used to encrypt and decrypt the application's data files.
+// Files are encrypted with the active key, and the id of that key is stored
+// in each file's envelope, so that after a key is rotated, files encrypted
+// with an older key can still be read (as long as the older key is still in
+// the keyring).  An empty keyring doesn't encrypt anything.
+//
+// The envelope format of an encrypted file is:
+//
+//	"HXENC" | version (1 byte) | key id length (1 byte) | key id | nonce | ciphertext
+//
+// The ciphertext is AES-256-GCM, with the header (everything before the
+// nonce) as additional authenticated data.
+type Keyring struct {
+	activeKeyId string
+	keys        map[string]cipher.AEAD
+}
+
+// Creates an empty keyring, which leaves data files unencrypted.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]cipher.AEAD{}}
+}
+
+// Creates a keyring from the keys configured in SYNTHOS_ENCRYPTION_KEY and
+// the key file named by SYNTHOS_ENCRYPTION_KEY_FILE.  The active key is the
+// first key in SYNTHOS_ENCRYPTION_KEY or, if that's empty, the first key in
+// the key file.
+func LoadKeyring(cfg AppConfig) (*Keyring, error) {
+	keyring := NewKeyring()
+
+	if err := keyring.AddKeys(strings.Split(string(cfg.EncryptionKey), ",")); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error in SYNTHOS_ENCRYPTION_KEY: %v", err))
+	}
+
+	if cfg.EncryptionKeyFile != "" {
+		b, err := ioutil.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading encryption key file: %v", err))
+		}
+		if err := keyring.AddKeys(strings.Split(string(b), "\n")); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error in encryption key file %v: %v", cfg.EncryptionKeyFile, err))
+		}
+	}
+
+	return keyring, nil
+}
+
+// Adds keys to the keyring.  Each entry has the format "<key id>:<key>",
+// where the key is 32 hex-encoded bytes.  Blank entries and entries starting
+// with '#' are ignored.  If the keyring doesn't have an active key yet, the
+// first key added becomes the active one.
+func (me *Keyring) AddKeys(entries []string) error {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		tokens := strings.SplitN(entry, ":", 2)
+		if len(tokens) != 2 {
+			return errors.New("Expected key in the format '<key id>:<hex-encoded key>'")
+		}
+		keyId := strings.TrimSpace(tokens[0])
+		if keyId == "" || len(keyId) > 255 {
+			return errors.New(fmt.Sprintf("Invalid key id: '%v'", keyId))
+		}
+		if _, exists := me.keys[keyId]; exists {
+			return errors.New(fmt.Sprintf("Duplicate key id: '%v'", keyId))
+		}
+
+		key, err := hex.DecodeString(strings.TrimSpace(tokens[1]))
+		if err != nil || len(key) != 32 {
+			return errors.New(fmt.Sprintf("Key '%v' must be 32 hex-encoded bytes", keyId))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+
+		me.keys[keyId] = aead
+		if me.activeKeyId == "" {
+			me.activeKeyId = keyId
+		}
+	}
+	return nil
+}
+
+// Returns true if data files are encrypted when written.
+func (me *Keyring) Enabled() bool {
+	return me.activeKeyId != ""
+}
+
+// Returns the id of the key that new files are encrypted with.
+func (me *Keyring) ActiveKeyId() string {
+	return me.activeKeyId
+}
+
+// Encrypts the data with the active key.  If the keyring is empty, the data
+// is returned as is.
+func (me *Keyring) Encrypt(data []byte) ([]byte, error) {
+	if !me.Enabled() {
+		return data, nil
+	}
+
+	aead := me.keys[me.activeKeyId]
+	header := makeEnvelopeHeader(me.activeKeyId)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := append(header, nonce...)
+	return aead.Seal(envelope, nonce, data, header), nil
+}
+
+// Decrypts data that was encrypted by Encrypt().  Data without an envelope
+// (i.e. legacy plaintext) is returned as is.
+func (me *Keyring) Decrypt(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+
+	headerLen := len(encryptedFileMagic) + 2
+	if len(data) < headerLen {
+		return nil, errors.New("Encrypted data is truncated")
+	}
+	version := data[len(encryptedFileMagic)]
+	if version != encryptedFileVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported encryption envelope version: %v", version))
+	}
+	keyIdLen := int(data[len(encryptedFileMagic)+1])
+	if len(data) < headerLen+keyIdLen {
+		return nil, errors.New("Encrypted data is truncated")
+	}
+	keyId := string(data[headerLen : headerLen+keyIdLen])
+	header := data[:headerLen+keyIdLen]
+
+	aead, exists := me.keys[keyId]
+	if !exists {
+		return nil, &MissingKeyError{KeyId: keyId}
+	}
+
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("Encrypted data is truncated")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error decrypting data with key '%v': %v", keyId, err))
+	}
+	return plaintext, nil
+}
+
+// Reads the file, decrypting it if it's encrypted.
+func (me *Keyring) ReadFile(filePath string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := me.Decrypt(b)
+	if missingKeyErr, ok := err.(*MissingKeyError); ok {
+		missingKeyErr.FilePath = filePath
+		return nil, missingKeyErr
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", filePath, err))
+	}
+	return plaintext, nil
+}
+
+// Writes the data to the file, encrypting it if the keyring is enabled.
+func (me *Keyring) WriteFile(filePath string, data []byte) error {
+	b, err := me.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, b, 0600)
+}
+
+// Encrypts, in place, every plaintext file under dir.  This is used for data
+// files written by code that doesn't know about encryption (e.g.
+// ContentBuffer.SaveState).  Does nothing if the keyring is empty.
+func (me *Keyring) EncryptFilesInDir(dir string) error {
+	if !me.Enabled() {
+		return nil
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || unencryptedFileNames[info.Name()] {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil || isEncrypted(b) {
+			return err
+		}
+		return me.WriteFile(path, b)
+	})
+}
+
+// Returns a directory with the same data files as dir, but decrypted, so
+// that they can be loaded by code that doesn't know about encryption (e.g.
+// ContentBuffer.LoadState).  If none of the files in dir are encrypted, dir
+// itself is returned.  Otherwise the files are decrypted into a private
+// temp directory, which the returned cleanup func deletes.  The snapshots and
+// quarantine directories are skipped when dir is the (legacy) data directory.
+func (me *Keyring) DecryptedDir(dir string) (decryptedDir string, cleanup func(), err error) {
+	noop := func() {}
+
+	encryptedFiles, err := findEncryptedFiles(dir)
+	if err != nil {
+		return "", noop, err
+	}
+	if len(encryptedFiles) == 0 {
+		return dir, noop, nil
+	}
+
+	// ioutil.TempDir creates the directory with 0700 permissions.
+	tempDir, err := ioutil.TempDir("", "heelix_decrypted")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup = func() { os.RemoveAll(tempDir) }
+
+	err = walkDataFiles(dir, func(path string, name string) error {
+		dest := filepath.Join(tempDir, name)
+		if !encryptedFiles[name] {
+			return linkOrCopyFile(path, dest)
+		}
+
+		plaintext, err := me.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, plaintext, 0600)
+	})
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+
+	return tempDir, cleanup, nil
+}
+
+// Returns the set of files under dir (relative paths) that are encrypted.
+func findEncryptedFiles(dir string) (map[string]bool, error) {
+	encryptedFiles := map[string]bool{}
+	err := walkDataFiles(dir, func(path string, name string) error {
+		isEncrypted, err := isEncryptedFile(path)
+		if isEncrypted {
+			encryptedFiles[name] = true
+		}
+		return err
+	})
+	return encryptedFiles, err
+}
+
+// Calls f with the full and relative path of each file under dir, skipping
+// the snapshots and quarantine directories.
+func walkDataFiles(dir string, f func(path string, name string) error) error {
+	skippedDirs := map[string]bool{
+		filepath.Join(dir, snapshotsDirName):  true,
+		filepath.Join(dir, quarantineDirName): true,
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if skippedDirs[path] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return f(path, name)
+	})
+}
+
+func isEncryptedFile(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptedFileMagic))
+	n, err := io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	return err == nil && isEncrypted(magic[:n]), err
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedFileMagic))
+}
+
+func makeEnvelopeHeader(keyId string) []byte {
+	header := []byte(encryptedFileMagic)
+	header = append(header, encryptedFileVersion, byte(len(keyId)))
+	return append(header, keyId...)
+}
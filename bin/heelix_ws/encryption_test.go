@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey1 = "key1:" + strings.Repeat("01", 32)
+var testKey2 = "key2:" + strings.Repeat("02", 32)
+
+func TestKeyring_EncryptAndDecrypt(t *testing.T) {
+	keyring := newKeyringForTest(t, testKey1)
+
+	ciphertext, err := keyring.Encrypt([]byte("secret stuff"))
+	assert.Nil(t, err)
+	assert.True(t, isEncrypted(ciphertext))
+	assert.False(t, strings.Contains(string(ciphertext), "secret stuff"))
+
+	plaintext, err := keyring.Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret stuff", string(plaintext))
+
+	// Tampered or truncated ciphertext is detected.
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = keyring.Decrypt(tampered)
+	assert.NotNil(t, err)
+
+	_, err = keyring.Decrypt(ciphertext[:len(encryptedFileMagic)+3])
+	assert.NotNil(t, err)
+}
+
+func TestKeyring_DecryptLegacyPlaintext(t *testing.T) {
+	plaintext, err := newKeyringForTest(t, testKey1).Decrypt([]byte(`[{"Id": 1}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"Id": 1}]`, string(plaintext))
+}
+
+func TestKeyring_disabled(t *testing.T) {
+	keyring := NewKeyring()
+	assert.False(t, keyring.Enabled())
+
+	data, err := keyring.Encrypt([]byte("not a secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "not a secret", string(data))
+}
+
+func TestKeyring_keyRotation(t *testing.T) {
+	oldKeyring := newKeyringForTest(t, testKey1)
+	ciphertext, _ := oldKeyring.Encrypt([]byte("encrypted with key1"))
+
+	// key2 is now the active key, but key1 can still be used for decryption.
+	newKeyring := newKeyringForTest(t, testKey2, testKey1)
+	assert.Equal(t, "key2", newKeyring.ActiveKeyId())
+	plaintext, err := newKeyring.Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "encrypted with key1", string(plaintext))
+
+	// Without key1, the data can't be decrypted.
+	_, err = newKeyringForTest(t, testKey2).Decrypt(ciphertext)
+	assert.NotNil(t, err)
+}
+
+func TestKeyring_AddKeys_invalid(t *testing.T) {
+	assert.NotNil(t, NewKeyring().AddKeys([]string{"no-key-id"}))
+	assert.NotNil(t, NewKeyring().AddKeys([]string{"k:not-hex"}))
+	assert.NotNil(t, NewKeyring().AddKeys([]string{"k:0102"}))
+	assert.NotNil(t, NewKeyring().AddKeys([]string{testKey1, testKey1}))
+	assert.Nil(t, NewKeyring().AddKeys([]string{"", "# comment", testKey1}))
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyFile, err := ioutil.TempFile("", "heelix_keys")
+	assert.Nil(t, err)
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString("# old keys\n" + testKey2 + "\n")
+	keyFile.Close()
+
+	keyring, err := LoadKeyring(AppConfig{EncryptionKey: Secret(testKey1), EncryptionKeyFile: keyFile.Name()})
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", keyring.ActiveKeyId())
+	assert.Equal(t, 2, len(keyring.keys))
+
+	_, err = LoadKeyring(AppConfig{EncryptionKeyFile: "/does/not/exist"})
+	assert.NotNil(t, err)
+}
+
+func TestSecret_String(t *testing.T) {
+	assert.Equal(t, "<redacted>", Secret(testKey1).String())
+	assert.Equal(t, "", Secret("").String())
+}
+
+func TestKeyring_EncryptFilesInDir_and_DecryptedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heelix_encryption")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyring := newKeyringForTest(t, testKey1)
+	os.MkdirAll(filepath.Join(dir, "graphs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docs.dat"), []byte("docs"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "graphs", "PersonGraph.dat"), []byte("persons"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "version.txt"), []byte("2"), 0644)
+
+	// Plaintext directories are loaded as is.
+	decryptedDir, cleanup, err := keyring.DecryptedDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, dir, decryptedDir)
+	cleanup()
+
+	assert.Nil(t, keyring.EncryptFilesInDir(dir))
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "docs.dat"))
+	assert.True(t, isEncrypted(b))
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "version.txt"))
+	assert.Equal(t, "2", string(b))
+
+	decryptedDir, cleanup, err = keyring.DecryptedDir(dir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, dir, decryptedDir)
+	assert.Equal(t, "docs", readTestFile(t, decryptedDir, "docs.dat"))
+	assert.Equal(t, "persons", readTestFile(t, decryptedDir, filepath.Join("graphs", "PersonGraph.dat")))
+	assert.Equal(t, "2", readTestFile(t, decryptedDir, "version.txt"))
+
+	cleanup()
+	assert.False(t, fileExists(decryptedDir))
+
+	// Without the key, the encrypted files can't be loaded.
+	_, _, err = NewKeyring().DecryptedDir(dir)
+	assert.NotNil(t, err)
+}
+
+//
+// TEST HELPERS
+//
+
+func newKeyringForTest(t *testing.T, keys ...string) *Keyring {
+	keyring := NewKeyring()
+	assert.Nil(t, keyring.AddKeys(keys))
+	return keyring
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"time"
+)
+
+// Most entities and watchlists that one ComparisonRequest may compare.
+const maxComparisonItems = 10
+
+// Asks for the coverage of several entities and/or watchlists to be compared
+// over a shared time range.  The time range is given as in a FilterQuery, and
+// defaults to all of the retained content (see resolveChartWindow).
+type ComparisonRequest struct {
+	Items []ComparisonItem
+
+	TimeRangeInHours int        `json:",omitempty"`
+	StartTime        *time.Time `json:",omitempty"`
+	EndTime          *time.Time `json:",omitempty"`
+
+	// Width of the buckets of the time series (default 1h), as for a
+	// FilterQuery's TrendBucket.
+	TrendBucket string `json:",omitempty"`
+}
+
+// One of the things being compared: either an entity, given by Id or by Type
+// and Label (see resolveFilterItems), or one of the user's watchlists.  A
+// watchlist's coverage is the content that its filter selects, within the
+// request's time range rather than its own.
+type ComparisonItem struct {
+	Entity      *FilterItem `json:",omitempty"`
+	WatchListId int         `json:",omitempty"`
+}
+
+// Fills in the default bucket width, and verifies the request.
+func (me *ComparisonRequest) Validate() error {
+	if me.TrendBucket == "" {
+		me.TrendBucket = defaultTimelineBucket
+	}
+
+	if len(me.Items) == 0 || len(me.Items) > maxComparisonItems {
+		return errors.New(fmt.Sprintf("Must compare between 1 and %v Items", maxComparisonItems))
+	}
+	for i, item := range me.Items {
+		if (item.Entity == nil) == (item.WatchListId == 0) {
+			return errors.New(fmt.Sprintf("Item %v must have either an Entity or a WatchListId", i))
+		}
+	}
+	if me.TimeRangeInHours < 0 {
+		return errors.New("TimeRangeInHours may not be negative")
+	}
+	timeRange := me.TimeRange()
+	_, err := timeRange.TrendBucketDuration()
+	return err
+}
+
+// Returns the request's time range and bucket width as a FilterQuery.
+func (me *ComparisonRequest) TimeRange() FilterQuery {
+	return FilterQuery{TimeRangeInHours: me.TimeRangeInHours, StartTime: me.StartTime, EndTime: me.EndTime, TrendBucket: me.TrendBucket}
+}
+
+// The coverage of one of the compared items.  Values are the numbers of
+// documents that mention it in each of the Comparison's buckets, and Share is
+// its fraction of the TotalMentions of all of the items.  PreviousMentions is
+// its number of mentions in the period of the same length that immediately
+// precedes the compared one, and Change is the relative change from then
+// (e.g. 0.25 for 25% more mentions).  Both are nil if the previous period
+// isn't retained in full, and Change is also nil if there were no previous
+// mentions.
+type ComparisonSeries struct {
+	Id               string `json:",omitempty"`
+	WatchListId      int    `json:",omitempty"`
+	Label            string
+	Values           []int
+	TotalMentions    int
+	Share            float64
+	PreviousMentions *int
+	Change           *float64
+}
+
+// The compared items' time series, which share the same buckets.
+type Comparison struct {
+	Bucket        string
+	Start         time.Time
+	End           time.Time
+	PreviousStart *time.Time
+	Times         []int
+	Series        []ComparisonSeries
+}
+
+// An item to compare, with the ids of the documents that cover it.
+type comparedItem struct {
+	series ComparisonSeries
+	docIds *server.IntSet
+}
+
+// Compares the items' coverage within the [start, end) window (see
+// Comparison).  retainedFrom is the time of the oldest retained content, which
+// determines whether the previous period can be compared with.  Returns the
+// context's error if the comparison is cancelled or runs out of time.
+func calcComparison(ctx context.Context, docIndex *DocumentIndex, items []comparedItem, start time.Time, end time.Time, bucket time.Duration, retainedFrom time.Time) (Comparison, error) {
+	comparison := Comparison{Start: start.UTC(), End: end.UTC(), Series: []ComparisonSeries{}}
+	previousStart := start.Add(-end.Sub(start))
+	if !previousStart.Before(retainedFrom) {
+		utc := previousStart.UTC()
+		comparison.PreviousStart = &utc
+	}
+
+	totalMentions := 0
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return comparison, err
+		}
+		timeline, err := docIndex.CalcEntityTimeline(item.docIds, start, end, bucket, 0)
+		if err != nil {
+			return comparison, err
+		}
+		comparison.Times = timeline.Times
+
+		series := item.series
+		series.Values, series.TotalMentions = timeline.Values, timeline.TotalMentions
+		if comparison.PreviousStart != nil {
+			previous, err := docIndex.CalcEntityTimeline(item.docIds, previousStart, start, bucket, 0)
+			if err != nil {
+				return comparison, err
+			}
+			series.PreviousMentions = &previous.TotalMentions
+			if previous.TotalMentions > 0 {
+				change := float64(series.TotalMentions-previous.TotalMentions) / float64(previous.TotalMentions)
+				series.Change = &change
+			}
+		}
+		comparison.Series = append(comparison.Series, series)
+		totalMentions += series.TotalMentions
+	}
+
+	if totalMentions > 0 {
+		for i := range comparison.Series {
+			comparison.Series[i].Share = float64(comparison.Series[i].TotalMentions) / float64(totalMentions)
+		}
+	}
+	return comparison, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestComparisonRequest_Validate(t *testing.T) {
+	request := ComparisonRequest{Items: []ComparisonItem{ComparisonItem{Entity: &FilterItem{Id: "Org:1"}}, ComparisonItem{WatchListId: 12}}}
+	assert.Nil(t, request.Validate())
+	assert.Equal(t, "1h", request.TrendBucket)
+
+	// error cases
+	invalidRequests := []ComparisonRequest{
+		ComparisonRequest{},
+		ComparisonRequest{Items: make([]ComparisonItem, maxComparisonItems+1)},
+		ComparisonRequest{Items: []ComparisonItem{ComparisonItem{}}},
+		ComparisonRequest{Items: []ComparisonItem{ComparisonItem{Entity: &FilterItem{Id: "Org:1"}, WatchListId: 12}}},
+		ComparisonRequest{Items: request.Items, TrendBucket: "90s"},
+		ComparisonRequest{Items: request.Items, TimeRangeInHours: -1},
+	}
+	for i, invalidRequest := range invalidRequests {
+		assert.NotNil(t, invalidRequest.Validate(), i)
+	}
+}
+
+func TestCalcComparison(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := newDocumentIndexForTest(g)
+	items := []comparedItem{
+		comparedItem{series: ComparisonSeries{Id: "Org:1"}, docIds: g.OrgGraph.DocumentIdsForEntity(1)},
+		comparedItem{series: ComparisonSeries{Id: "Org:2"}, docIds: g.OrgGraph.DocumentIdsForEntity(2)},
+	}
+	at := func(hours int) time.Time {
+		return testContentStartTime.Add(time.Duration(hours) * time.Hour)
+	}
+
+	// Org 1 is mentioned by docs 1-3, and org 2 by docs 2 and 4 (inserted an
+	// hour apart), so each has 1 mention in the window.
+	comparison, err := calcComparison(context.Background(), docIndex, items, at(3), at(5), time.Hour, at(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{int(at(3).Unix()), int(at(4).Unix())}, comparison.Times)
+	assert.Equal(t, at(1), *comparison.PreviousStart)
+	org1, org2 := comparison.Series[0], comparison.Series[1]
+	assert.Equal(t, []int{1, 0}, org1.Values)
+	assert.Equal(t, []int{0, 1}, org2.Values)
+	assert.Equal(t, 0.5, org1.Share)
+	assert.Equal(t, 2, *org1.PreviousMentions)
+	assert.Equal(t, -0.5, *org1.Change)
+	assert.Equal(t, 1, *org2.PreviousMentions)
+	assert.Equal(t, 0.0, *org2.Change)
+
+	// The previous period isn't retained in full.
+	comparison, _ = calcComparison(context.Background(), docIndex, items, at(3), at(5), time.Hour, at(2))
+	assert.Nil(t, comparison.PreviousStart)
+	assert.Nil(t, comparison.Series[0].PreviousMentions)
+	assert.Nil(t, comparison.Series[0].Change)
+
+	// error case: the comparison was cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = calcComparison(ctx, docIndex, items, at(3), at(5), time.Hour, at(1))
+	assert.Equal(t, context.Canceled, err)
+}
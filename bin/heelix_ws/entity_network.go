@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+)
+
+// Defaults and limits of the EntityNetworkRequest params.
+const (
+	defaultNetworkDepth    = 1
+	maxNetworkDepth        = 3
+	defaultNetworkMaxNodes = 50
+	maxNetworkMaxNodes     = 500
+)
+
+// Asks for the network of entities that co-occur (i.e. are mentioned by the
+// same documents) within the content selected by Filter.  If a Seed entity is
+// given, the network spreads out from it for up to Depth hops; otherwise it
+// consists of the most-mentioned entities.
+type EntityNetworkRequest struct {
+	// The entity at the center of the network, given by Id or by Type and
+	// Label (see resolveFilterItems).
+	Seed *FilterItem `json:",omitempty"`
+
+	Filter FilterQuery
+
+	// How many hops away from the seed the network reaches (default 1).
+	Depth int `json:",omitempty"`
+
+	// Edges between entities that share fewer documents than this are left
+	// out (default 1).
+	MinEdgeWeight int `json:",omitempty"`
+
+	// Most entities in the network (default 50).  The entities that are most
+	// strongly connected to the network are kept.
+	MaxNodes int `json:",omitempty"`
+}
+
+// Fills in the defaults of the unspecified params, and verifies the others.
+func (me *EntityNetworkRequest) Validate() error {
+	if me.Depth == 0 {
+		me.Depth = defaultNetworkDepth
+	}
+	if me.MinEdgeWeight == 0 {
+		me.MinEdgeWeight = 1
+	}
+	if me.MaxNodes == 0 {
+		me.MaxNodes = defaultNetworkMaxNodes
+	}
+
+	switch {
+	case me.Depth < 1 || me.Depth > maxNetworkDepth:
+		return errors.New(fmt.Sprintf("Depth must be between 1 and %v", maxNetworkDepth))
+	case me.MinEdgeWeight < 1:
+		return errors.New("MinEdgeWeight must be positive")
+	case me.MaxNodes < 1 || me.MaxNodes > maxNetworkMaxNodes:
+		return errors.New(fmt.Sprintf("MaxNodes must be between 1 and %v", maxNetworkMaxNodes))
+	}
+	return me.Filter.ValidateStatsParams()
+}
+
+// An entity within an EntityNetwork.  Count is the number of documents that
+// mention it, and Depth is the number of hops from the seed entity (if any).
+type EntityNetworkNode struct {
+	Id    string
+	Type  string
+	Label string
+	Count int
+	Depth int
+}
+
+// Connects two entities of an EntityNetwork that are mentioned by Weight
+// documents in common.
+type EntityNetworkEdge struct {
+	Source string
+	Target string
+	Weight int
+}
+
+// A weighted network of co-occurring entities.  Truncated is true if more
+// entities would have been included, but for the MaxNodes limit.
+type EntityNetwork struct {
+	Nodes     []EntityNetworkNode
+	Edges     []EntityNetworkEdge
+	Truncated bool
+}
+
+// Identifies an entity across all entity types.
+type entityKey struct {
+	Type server.EntityType
+	Id   int
+}
+
+func (me entityKey) less(other entityKey) bool {
+	if me.Type != other.Type {
+		return me.Type < other.Type
+	}
+	return me.Id < other.Id
+}
+
+// Calculates the network of co-occurring entities within g (see
+// EntityNetworkRequest).  seed is nil if the network has no seed entity.
+// Returns the context's error if the calculation is cancelled or runs out of
+// time.
+func calcEntityNetwork(ctx context.Context, g *server.ContentBuffer, contentDAO *server.ContentDAO, seed *entityKey, request EntityNetworkRequest) (EntityNetwork, error) {
+	network := EntityNetwork{Nodes: []EntityNetworkNode{}, Edges: []EntityNetworkEdge{}}
+	depths := map[entityKey]int{}
+	keys := []entityKey{}
+	addNode := func(key entityKey, depth int) {
+		depths[key] = depth
+		keys = append(keys, key)
+	}
+
+	// The co-occurrences of each entity are needed for both the nodes and the
+	// edges, so they're only counted once.
+	coOccurrences := map[entityKey]map[entityKey]int{}
+	coOccurrencesOf := func(key entityKey) (map[entityKey]int, error) {
+		if counts, found := coOccurrences[key]; found {
+			return counts, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		counts := countCoOccurrences(g, key)
+		coOccurrences[key] = counts
+		return counts, nil
+	}
+
+	if seed != nil {
+		addNode(*seed, 0)
+		frontier := []entityKey{*seed}
+		for depth := 1; depth <= request.Depth && len(frontier) > 0 && !network.Truncated; depth++ {
+			// Each new entity is ranked by its strongest edge to the frontier.
+			weights := map[entityKey]int{}
+			for _, key := range frontier {
+				counts, err := coOccurrencesOf(key)
+				if err != nil {
+					return network, err
+				}
+				for other, weight := range counts {
+					if _, included := depths[other]; !included && weight >= request.MinEdgeWeight && weight > weights[other] {
+						weights[other] = weight
+					}
+				}
+			}
+
+			frontier = []entityKey{}
+			for _, key := range sortedByWeight(weights) {
+				if len(keys) == request.MaxNodes {
+					network.Truncated = true
+					break
+				}
+				addNode(key, depth)
+				frontier = append(frontier, key)
+			}
+		}
+	} else {
+		topEntities := map[entityKey]int{}
+		for _, def := range entityTypes.All() {
+			for _, entity := range calcTopEntities(def.Graph(g), request.MaxNodes+1) {
+				topEntities[entityKey{def.Type, entity.GetId()}] = entity.GetScore()
+			}
+		}
+		for _, key := range sortedByWeight(topEntities) {
+			if len(keys) == request.MaxNodes {
+				network.Truncated = true
+				break
+			}
+			addNode(key, 0)
+		}
+	}
+
+	nodeIds := map[entityKey]string{}
+	for _, key := range keys {
+		def, _ := entityTypes.ByType(key.Type)
+		nodeIds[key] = fmt.Sprintf("%v:%v", def.Name, key.Id)
+		network.Nodes = append(network.Nodes, EntityNetworkNode{
+			Id:    nodeIds[key],
+			Type:  def.Name,
+			Label: def.DAO(contentDAO).GetLabel(key.Id),
+			Count: def.Graph(g).DocumentIdsForEntity(key.Id).Size(),
+			Depth: depths[key],
+		})
+	}
+
+	for _, key := range keys {
+		counts, err := coOccurrencesOf(key)
+		if err != nil {
+			return network, err
+		}
+		for other, weight := range counts {
+			if _, included := depths[other]; included && key.less(other) && weight >= request.MinEdgeWeight {
+				network.Edges = append(network.Edges, EntityNetworkEdge{Source: nodeIds[key], Target: nodeIds[other], Weight: weight})
+			}
+		}
+	}
+	sort.Sort(byDecreasingEdgeWeight(network.Edges))
+
+	return network, nil
+}
+
+// Returns the number of documents within g that mention both the entity and
+// each of the other entities it co-occurs with.
+func countCoOccurrences(g *server.ContentBuffer, key entityKey) map[entityKey]int {
+	counts := map[entityKey]int{}
+	graph := entityGraphForType(g, key.Type)
+	if graph == nil {
+		return counts
+	}
+	graph.DocumentIdsForEntity(key.Id).ForEach(func(docId int) {
+		for _, def := range entityTypes.All() {
+			def.Graph(g).EntityIdsForDocument(docId).ForEach(func(entityId int) {
+				other := entityKey{def.Type, entityId}
+				if other != key {
+					counts[other]++
+				}
+			})
+		}
+	})
+	return counts
+}
+
+// Returns the keys in order of decreasing weight (with ties broken by key, so
+// that the order is stable).
+func sortedByWeight(weights map[entityKey]int) []entityKey {
+	keys := make([]entityKey, 0, len(weights))
+	for key := range weights {
+		keys = append(keys, key)
+	}
+	sort.Sort(byDecreasingWeight{keys, weights})
+	return keys
+}
+
+type byDecreasingWeight struct {
+	keys    []entityKey
+	weights map[entityKey]int
+}
+
+func (a byDecreasingWeight) Len() int      { return len(a.keys) }
+func (a byDecreasingWeight) Swap(i, j int) { a.keys[i], a.keys[j] = a.keys[j], a.keys[i] }
+func (a byDecreasingWeight) Less(i, j int) bool {
+	if a.weights[a.keys[i]] != a.weights[a.keys[j]] {
+		return a.weights[a.keys[i]] > a.weights[a.keys[j]]
+	}
+	return a.keys[i].less(a.keys[j])
+}
+
+// Sorts edges by decreasing weight, with ties broken by source and target.
+type byDecreasingEdgeWeight []EntityNetworkEdge
+
+func (a byDecreasingEdgeWeight) Len() int      { return len(a) }
+func (a byDecreasingEdgeWeight) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDecreasingEdgeWeight) Less(i, j int) bool {
+	if a[i].Weight != a[j].Weight {
+		return a[i].Weight > a[j].Weight
+	}
+	if a[i].Source != a[j].Source {
+		return a[i].Source < a[j].Source
+	}
+	return a[i].Target < a[j].Target
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+)
+
+func TestEntityNetworkRequest_Validate(t *testing.T) {
+	request := EntityNetworkRequest{}
+	assert.Nil(t, request.Validate())
+	assert.Equal(t, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 50}, request)
+
+	// error cases
+	for _, request := range []EntityNetworkRequest{
+		EntityNetworkRequest{Depth: 4},
+		EntityNetworkRequest{MinEdgeWeight: -1},
+		EntityNetworkRequest{MaxNodes: 501},
+		EntityNetworkRequest{Filter: FilterQuery{TopN: -1}},
+	} {
+		assert.NotNil(t, request.Validate(), "%+v", request)
+	}
+}
+
+func TestCalcEntityNetwork_seed(t *testing.T) {
+	g := newNetworkContentBufferForTest()
+	seed := &entityKey{server.PersonEntity, 1}
+
+	network, err := calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), seed, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 50})
+	assert.Nil(t, err)
+	assert.Equal(t, []EntityNetworkNode{
+		EntityNetworkNode{Id: "Person:1", Type: "Person", Label: "Joe Smith", Count: 3, Depth: 0},
+		EntityNetworkNode{Id: "Org:1", Type: "Org", Count: 2, Depth: 1},
+		EntityNetworkNode{Id: "Person:2", Type: "Person", Count: 2, Depth: 1},
+		EntityNetworkNode{Id: "Org:2", Type: "Org", Label: "Acme", Count: 1, Depth: 1},
+	}, network.Nodes)
+	assert.Equal(t, []EntityNetworkEdge{
+		EntityNetworkEdge{Source: "Person:1", Target: "Org:1", Weight: 2},
+		EntityNetworkEdge{Source: "Org:1", Target: "Org:2", Weight: 1},
+		EntityNetworkEdge{Source: "Person:1", Target: "Org:2", Weight: 1},
+		EntityNetworkEdge{Source: "Person:1", Target: "Person:2", Weight: 1},
+	}, network.Edges)
+	assert.False(t, network.Truncated)
+
+	// Place:3 is 2 hops away, through Person:2.
+	network, err = calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), seed, EntityNetworkRequest{Depth: 2, MinEdgeWeight: 1, MaxNodes: 50})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(network.Nodes))
+	assert.Equal(t, EntityNetworkNode{Id: "Place:3", Type: "Place", Label: "Springfield", Count: 1, Depth: 2}, network.Nodes[4])
+
+	// Weak edges are left out, along with the entities they'd connect.
+	network, err = calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), seed, EntityNetworkRequest{Depth: 2, MinEdgeWeight: 2, MaxNodes: 50})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Person:1", "Org:1"}, networkNodeIds(network))
+	assert.Equal(t, 1, len(network.Edges))
+
+	network, err = calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), seed, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Person:1", "Org:1"}, networkNodeIds(network))
+	assert.True(t, network.Truncated)
+
+	// An entity that isn't mentioned is on its own.
+	network, err = calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), &entityKey{server.OrgEntity, 99}, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 50})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Org:99"}, networkNodeIds(network))
+	assert.Equal(t, 0, len(network.Edges))
+
+	// error case: the calculation is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = calcEntityNetwork(ctx, g, newLabeledContentDAO(), seed, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 50})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCalcEntityNetwork_noSeed(t *testing.T) {
+	g := newNetworkContentBufferForTest()
+
+	network, err := calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), nil, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Person:1", "Person:2", "Org:1"}, networkNodeIds(network))
+	assert.True(t, network.Truncated)
+	assert.Equal(t, 2, len(network.Edges))
+
+	network, err = calcEntityNetwork(context.Background(), g, newLabeledContentDAO(), nil, EntityNetworkRequest{Depth: 1, MinEdgeWeight: 1, MaxNodes: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(network.Nodes))
+	assert.False(t, network.Truncated)
+}
+
+//
+// TEST HELPERS
+//
+
+// Creates a content buffer with 4 docs:
+//
+//	doc 1: Person:1, Org:1
+//	doc 2: Person:1, Org:1, Org:2
+//	doc 3: Person:1, Person:2
+//	doc 4: Person:2, Place:3
+func newNetworkContentBufferForTest() *server.ContentBuffer {
+	entities := func(ids ...int) []server.Entity {
+		result := []server.Entity{}
+		for _, id := range ids {
+			result = append(result, server.DisplayEntity{Id: id})
+		}
+		return result
+	}
+	g := server.NewContentBuffer()
+	for _, newsArticle := range []server.NewsArticle{
+		server.NewsArticle{Document: server.Document{Id: 1}, Persons: entities(1), Orgs: entities(1)},
+		server.NewsArticle{Document: server.Document{Id: 2}, Persons: entities(1), Orgs: entities(1, 2)},
+		server.NewsArticle{Document: server.Document{Id: 3}, Persons: entities(1, 2)},
+		server.NewsArticle{Document: server.Document{Id: 4}, Persons: entities(2), Places: entities(3)},
+	} {
+		newsArticle.Document.InsertDate = unixtime.Unix(int32(testContentStartTime.Unix()))
+		g.AddNewsArticle(newsArticle)
+	}
+	return g
+}
+
+func networkNodeIds(network EntityNetwork) []string {
+	ids := []string{}
+	for _, node := range network.Nodes {
+		ids = append(ids, node.Id)
+	}
+	return ids
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+	"time"
+)
+
+// Number of top entities of each type that the ContentBuffer's stats
+// include, and the most that a query may ask for (see FilterQuery.TopN).
+const defaultTopN = 20
+const maxTopN = 100
+
+// Bounds of FilterQuery.TrendBucket, and the most buckets that an
+// EntityTrend may have.
+const minTrendBucket = time.Minute
+const maxTrendBucket = 24 * time.Hour
+const maxTrendPoints = 10000
+
+// Returns the n entities in the graph that are mentioned by the most
+// documents, scored by their number of documents.
+func calcTopEntities(graph *server.EntityGraph, n int) []server.Entity {
+	entities := []server.Entity{}
+	graph.ForEachEntityId(func(entityId int) {
+		entities = append(entities, server.DisplayEntity{Id: entityId, Score: graph.DocumentIdsForEntity(entityId).Size()})
+	})
+	sort.Sort(byDecreasingScore(entities))
+	if len(entities) > n {
+		entities = entities[:n]
+	}
+	return entities
+}
+
+// Sorts entities by descending score, then by id.
+type byDecreasingScore []server.Entity
+
+func (a byDecreasingScore) Len() int      { return len(a) }
+func (a byDecreasingScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDecreasingScore) Less(i, j int) bool {
+	if a[i].GetScore() != a[j].GetScore() {
+		return a[i].GetScore() > a[j].GetScore()
+	}
+	return a[i].GetId() < a[j].GetId()
+}
+
+// Returns the number of entity mentions by the documents in g, bucketed by
+// their insert date into buckets of the specified width.  The trend runs from
+// the oldest document's bucket to the newest's (buckets without any mentions
+// are included, as zeroes), and each time is the start of its bucket.  Only
+// documents in the index have a known insert date, so the rest are left out.
+func (me *DocumentIndex) CalcEntityTrend(g *server.ContentBuffer, bucket time.Duration) (EntityTrend, error) {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	bucketSeconds := int(bucket / time.Second)
+	mentionsByBucket := map[int]int{}
+	first, last := 0, 0
+	documentIds(g).ForEach(func(docId int) {
+		doc, exists := me.docs[docId]
+		if !exists {
+			return
+		}
+		bucketStart := int(doc.InsertDate) - int(doc.InsertDate)%bucketSeconds
+		if len(mentionsByBucket) == 0 || bucketStart < first {
+			first = bucketStart
+		}
+		if len(mentionsByBucket) == 0 || bucketStart > last {
+			last = bucketStart
+		}
+		mentionsByBucket[bucketStart] += entityTypes.MentionCount(g, docId)
+	})
+
+	trend := EntityTrend{Times: []int{}, Values: []int{}}
+	if len(mentionsByBucket) == 0 {
+		return trend, nil
+	}
+	if points := (last-first)/bucketSeconds + 1; points > maxTrendPoints {
+		return trend, errors.New(fmt.Sprintf("The trend would have %v buckets of %v (the most allowed is %v): use a larger TrendBucket, or a shorter time range",
+			points, bucket, maxTrendPoints))
+	}
+	for t := first; t <= last; t += bucketSeconds {
+		trend.Times = append(trend.Times, t)
+		trend.Values = append(trend.Values, mentionsByBucket[t])
+	}
+	return trend, nil
+}
+
+// Default width of the buckets of an EntityTimeline, and the number of news
+// sources that its breakdown by source lists separately by default (and at
+// most).
+const defaultTimelineBucket = "1h"
+const defaultTimelineSources = 10
+const maxTimelineSources = 100
+
+// The number of documents that mention an entity over time, in the same
+// format as an EntityTrend (see CalcEntityTimeline).
+type EntityTimeline struct {
+	Id     string
+	Label  string
+	Bucket string
+	Start  time.Time
+	End    time.Time
+	Times  []int
+	Values []int
+	// Total number of documents within the timeline.
+	TotalMentions int
+	// If asked for, the Values broken down by news source: the sources with the
+	// most mentions, and all of the others (including documents whose source
+	// isn't known) combined.
+	BySource     []SourceTimeline `json:",omitempty"`
+	OtherSources []int            `json:",omitempty"`
+}
+
+// The part of an EntityTimeline's Values from a single news source.
+type SourceTimeline struct {
+	Source        string
+	TotalMentions int
+	Values        []int
+}
+
+// Returns the number of the documents that fall within the [start, end)
+// window, bucketed by their insert date into buckets of the specified width.
+// Every bucket that overlaps the window is included (even if empty), and
+// each time is the start of its bucket.  If maxSources is positive, the
+// counts are also broken down by the documents' news source, listing up to
+// maxSources sources separately.  Only documents in the index have a known
+// insert date, so the rest are left out.
+func (me *DocumentIndex) CalcEntityTimeline(docIds *server.IntSet, start time.Time, end time.Time, bucket time.Duration, maxSources int) (EntityTimeline, error) {
+	bucketSeconds := int(bucket / time.Second)
+	startTime, endTime := int(start.Unix()), int(end.Unix())
+	first := startTime - startTime%bucketSeconds
+	last := (endTime - 1) - (endTime-1)%bucketSeconds
+	points := (last-first)/bucketSeconds + 1
+	if points > maxTrendPoints {
+		return EntityTimeline{}, errors.New(fmt.Sprintf("The timeline would have %v buckets of %v (the most allowed is %v): use a larger bucket, or a shorter time range",
+			points, bucket, maxTrendPoints))
+	}
+
+	timeline := EntityTimeline{Times: make([]int, points), Values: make([]int, points)}
+	for i := range timeline.Times {
+		timeline.Times[i] = first + i*bucketSeconds
+	}
+	sources := map[string]*SourceTimeline{}
+	otherSources := make([]int, points)
+
+	me.lock.RLock()
+	docIds.ForEach(func(docId int) {
+		doc, exists := me.docs[docId]
+		if !exists || int(doc.InsertDate) < startTime || int(doc.InsertDate) >= endTime {
+			return
+		}
+		i := (int(doc.InsertDate) - first) / bucketSeconds
+		timeline.Values[i]++
+		timeline.TotalMentions++
+		if maxSources <= 0 {
+			return
+		}
+
+		// Variants of a name that differ only in case are counted together.
+		key := normalizeSource(doc.Source)
+		if key == "" {
+			otherSources[i]++
+			return
+		}
+		source, exists := sources[key]
+		if !exists {
+			source = &SourceTimeline{Source: doc.Source, Values: make([]int, points)}
+			sources[key] = source
+		} else if doc.Source < source.Source {
+			source.Source = doc.Source
+		}
+		source.Values[i]++
+		source.TotalMentions++
+	})
+	me.lock.RUnlock()
+
+	if maxSources <= 0 {
+		return timeline, nil
+	}
+	timeline.BySource = []SourceTimeline{}
+	for _, source := range sources {
+		timeline.BySource = append(timeline.BySource, *source)
+	}
+	sort.Sort(byTotalMentions(timeline.BySource))
+	if len(timeline.BySource) > maxSources {
+		for _, source := range timeline.BySource[maxSources:] {
+			for i, count := range source.Values {
+				otherSources[i] += count
+			}
+		}
+		timeline.BySource = timeline.BySource[:maxSources]
+	}
+	timeline.OtherSources = otherSources
+	return timeline, nil
+}
+
+// Sorts source timelines by descending number of mentions, then by source
+// name.
+type byTotalMentions []SourceTimeline
+
+func (a byTotalMentions) Len() int      { return len(a) }
+func (a byTotalMentions) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTotalMentions) Less(i, j int) bool {
+	if a[i].TotalMentions != a[j].TotalMentions {
+		return a[i].TotalMentions > a[j].TotalMentions
+	}
+	return a[i].Source < a[j].Source
+}
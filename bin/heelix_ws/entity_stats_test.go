@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+	"time"
+)
+
+func TestCalcTopEntities(t *testing.T) {
+	g := newContentBufferForTest()
+
+	// Org 1 is mentioned by 3 documents, and org 2 by 2.
+	topOrgs := calcTopEntities(g.OrgGraph, 1)
+	assert.Equal(t, []server.Entity{server.DisplayEntity{Id: 1, Score: 3}}, topOrgs)
+	assert.Equal(t, 2, len(calcTopEntities(g.OrgGraph, 5)))
+	assert.Equal(t, 0, len(calcTopEntities(g.PersonGraph, 5)))
+}
+
+func TestDocumentIndex_CalcEntityTrend(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := newDocumentIndexForTest(g)
+	startTime := int(testContentStartTime.Unix())
+
+	trend, err := docIndex.CalcEntityTrend(g, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{startTime + 3600, startTime + 2*3600, startTime + 3*3600, startTime + 4*3600}, trend.Times)
+	assert.Equal(t, []int{1, 2, 1, 1}, trend.Values)
+
+	// The buckets start on multiples of their width.
+	trend, _ = docIndex.CalcEntityTrend(g, 2*time.Hour)
+	assert.Equal(t, []int{startTime, startTime + 2*3600, startTime + 4*3600}, trend.Times)
+	assert.Equal(t, []int{1, 3, 1}, trend.Values)
+
+	trend, _ = docIndex.CalcEntityTrend(server.NewContentBuffer(), time.Hour)
+	assert.Equal(t, 0, len(trend.Times))
+
+	// error case: too many buckets
+	newDoc := server.Document{Id: 5, InsertDate: unixtime.Unix(int32(testContentStartTime.Add(10 * 24 * time.Hour).Unix()))}
+	g.AddNewsArticle(server.NewsArticle{Document: newDoc, Orgs: []server.Entity{server.DisplayEntity{Id: 1}}})
+	docIndex.AddDocuments([]server.Document{newDoc})
+	_, err = docIndex.CalcEntityTrend(g, time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestDocumentIndex_CalcEntityTimeline(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := NewDocumentIndex()
+	sources := map[int]string{1: "Reuters", 2: "reuters ", 3: "BBC News", 4: ""}
+	for docId, source := range sources {
+		insertDate := unixtime.Unix(int32(testContentStartTime.Add(time.Duration(docId) * time.Hour).Unix()))
+		docIndex.AddDocuments([]server.Document{server.Document{Id: docId, InsertDate: insertDate, Source: source}})
+	}
+	startTime := int(testContentStartTime.Unix())
+	org1 := g.OrgGraph.DocumentIdsForEntity(1)
+
+	// Empty buckets within the window are included.
+	timeline, err := docIndex.CalcEntityTimeline(org1, testContentStartTime, testContentStartTime.Add(5*time.Hour), time.Hour, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{startTime, startTime + 3600, startTime + 2*3600, startTime + 3*3600, startTime + 4*3600}, timeline.Times)
+	assert.Equal(t, []int{0, 1, 1, 1, 0}, timeline.Values)
+	assert.Equal(t, 3, timeline.TotalMentions)
+	assert.Nil(t, timeline.BySource)
+
+	// The window's end is exclusive.
+	timeline, _ = docIndex.CalcEntityTimeline(org1, testContentStartTime.Add(time.Hour), testContentStartTime.Add(3*time.Hour), 2*time.Hour, 0)
+	assert.Equal(t, []int{startTime, startTime + 2*3600}, timeline.Times)
+	assert.Equal(t, []int{1, 1}, timeline.Values)
+
+	// Sources that differ only in case are counted together, and the sources
+	// beyond the limit are combined with the unknown ones.
+	timeline, _ = docIndex.CalcEntityTimeline(org1, testContentStartTime, testContentStartTime.Add(5*time.Hour), time.Hour, 1)
+	assert.Equal(t, []SourceTimeline{SourceTimeline{Source: "Reuters", TotalMentions: 2, Values: []int{0, 1, 1, 0, 0}}}, timeline.BySource)
+	assert.Equal(t, []int{0, 0, 0, 1, 0}, timeline.OtherSources)
+	org2 := g.OrgGraph.DocumentIdsForEntity(2)
+	timeline, _ = docIndex.CalcEntityTimeline(org2, testContentStartTime, testContentStartTime.Add(5*time.Hour), time.Hour, 10)
+	assert.Equal(t, 1, len(timeline.BySource))
+	assert.Equal(t, []int{0, 0, 0, 0, 1}, timeline.OtherSources)
+
+	// error case: too many buckets
+	_, err = docIndex.CalcEntityTimeline(org1, testContentStartTime, testContentStartTime.Add(10*24*time.Hour), time.Minute, 0)
+	assert.NotNil(t, err)
+}
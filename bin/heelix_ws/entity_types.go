@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	server "qbase/synthos/synthos_svr"
+)
+
+// Describes one of the types of entities that the app supports (e.g. Person).
+// Each type's entities are kept in their own graph in the content buffer, so
+// only the types that the content buffer has a graph for can be registered
+// (see EntityTypeRegistry.Register).  The definition decides how the app
+// names, serves and saves a type's entities.
+type EntityTypeDef struct {
+	Type server.EntityType
+
+	// Prefix of the FilterItem Ids of this type's entities (e.g. the "Person" in
+	// "Person:12345"), which is also the key of this type's entities in the
+	// all_entity_info, search and hot_entities responses.
+	Name string
+
+	// Key of this type's entity count in the system info (e.g. "Persons").
+	PluralName string
+
+	// If set, the info about this type's entities is served at
+	// /api/<InfoPath>/{id} (see FetchEntityInfo).
+	InfoPath string
+
+	// Returns the content buffer's graph of this type's entities, i.e. the one
+	// that the content buffer keeps for Type.
+	Graph func(g *server.ContentBuffer) *server.EntityGraph
+
+	// Returns the DAO that holds the labels of this type's entities.
+	DAO func(contentDAO *server.ContentDAO) server.EntityDAO
+
+	// Returns this type's top entities from a content buffer's precalculated
+	// stats.  Nil if the stats don't cover this type, in which case the top
+	// entities are calculated from the graph instead.
+	StatsTopEntities func(stats server.EntityStats) []server.Entity
+
+	// Name of the file that this type's labels are saved to, alongside the rest
+	// of the global data (see SaveGlobalData).  Only needed for types whose DAO
+	// isn't one of the ContentDAO's own, which it saves itself.
+	DAOFileName string
+}
+
+// Returns the n (or defaultTopN, if n is 0) most-mentioned entities of this
+// type in g, whose precalculated stats are passed in.
+func (me *EntityTypeDef) TopEntities(g *server.ContentBuffer, stats server.EntityStats, n int) []server.Entity {
+	if n == 0 {
+		n = defaultTopN
+	}
+	if n == defaultTopN && me.StatsTopEntities != nil {
+		return me.StatsTopEntities(stats)
+	}
+	return calcTopEntities(me.Graph(g), n)
+}
+
+// The entity types that the app supports, in the order they were registered.
+// Types must be registered at startup (e.g. from an init func), before any
+// requests are served, since the registry isn't safe to modify concurrently.
+type EntityTypeRegistry struct {
+	defs []EntityTypeDef
+}
+
+// The app's entity types.  Person, Org and Place are built in.
+var entityTypes = newBuiltInEntityTypes()
+
+func newBuiltInEntityTypes() *EntityTypeRegistry {
+	registry := &EntityTypeRegistry{}
+	builtInTypes := []EntityTypeDef{
+		EntityTypeDef{
+			Type:             server.PersonEntity,
+			Name:             "Person",
+			PluralName:       "Persons",
+			InfoPath:         "person",
+			Graph:            func(g *server.ContentBuffer) *server.EntityGraph { return g.PersonGraph },
+			DAO:              func(contentDAO *server.ContentDAO) server.EntityDAO { return contentDAO.PersonDAO },
+			StatsTopEntities: func(stats server.EntityStats) []server.Entity { return stats.TopPersons },
+		},
+		EntityTypeDef{
+			Type:             server.OrgEntity,
+			Name:             "Org",
+			PluralName:       "Orgs",
+			InfoPath:         "org",
+			Graph:            func(g *server.ContentBuffer) *server.EntityGraph { return g.OrgGraph },
+			DAO:              func(contentDAO *server.ContentDAO) server.EntityDAO { return contentDAO.OrgDAO },
+			StatsTopEntities: func(stats server.EntityStats) []server.Entity { return stats.TopOrgs },
+		},
+		EntityTypeDef{
+			Type:             server.PlaceEntity,
+			Name:             "Place",
+			PluralName:       "Places",
+			Graph:            func(g *server.ContentBuffer) *server.EntityGraph { return g.PlaceGraph },
+			DAO:              func(contentDAO *server.ContentDAO) server.EntityDAO { return contentDAO.PlaceDAO },
+			StatsTopEntities: func(stats server.EntityStats) []server.Entity { return stats.TopPlaces },
+		},
+	}
+	for _, def := range builtInTypes {
+		if err := registry.Register(def); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+// Adds an entity type to the registry.  Returns an error if the definition is
+// incomplete, if its Graph isn't the content buffer's graph of its Type, or if
+// its type, name, info path or DAO file is already registered.
+func (me *EntityTypeRegistry) Register(def EntityTypeDef) error {
+	if def.Name == "" || def.PluralName == "" || def.Graph == nil || def.DAO == nil {
+		return errors.New(fmt.Sprintf("Entity type '%v' must have a Name, PluralName, Graph and DAO", def.Name))
+	}
+	if entityType, found := bufferGraphType(server.NewContentBuffer(), def.Graph); !found || entityType != def.Type {
+		return errors.New(fmt.Sprintf("Entity type '%v' must have the content buffer's graph of its Type as its Graph", def.Name))
+	}
+	for _, existing := range me.defs {
+		switch {
+		case existing.Type == def.Type:
+			return errors.New(fmt.Sprintf("Entity type '%v' is already registered as '%v'", def.Name, existing.Name))
+		case existing.Name == def.Name:
+			return errors.New(fmt.Sprintf("Entity type name '%v' is already registered", def.Name))
+		case def.InfoPath != "" && existing.InfoPath == def.InfoPath:
+			return errors.New(fmt.Sprintf("Entity info path '%v' is already registered for '%v'", def.InfoPath, existing.Name))
+		case def.DAOFileName != "" && existing.DAOFileName == def.DAOFileName:
+			return errors.New(fmt.Sprintf("Entity DAO file '%v' is already registered for '%v'", def.DAOFileName, existing.Name))
+		}
+	}
+	me.defs = append(me.defs, def)
+	return nil
+}
+
+// Returns the type that the content buffer keeps the graph under (e.g. the
+// OrgEntity for its OrgGraph).  Returns false if the graph isn't one of g's.
+func bufferGraphType(g *server.ContentBuffer, graph func(g *server.ContentBuffer) *server.EntityGraph) (server.EntityType, bool) {
+	switch graph(g) {
+	case g.PersonGraph:
+		return server.PersonEntity, true
+	case g.OrgGraph:
+		return server.OrgEntity, true
+	case g.PlaceGraph:
+		return server.PlaceEntity, true
+	}
+	return 0, false
+}
+
+// Returns all of the registered entity types, in the order they were
+// registered.
+func (me *EntityTypeRegistry) All() []EntityTypeDef {
+	return me.defs
+}
+
+// Returns the entity type with the specified name (e.g. "Person").
+func (me *EntityTypeRegistry) ByName(name string) (EntityTypeDef, bool) {
+	for _, def := range me.defs {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return EntityTypeDef{}, false
+}
+
+// Returns the definition of the specified entity type.
+func (me *EntityTypeRegistry) ByType(entityType server.EntityType) (EntityTypeDef, bool) {
+	for _, def := range me.defs {
+		if def.Type == entityType {
+			return def, true
+		}
+	}
+	return EntityTypeDef{}, false
+}
+
+// Returns the number of entities of every type that the document mentions.
+func (me *EntityTypeRegistry) MentionCount(g *server.ContentBuffer, docId int) int {
+	count := 0
+	for _, def := range me.defs {
+		count += def.Graph(g).EntityIdsForDocument(docId).Size()
+	}
+	return count
+}
+
+// Saves the labels of the entity types that have a DAOFileName into dir.
+func (me *EntityTypeRegistry) SaveDAOs(contentDAO *server.ContentDAO, dir string) error {
+	for _, def := range me.defs {
+		if def.DAOFileName == "" {
+			continue
+		}
+		if err := def.DAO(contentDAO).Save(filepath.Join(dir, def.DAOFileName)); err != nil {
+			return errors.New(fmt.Sprintf("Error saving %v labels: %v", def.Name, err))
+		}
+	}
+	return nil
+}
+
+// Loads the labels of the entity types that have a DAOFileName from dir (see
+// SaveDAOs).  A missing file isn't an error, since data that was saved before
+// a type was registered won't have one.
+func (me *EntityTypeRegistry) LoadDAOs(contentDAO *server.ContentDAO, dir string) error {
+	for _, def := range me.defs {
+		if def.DAOFileName == "" {
+			continue
+		}
+		filePath := filepath.Join(dir, def.DAOFileName)
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			logger.Printf("No saved %v labels in %v", def.Name, dir)
+			continue
+		}
+		if err := def.DAO(contentDAO).Load(filePath); err != nil {
+			return errors.New(fmt.Sprintf("Error loading %v labels: %v", def.Name, err))
+		}
+	}
+	return nil
+}
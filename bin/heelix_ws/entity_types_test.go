@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+)
+
+func TestEntityTypeRegistry_builtInTypes(t *testing.T) {
+	names := []string{}
+	for _, def := range entityTypes.All() {
+		names = append(names, def.Name)
+	}
+	assert.Equal(t, []string{"Person", "Org", "Place"}, names)
+
+	def, found := entityTypes.ByName("Org")
+	assert.True(t, found)
+	assert.Equal(t, server.OrgEntity, def.Type)
+	def, found = entityTypes.ByType(server.PlaceEntity)
+	assert.True(t, found)
+	assert.Equal(t, "Place", def.Name)
+	_, found = entityTypes.ByName("org")
+	assert.False(t, found)
+}
+
+func TestEntityTypeRegistry_Register(t *testing.T) {
+	registry := newEntityTypesWithoutOrgForTest()
+	topic := newTopicEntityTypeForTest(&labelFileDAOForTest{})
+	assert.Nil(t, registry.Register(topic))
+	def, found := registry.ByName("Topic")
+	assert.True(t, found)
+	assert.Equal(t, topic.Type, def.Type)
+
+	// error cases: incomplete or duplicate definitions, and graphs that aren't
+	// the content buffer's graph of the type
+	assert.NotNil(t, registry.Register(EntityTypeDef{Type: server.EntityType(100), Name: "Product"}))
+	product := newTopicEntityTypeForTest(&labelFileDAOForTest{})
+	product.Type, product.Name, product.InfoPath, product.DAOFileName = server.EntityType(100), "Product", "", ""
+	product.Graph = func(g *server.ContentBuffer) *server.EntityGraph { return server.NewEntityGraph() }
+	assert.NotNil(t, registry.Register(product))
+	product.Graph = func(g *server.ContentBuffer) *server.EntityGraph { return g.OrgGraph }
+	assert.NotNil(t, registry.Register(product))
+	duplicates := []EntityTypeDef{topic, topic}
+	duplicates[0].Name = "Topic2"
+	duplicates[1].Type, duplicates[1].Name, duplicates[1].InfoPath = server.PersonEntity, "Topic2", ""
+	duplicates[1].Graph = func(g *server.ContentBuffer) *server.EntityGraph { return g.PersonGraph }
+	for _, def := range duplicates {
+		assert.NotNil(t, registry.Register(def), def.Name)
+	}
+	assert.Equal(t, 3, len(registry.All()))
+}
+
+func TestEntityTypeRegistry_registeredTypeInFilters(t *testing.T) {
+	defer registerEntityTypeForTest(t, newTopicEntityTypeForTest(&labelFileDAOForTest{}))()
+	g := newContentBufferForTest()
+
+	entityType, entityId, err := parseFilterItem(FilterItem{Id: "Topic:2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, entityId)
+	assert.Equal(t, 2, entityGraphForType(g, entityType).DocumentIdsForEntity(entityId).Size())
+	assert.Equal(t, 2, g.FilterOnEntity(entityType, entityId).OrgGraph.DocumentIdsForEntity(entityId).Size())
+
+	// The orgs are no longer registered, so doc 2's orgs are only counted as topics.
+	_, _, err = parseFilterItem(FilterItem{Id: "Org:2"})
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, entityTypes.MentionCount(g, 2))
+}
+
+func TestEntityTypeDef_TopEntities(t *testing.T) {
+	g := newContentBufferForTest()
+	def, _ := entityTypes.ByType(server.OrgEntity)
+	precalculated := []server.Entity{server.DisplayEntity{Id: 99, Score: 1}}
+	stats := server.EntityStats{TopOrgs: precalculated}
+
+	// The default number of top entities comes from the stats.
+	assert.Equal(t, precalculated, def.TopEntities(g, stats, 0))
+	assert.Equal(t, precalculated, def.TopEntities(g, stats, defaultTopN))
+	assert.Equal(t, []server.Entity{server.DisplayEntity{Id: 1, Score: 3}}, def.TopEntities(g, stats, 1))
+
+	// Types that the stats don't cover are always calculated.
+	def.StatsTopEntities = nil
+	assert.Equal(t, 2, len(def.TopEntities(g, stats, 0)))
+}
+
+func TestEntityTypeRegistry_SaveAndLoadDAOs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "entity_types_test")
+	defer os.RemoveAll(dir)
+
+	dao := &labelFileDAOForTest{labels: map[int]string{1: "Elections"}}
+	registry := newEntityTypesWithoutOrgForTest()
+	assert.Nil(t, registry.Register(newTopicEntityTypeForTest(dao)))
+
+	// Nothing has been saved yet.
+	assert.Nil(t, registry.LoadDAOs(server.NewContentDAO(), dir))
+
+	assert.Nil(t, registry.SaveDAOs(server.NewContentDAO(), dir))
+	dao.labels = map[int]string{}
+	assert.Nil(t, registry.LoadDAOs(server.NewContentDAO(), dir))
+	assert.Equal(t, "Elections", dao.GetLabel(1))
+
+	// error case: corrupt labels file
+	ioutil.WriteFile(dir+"/topics.json", []byte("{"), 0600)
+	assert.NotNil(t, registry.LoadDAOs(server.NewContentDAO(), dir))
+}
+
+//
+// TEST HELPERS
+//
+
+// Defines a "Topic" entity type whose labels are kept in the specified DAO.
+// There's no topic graph in the content buffer, so topics take the place of
+// the orgs, and are kept in the org graph.
+func newTopicEntityTypeForTest(dao server.EntityDAO) EntityTypeDef {
+	return EntityTypeDef{
+		Type:        server.OrgEntity,
+		Name:        "Topic",
+		PluralName:  "Topics",
+		InfoPath:    "topic",
+		Graph:       func(g *server.ContentBuffer) *server.EntityGraph { return g.OrgGraph },
+		DAO:         func(contentDAO *server.ContentDAO) server.EntityDAO { return dao },
+		DAOFileName: "topics.json",
+	}
+}
+
+// Returns a registry of the built-in entity types, minus Org.
+func newEntityTypesWithoutOrgForTest() *EntityTypeRegistry {
+	registry := &EntityTypeRegistry{}
+	for _, def := range newBuiltInEntityTypes().All() {
+		if def.Type != server.OrgEntity {
+			registry.Register(def)
+		}
+	}
+	return registry
+}
+
+// Registers the entity type with the app's registry in place of Org, and
+// returns a func that restores the registry.
+func registerEntityTypeForTest(t *testing.T, def EntityTypeDef) func() {
+	saved := *entityTypes
+	*entityTypes = *newEntityTypesWithoutOrgForTest()
+	assert.Nil(t, entityTypes.Register(def))
+	return func() {
+		*entityTypes = saved
+	}
+}
+
+// An EntityDAO that saves its labels as JSON.
+type labelFileDAOForTest struct {
+	FakeEntityDAO
+	labels map[int]string
+}
+
+func (dao *labelFileDAOForTest) GetLabel(entityId int) string {
+	return dao.labels[entityId]
+}
+
+func (dao *labelFileDAOForTest) Save(filePath string) error {
+	b, _ := json.Marshal(dao.labels)
+	return ioutil.WriteFile(filePath, b, 0600)
+}
+
+func (dao *labelFileDAOForTest) Load(filePath string) error {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &dao.labels)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"strings"
+)
+
+// Most candidate entities that are listed for a FilterItem that couldn't be
+// resolved (see UnresolvedFilterItem).
+const maxResolutionCandidates = 10
+
+// Describes a FilterItem, given by its Type and Label, that couldn't be
+// resolved to a single entity.  Disjunct and Conjunct give the item's position
+// within the filter, as for a FilterItemError.
+type UnresolvedFilterItem struct {
+	Disjunct int
+	Conjunct int
+	Negated  bool `json:",omitempty"`
+	Type     string
+	Label    string
+	Reason   string
+	// The entities of the item's type that either match its label equally
+	// well, or partially match it, for the client to choose from.
+	Candidates []FilterItem `json:",omitempty"`
+}
+
+// Returned when one or more FilterItems given by Type and Label match no
+// entity, or more than one.
+type FilterResolutionError struct {
+	UnresolvedItems []UnresolvedFilterItem
+}
+
+func (me *FilterResolutionError) Error() string {
+	reasons := make([]string, 0, len(me.UnresolvedItems))
+	for _, item := range me.UnresolvedItems {
+		reasons = append(reasons, fmt.Sprintf("%v '%v': %v", item.Type, item.Label, item.Reason))
+	}
+	return fmt.Sprintf("%v unresolved filter item(s): %v", len(me.UnresolvedItems), strings.Join(reasons, "; "))
+}
+
+// Returns the FilterItem with the Id that it resolves to, if it's given by
+// Type and Label (see resolveFilterItems).
+func resolveFilterItem(item FilterItem, entitySearch server.EntitySearch) (FilterItem, error) {
+	resolved, err := resolveFilterItems(FilterQuery{Or: []ConjunctiveExpr{ConjunctiveExpr{And: []FilterItem{item}}}}, entitySearch)
+	if err != nil {
+		return item, err
+	}
+	return resolved.Or[0].And[0], nil
+}
+
+// Returns a copy of the filter query in which every FilterItem given by Type
+// and Label (see FilterItem.IsUnresolved) has the Id of the entity of that
+// type whose label matches (ignoring case), as found through the entity
+// search.  Returns a *FilterResolutionError listing every item that matches
+// no entity or several, in which case the filter query is returned as is.
+func resolveFilterItems(filterQuery FilterQuery, entitySearch server.EntitySearch) (FilterQuery, error) {
+	resolved := filterQuery
+	if filterQuery.Or != nil {
+		resolved.Or = make([]ConjunctiveExpr, len(filterQuery.Or))
+	}
+	unresolvedItems := []UnresolvedFilterItem{}
+	searchResults := map[string]map[server.EntityType][]server.DisplayEntity{}
+
+	resolveItems := func(disjunct int, items []FilterItem, negated bool) []FilterItem {
+		if items == nil {
+			return nil
+		}
+		resolvedItems := make([]FilterItem, len(items))
+		for j, item := range items {
+			resolvedItems[j] = item
+			if !item.IsUnresolved() {
+				continue
+			}
+			addUnresolvedItem := func(reason string, candidates []FilterItem) {
+				unresolvedItems = append(unresolvedItems, UnresolvedFilterItem{Disjunct: disjunct, Conjunct: j, Negated: negated,
+					Type: item.Type, Label: item.Label, Reason: reason, Candidates: candidates})
+			}
+
+			def, found := entityTypes.ByName(item.Type)
+			if !found {
+				addUnresolvedItem(fmt.Sprintf("Unknown entity type: '%v'", item.Type), nil)
+				continue
+			}
+			searchString := strings.ToLower(strings.TrimSpace(item.Label))
+			if searchString == "" {
+				addUnresolvedItem("Label was empty", nil)
+				continue
+			}
+			if _, searched := searchResults[searchString]; !searched {
+				searchResults[searchString] = entitySearch.Find(searchString)
+			}
+
+			var matches, candidates []FilterItem
+			for _, entity := range searchResults[searchString][def.Type] {
+				candidate := FilterItem{Id: fmt.Sprintf("%v:%v", def.Name, entity.Id), Label: entity.Name}
+				if strings.EqualFold(strings.TrimSpace(entity.Name), searchString) {
+					matches = append(matches, candidate)
+				}
+				if len(candidates) < maxResolutionCandidates {
+					candidates = append(candidates, candidate)
+				}
+			}
+			switch {
+			case len(matches) == 1:
+				resolvedItems[j] = matches[0]
+			case len(matches) > 1:
+				if len(matches) > maxResolutionCandidates {
+					matches = matches[:maxResolutionCandidates]
+				}
+				addUnresolvedItem("Matches more than one entity", matches)
+			default:
+				addUnresolvedItem("Matches no entity", candidates)
+			}
+		}
+		return resolvedItems
+	}
+
+	for i, expr := range filterQuery.Or {
+		resolved.Or[i] = ConjunctiveExpr{And: resolveItems(i, expr.And, false), Not: resolveItems(i, expr.Not, true)}
+	}
+
+	if len(unresolvedItems) > 0 {
+		return filterQuery, &FilterResolutionError{UnresolvedItems: unresolvedItems}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	server "qbase/synthos/synthos_svr"
+	"strings"
+	"testing"
+)
+
+func TestResolveFilterItems(t *testing.T) {
+	entitySearch := newEntitySearchForTest()
+	filterQuery := FilterQuery{TimeRangeInHours: 8, Or: []ConjunctiveExpr{
+		ConjunctiveExpr{
+			And: []FilterItem{FilterItem{Type: "Org", Label: "boeing "}, FilterItem{Id: "Person:1"}},
+			Not: []FilterItem{FilterItem{Type: "Place", Label: "Seattle"}},
+		},
+	}}
+
+	resolved, err := resolveFilterItems(filterQuery, entitySearch)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, resolved.TimeRangeInHours)
+	assert.Equal(t, []FilterItem{FilterItem{Id: "Org:1", Label: "Boeing"}, FilterItem{Id: "Person:1"}}, resolved.Or[0].And)
+	assert.Equal(t, []FilterItem{FilterItem{Id: "Place:4", Label: "Seattle"}}, resolved.Or[0].Not)
+
+	// The original query is untouched.
+	assert.True(t, filterQuery.Or[0].And[0].IsUnresolved())
+
+	// Queries without such items are returned as they are.
+	resolved, err = resolveFilterItems(FilterQuery{}, entitySearch)
+	assert.Nil(t, err)
+	assert.Nil(t, resolved.Or)
+}
+
+func TestResolveFilterItems_errorCases(t *testing.T) {
+	filterQuery := FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Type: "Place", Label: "Paris"}}},
+		ConjunctiveExpr{
+			And: []FilterItem{FilterItem{Type: "Org", Label: "Boe"}, FilterItem{Type: "Org", Label: "Airbus"}},
+			Not: []FilterItem{FilterItem{Type: "Topic", Label: "Aviation"}, FilterItem{Type: "Person", Label: " "}},
+		},
+	}}
+
+	_, err := resolveFilterItems(filterQuery, newEntitySearchForTest())
+	resolutionErr, ok := err.(*FilterResolutionError)
+	if assert.True(t, ok) && assert.Equal(t, 5, len(resolutionErr.UnresolvedItems)) {
+		items := resolutionErr.UnresolvedItems
+
+		// Both Paris's match equally well.
+		assert.Equal(t, "Matches more than one entity", items[0].Reason)
+		assert.Equal(t, []FilterItem{FilterItem{Id: "Place:2", Label: "Paris"}, FilterItem{Id: "Place:3", Label: "Paris"}}, items[0].Candidates)
+
+		// "Boe" only partially matches the Boeings.
+		assert.Equal(t, "Matches no entity", items[1].Reason)
+		assert.Equal(t, 2, len(items[1].Candidates))
+		assert.Equal(t, UnresolvedFilterItem{Disjunct: 1, Conjunct: 1, Type: "Org", Label: "Airbus", Reason: "Matches no entity"}, items[2])
+
+		assert.True(t, items[3].Negated)
+		assert.Equal(t, "Unknown entity type: 'Topic'", items[3].Reason)
+		assert.Equal(t, "Label was empty", items[4].Reason)
+	}
+}
+
+//
+// TEST HELPERS
+//
+
+// An EntitySearch that finds the entities whose names contain the search
+// string.
+type entitySearchForTest map[server.EntityType][]server.DisplayEntity
+
+func (me entitySearchForTest) Find(searchStr string) map[server.EntityType][]server.DisplayEntity {
+	results := map[server.EntityType][]server.DisplayEntity{}
+	for entityType, entities := range me {
+		for _, entity := range entities {
+			if strings.Contains(strings.ToLower(entity.Name), searchStr) {
+				results[entityType] = append(results[entityType], entity)
+			}
+		}
+	}
+	return results
+}
+
+func newEntitySearchForTest() entitySearchForTest {
+	return entitySearchForTest{
+		server.OrgEntity: []server.DisplayEntity{
+			server.DisplayEntity{Id: 1, Name: "Boeing"},
+			server.DisplayEntity{Id: 5, Name: "Boeing Capital"},
+		},
+		server.PlaceEntity: []server.DisplayEntity{
+			server.DisplayEntity{Id: 2, Name: "Paris"},
+			server.DisplayEntity{Id: 3, Name: "Paris"},
+			server.DisplayEntity{Id: 4, Name: "Seattle"},
+		},
+	}
+}
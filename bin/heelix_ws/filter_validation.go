@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"strings"
+)
+
+// Describes a single FilterItem that failed validation.  Disjunct and Conjunct
+// give the item's position within the filter (i.e. Or[Disjunct].And[Conjunct],
+// or Or[Disjunct].Not[Conjunct] if Negated is true).
+type FilterItemError struct {
+	Disjunct int
+	Conjunct int
+	Negated  bool `json:",omitempty"`
+	Id       string
+	Reason   string
+}
+
+// Returned when one or more FilterItems within a FilterQuery refer to
+// malformed, unsupported or unknown entities.
+type FilterValidationError struct {
+	InvalidItems []FilterItemError
+}
+
+func (me *FilterValidationError) Error() string {
+	reasons := make([]string, 0, len(me.InvalidItems))
+	for _, item := range me.InvalidItems {
+		reasons = append(reasons, fmt.Sprintf("'%v': %v", item.Id, item.Reason))
+	}
+	return fmt.Sprintf("%v invalid filter item(s): %v", len(me.InvalidItems), strings.Join(reasons, "; "))
+}
+
+// Parses the Id of a FilterItem into its entity type and entity id, verifying
+// that the entity type is a registered one (see entityTypes).
+func parseFilterItem(item FilterItem) (entityType server.EntityType, entityId int, err error) {
+	entityTypeStr, entityId, err := parseEntityStr(item.Id)
+	if err != nil {
+		return entityType, -1, err
+	}
+
+	def, isValidEntityType := entityTypes.ByName(entityTypeStr)
+	if !isValidEntityType {
+		return entityType, -1, errors.New(fmt.Sprintf("Unknown entity type: '%v'", entityTypeStr))
+	}
+
+	return def.Type, entityId, nil
+}
+
+// Returns the DAO that holds the labels for the specified entity type.
+func entityDAOForType(contentDAO *server.ContentDAO, entityType server.EntityType) server.EntityDAO {
+	if def, found := entityTypes.ByType(entityType); found {
+		return def.DAO(contentDAO)
+	}
+	return nil
+}
+
+// Verifies that every FilterItem in the query refers to a well-formed entity
+// of a supported type that is known to the ContentDAO.  Items that are given
+// by Type and Label are skipped, since they're verified as they're resolved
+// (see resolveFilterItems).  If refreshLabels is
+// true, any item whose Label differs from the entity's current label is
+// updated in place.  Returns a *FilterValidationError listing every invalid
+// item, or nil if the whole query is valid.  A Keywords clause that can't be
+// parsed, a blank source name, or an invalid geographic area is reported as
+// a plain error.
+func validateFilterQuery(filterQuery *FilterQuery, contentDAO *server.ContentDAO, refreshLabels bool) error {
+	if filterQuery.IsKeywordFilterSpecified() {
+		if _, err := parseKeywordQuery(filterQuery.Keywords); err != nil {
+			return err
+		}
+	}
+
+	for _, source := range append(append([]string{}, filterQuery.Sources...), filterQuery.ExcludedSources...) {
+		if strings.TrimSpace(source) == "" {
+			return errors.New("Source names may not be empty")
+		}
+	}
+
+	if err := validateGeoFilter(*filterQuery); err != nil {
+		return err
+	}
+
+	if err := filterQuery.ValidateStatsParams(); err != nil {
+		return err
+	}
+
+	invalidItems := []FilterItemError{}
+
+	validateItems := func(disjunct int, items []FilterItem, negated bool) {
+		for j := range items {
+			item := &items[j]
+			if item.IsUnresolved() {
+				continue
+			}
+			addInvalidItem := func(reason string) {
+				invalidItems = append(invalidItems, FilterItemError{Disjunct: disjunct, Conjunct: j, Negated: negated, Id: item.Id, Reason: reason})
+			}
+
+			entityType, entityId, err := parseFilterItem(*item)
+			if err != nil {
+				addInvalidItem(err.Error())
+				continue
+			}
+
+			currentLabel := entityDAOForType(contentDAO, entityType).GetLabel(entityId)
+			if currentLabel == "" {
+				addInvalidItem("Entity doesn't exist")
+				continue
+			}
+
+			if refreshLabels && item.Label != currentLabel {
+				logger.Printf("Refreshing stale label for %v: '%v' -> '%v'", item.Id, item.Label, currentLabel)
+				item.Label = currentLabel
+			}
+		}
+	}
+
+	for i := range filterQuery.Or {
+		validateItems(i, filterQuery.Or[i].And, false)
+		validateItems(i, filterQuery.Or[i].Not, true)
+	}
+
+	if len(invalidItems) > 0 {
+		return &FilterValidationError{InvalidItems: invalidItems}
+	}
+
+	return nil
+}
+
+// Verifies the filter query's geographic areas, if any.
+func validateGeoFilter(filterQuery FilterQuery) error {
+	if filterQuery.GeoBoundingBox != nil {
+		if err := filterQuery.GeoBoundingBox.Validate(); err != nil {
+			return err
+		}
+	}
+	if filterQuery.GeoRadius != nil {
+		if err := filterQuery.GeoRadius.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+)
+
+func TestParseFilterItem(t *testing.T) {
+	entityType, entityId, err := parseFilterItem(FilterItem{Id: "Org:123"})
+	assert.Nil(t, err)
+	assert.Equal(t, server.OrgEntity, entityType)
+	assert.Equal(t, 123, entityId)
+
+	// error case: unsupported entity type
+	_, _, err = parseFilterItem(FilterItem{Id: "Persn:123"})
+	assert.NotNil(t, err)
+
+	// error case: malformed id
+	_, _, err = parseFilterItem(FilterItem{Id: "Person:abc"})
+	assert.NotNil(t, err)
+}
+
+func TestValidateFilterQuery(t *testing.T) {
+	contentDAO := newLabeledContentDAO()
+
+	filterQuery := FilterQuery{
+		Or: []ConjunctiveExpr{
+			ConjunctiveExpr{And: []FilterItem{
+				FilterItem{Id: "Person:1", Label: "Joe"},
+				FilterItem{Id: "Persn:123", Label: "Typo"},
+			}},
+			ConjunctiveExpr{And: []FilterItem{
+				FilterItem{Id: "Org:99999", Label: "Unknown Org"},
+			}},
+		},
+	}
+
+	err := validateFilterQuery(&filterQuery, contentDAO, false)
+	assert.NotNil(t, err)
+
+	validationErr, ok := err.(*FilterValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(validationErr.InvalidItems))
+	assert.Equal(t, FilterItemError{Disjunct: 0, Conjunct: 1, Id: "Persn:123", Reason: "Unknown entity type: 'Persn'"}, validationErr.InvalidItems[0])
+	assert.Equal(t, 1, validationErr.InvalidItems[1].Disjunct)
+	assert.Equal(t, "Org:99999", validationErr.InvalidItems[1].Id)
+
+	// The stale label is left alone unless a refresh was requested.
+	assert.Equal(t, "Joe", filterQuery.Or[0].And[0].Label)
+}
+
+func TestValidateFilterQuery_refreshLabels(t *testing.T) {
+	contentDAO := newLabeledContentDAO()
+
+	filterQuery := FilterQuery{
+		Or: []ConjunctiveExpr{
+			ConjunctiveExpr{And: []FilterItem{
+				FilterItem{Id: "Person:1", Label: "Joe"},
+				FilterItem{Id: "Place:3", Label: "Springfield"},
+			}},
+		},
+	}
+
+	assert.Nil(t, validateFilterQuery(&filterQuery, contentDAO, true))
+	assert.Equal(t, "Joe Smith", filterQuery.Or[0].And[0].Label)
+	assert.Equal(t, "Springfield", filterQuery.Or[0].And[1].Label)
+}
+
+func TestValidateFilterQuery_negatedItems(t *testing.T) {
+	filterQuery := FilterQuery{
+		Or: []ConjunctiveExpr{
+			ConjunctiveExpr{
+				And: []FilterItem{FilterItem{Id: "Person:1", Label: "Joe Smith"}},
+				Not: []FilterItem{
+					FilterItem{Id: "Org:2", Label: "Acme"},
+					FilterItem{Id: "Org:99999", Label: "Unknown Org"},
+				},
+			},
+		},
+	}
+
+	err := validateFilterQuery(&filterQuery, newLabeledContentDAO(), false)
+	validationErr, ok := err.(*FilterValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(validationErr.InvalidItems))
+	assert.Equal(t, 1, validationErr.InvalidItems[0].Conjunct)
+	assert.True(t, validationErr.InvalidItems[0].Negated)
+	assert.Equal(t, "Org:99999", validationErr.InvalidItems[0].Id)
+}
+
+func TestValidateFilterQuery_keywordsAndSources(t *testing.T) {
+	contentDAO := newLabeledContentDAO()
+
+	assert.Nil(t, validateFilterQuery(&FilterQuery{Keywords: "strike", Sources: []string{"Reuters"}}, contentDAO, false))
+	assert.NotNil(t, validateFilterQuery(&FilterQuery{Keywords: `"labor union`}, contentDAO, false))
+	assert.NotNil(t, validateFilterQuery(&FilterQuery{ExcludedSources: []string{" "}}, contentDAO, false))
+}
+
+func TestValidateFilterQuery_emptyFilter(t *testing.T) {
+	assert.Nil(t, validateFilterQuery(&FilterQuery{}, newLabeledContentDAO(), false))
+}
+
+//
+// TEST HELPERS
+//
+
+// Creates a ContentDAO that knows about Person:1, Org:2 and Place:3 only.
+func newLabeledContentDAO() *server.ContentDAO {
+	contentDAO := server.NewContentDAO()
+	contentDAO.PersonDAO = &LabeledEntityDAO{labels: map[int]string{1: "Joe Smith"}}
+	contentDAO.OrgDAO = &LabeledEntityDAO{labels: map[int]string{2: "Acme"}}
+	contentDAO.PlaceDAO = &LabeledEntityDAO{labels: map[int]string{3: "Springfield"}}
+	return contentDAO
+}
+
+type LabeledEntityDAO struct {
+	FakeEntityDAO
+	labels map[int]string
+}
+
+func (dao *LabeledEntityDAO) GetLabel(entityId int) string {
+	return dao.labels[entityId]
+}
+func (dao *LabeledEntityDAO) Size() int {
+	return len(dao.labels)
+}
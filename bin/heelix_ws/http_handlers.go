@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	migrate "qbase/synthos/heelix_ws/datamigrate"
@@ -63,7 +65,7 @@ func HealthCheck() webapp.HttpHandler {
 }
 
 // Returns configuration and runtime information about the deployed application.
-func GetSystemInfo(mgr *server.EntityManager, cfg AppConfig) webapp.HttpHandler {
+func GetSystemInfo(mgr *server.EntityManager, cfg AppConfig, dataHealth DataHealth, resultCache *ResultCache) webapp.HttpHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -82,9 +84,9 @@ func GetSystemInfo(mgr *server.EntityManager, cfg AppConfig) webapp.HttpHandler
 
 		itemCounts := map[string]int{
 			"Documents": contentBuffer.DocumentCount(),
-			"Persons":   contentBuffer.PersonGraph.EntityCount(),
-			"Orgs":      contentBuffer.OrgGraph.EntityCount(),
-			"Places":    contentBuffer.PlaceGraph.EntityCount(),
+		}
+		for _, def := range entityTypes.All() {
+			itemCounts[def.PluralName] = def.Graph(contentBuffer).EntityCount()
 		}
 
 		runtimeInfo := map[string]interface{}{
@@ -94,6 +96,8 @@ func GetSystemInfo(mgr *server.EntityManager, cfg AppConfig) webapp.HttpHandler
 			"TimeRangesInHours":   timeRangesInHours,
 			"OldestContent":       entityStats.OldestContent.String(),
 			"NewestContent":       entityStats.NewestContent.String(),
+			"DataHealth":          dataHealth,
+			"ResultCache":         resultCache.Stats(),
 		}
 
 		deploymentInfo := map[string]interface{}{
@@ -111,9 +115,9 @@ func GetSystemInfo(mgr *server.EntityManager, cfg AppConfig) webapp.HttpHandler
 	}
 }
 
-// Returns information about a specific 'Person' entity (e.g. Barack Obama).
-// The entity's ID is expected to be the last token in the slash-delimited
-// URL path (e.g. /api/person/12345).
+// Returns information about a specific entity of the specified type (e.g.
+// the Person Barack Obama).  The entity's ID is expected to be the last token
+// in the slash-delimited URL path (e.g. /api/person/12345).
 func FetchEntityInfo(entityType server.EntityType, entityAnnotator server.EntityAnnotator) webapp.UserHttpHandler {
 	return func(w http.ResponseWriter, r *http.Request, userId int) {
 		w.Header().Set("Content-Type", "application/json")
@@ -140,7 +144,105 @@ func FetchEntityInfo(entityType server.EntityType, entityAnnotator server.Entity
 	}
 }
 
-// Add a new user.
+// Returns the number of documents that mention an entity over time, for
+// charting a single entity's coverage (e.g.
+// GET /api/entity/Person/12345/timeline?bucket=6h&hours=48).  The 'bucket'
+// param sets the width of the buckets (default 1h), and the 'hours', or
+// 'start' and 'end' (RFC 3339), params select the time range, which defaults
+// to all of the retained content.  With 'by=source', the counts are also
+// broken down by news source, listing up to 'sources' (default 10) sources
+// separately.
+func GetEntityTimeline(mgr *server.EntityManager, docIndex *DocumentIndex) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("Entity timeline: User:%v; unsupported HTTP Verb '%v'", userId, r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		// The path is /api/entity/{type}/{id}/timeline.
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) != 5 || pathParts[4] != "timeline" {
+			http.Error(w, fmt.Sprintf("Unknown entity endpoint '%v'", r.URL.Path), http.StatusNotFound)
+			return
+		}
+		var def EntityTypeDef
+		found := false
+		for _, candidate := range entityTypes.All() {
+			if strings.EqualFold(candidate.Name, pathParts[2]) {
+				def, found = candidate, true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Unknown entity type '%v'", pathParts[2]), http.StatusNotFound)
+			return
+		}
+		entityId, err := parseObjectIdFromPath(strings.TrimSuffix(r.URL.Path, "/timeline"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not determine entity ID from '%v': %v", r.URL.Path, err), http.StatusBadRequest)
+			return
+		}
+		g := mgr.ContentBuffer()
+		docIds := def.Graph(g).DocumentIdsForEntity(entityId)
+		label := def.DAO(mgr.ContentDAO).GetLabel(entityId)
+		if label == "" && docIds.Size() == 0 {
+			http.Error(w, fmt.Sprintf("No %v with Id %v", def.Name, entityId), http.StatusNotFound)
+			return
+		}
+
+		params := r.URL.Query()
+		bucketQuery := FilterQuery{TrendBucket: params.Get("bucket")}
+		if bucketQuery.TrendBucket == "" {
+			bucketQuery.TrendBucket = defaultTimelineBucket
+		}
+		bucket, err := bucketQuery.TrendBucketDuration()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid bucket '%v': must be a whole number of minutes within [%v, %v], e.g. 1m or 1h",
+				bucketQuery.TrendBucket, minTrendBucket, maxTrendBucket), http.StatusBadRequest)
+			return
+		}
+		maxSources := 0
+		switch params.Get("by") {
+		case "":
+		case "source":
+			maxSources = defaultTimelineSources
+			if sources := params.Get("sources"); sources != "" {
+				maxSources, err = strconv.Atoi(sources)
+				if err != nil || maxSources < 1 || maxSources > maxTimelineSources {
+					http.Error(w, fmt.Sprintf("Invalid sources '%v': must be between 1 and %v", sources, maxTimelineSources), http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			http.Error(w, fmt.Sprintf("Invalid by '%v': the timeline can only be broken down by 'source'", params.Get("by")), http.StatusBadRequest)
+			return
+		}
+
+		timeRange, err := overrideTimeRange(FilterQuery{}, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+			return
+		}
+		start, end, err := resolveChartWindow(timeRange, g.LatestEntityStats(), time.Now())
+		if err != nil {
+			sendTimeWindowError(userId, err, w)
+			return
+		}
+
+		timeline, err := docIndex.CalcEntityTimeline(docIds, start, end, bucket, maxSources)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+			return
+		}
+		timeline.Id, timeline.Label = fmt.Sprintf("%v:%v", def.Name, entityId), label
+		timeline.Bucket, timeline.Start, timeline.End = bucketQuery.TrendBucket, start.UTC(), end.UTC()
+
+		sendJsonResponse(timeline, w)
+	}
+}
+
+// Add a new user.  The user's role defaults to RoleUser.
 func AddNewUser(userDb *UserDb) webapp.HttpHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -149,6 +251,7 @@ func AddNewUser(userDb *UserDb) webapp.HttpHandler {
 			type newUserInfo struct {
 				Email    string
 				Password string
+				Role     string
 			}
 
 			var userInfo newUserInfo
@@ -156,19 +259,27 @@ func AddNewUser(userDb *UserDb) webapp.HttpHandler {
 				http.Error(w, fmt.Sprintf("Error parsing userInfo: %v", err), http.StatusBadRequest)
 				return
 			}
+			if userInfo.Role != "" && !isValidRole(userInfo.Role) {
+				http.Error(w, fmt.Sprintf("Unknown role '%v'", userInfo.Role), http.StatusBadRequest)
+				return
+			}
 
 			user, err := userDb.AddUser(userInfo.Email, userInfo.Password)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Error creating new user: %v", err), http.StatusInternalServerError)
 				return
 			}
+			if userInfo.Role != "" {
+				userDb.SetRole(user.Id, userInfo.Role)
+				user.Role = userInfo.Role
+			}
 
 			sendJsonResponse(user, w)
 		})
 	}
 }
 
-func GetOrPostWatchLists(userDb *UserDb) webapp.UserHttpHandler {
+func GetOrPostWatchLists(userDb *UserDb, contentDAO *server.ContentDAO, entitySearch server.EntitySearch) webapp.UserHttpHandler {
 	return func(w http.ResponseWriter, r *http.Request, userId int) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -178,13 +289,15 @@ func GetOrPostWatchLists(userDb *UserDb) webapp.UserHttpHandler {
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Error getting watchlists for User:%v: %v", userId, err), http.StatusInternalServerError)
 			} else {
-				sendJsonResponse(watchLists, w)
+				sendJsonResponse(filterWatchLists(watchLists, r.URL.Query()), w)
 			}
 		case "POST":
 			getHttpRequestBody(w, r, func(postBody []byte) {
 				watchList, err := parseWatchList(postBody)
 				if err != nil {
 					http.Error(w, fmt.Sprintf("Error getting WatchList data from request for User:%v: %v", userId, err), http.StatusInternalServerError)
+				} else if err = validateWatchListFilter(&watchList.Filter, contentDAO, entitySearch, r); err != nil {
+					sendFilterValidationError(userId, err, w)
 				} else {
 					watchList, err = userDb.SaveWatchList(userId, watchList)
 					if err != nil {
@@ -200,7 +313,7 @@ func GetOrPostWatchLists(userDb *UserDb) webapp.UserHttpHandler {
 	}
 }
 
-func PutOrDeleteWatchList(userDb *UserDb) webapp.UserHttpHandler {
+func PutOrDeleteWatchList(userDb *UserDb, contentDAO *server.ContentDAO, entitySearch server.EntitySearch) webapp.UserHttpHandler {
 	return func(w http.ResponseWriter, r *http.Request, userId int) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -213,9 +326,12 @@ func PutOrDeleteWatchList(userDb *UserDb) webapp.UserHttpHandler {
 		switch r.Method {
 		case "PUT":
 			getHttpRequestBody(w, r, func(postBody []byte) {
-				watchList, err := parseWatchList(postBody)
+				stored, _ := userDb.GetWatchList(userId, watchListId)
+				watchList, err := parseWatchListUpdate(postBody, stored)
 				if err != nil {
 					http.Error(w, fmt.Sprintf("Error parsing WatchList data from request for User:%v: %v", userId, err), http.StatusInternalServerError)
+				} else if err = validateWatchListFilter(&watchList.Filter, contentDAO, entitySearch, r); err != nil {
+					sendFilterValidationError(userId, err, w)
 				} else {
 					watchList.Id = watchListId
 					_, err = userDb.SaveWatchList(userId, watchList)
@@ -235,68 +351,206 @@ func PutOrDeleteWatchList(userDb *UserDb) webapp.UserHttpHandler {
 	}
 }
 
-// Returns all entities in the EntityManager that match a given search term.
-// Matching logic is currently just a substring match.
-func FindEntities(entitySearch server.EntitySearch) webapp.UserHttpHandler {
+// Runs the filter query of one of the authenticated user's watchlists (e.g.
+// GET /api/watchlists/12/results), and responds in the same format as
+// GetAllEntityInfo.  Watchlists can't be shared, so only the owner may run one;
+// other users' watchlists are reported as not found.  The 'hours' param, or
+// the 'start' and 'end' params (RFC 3339), override the filter's time range,
+// and the LatestNews paging and explain params are the same as
+// GetAllEntityInfo's.
+func GetWatchListResults(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, entitySearch server.EntitySearch, resultCache *ResultCache, budget QueryBudget, userDb *UserDb) webapp.UserHttpHandler {
+	runQuery := entityInfoQueryRunner(mgr, docIndex, placeIndex, entitySearch, resultCache, budget, userDb)
 	return func(w http.ResponseWriter, r *http.Request, userId int) {
 		w.Header().Set("Content-Type", "application/json")
 
-		searchString := strings.TrimSpace(strings.ToLower(strutil.LastToken(r.URL.Path, "/")))
+		if r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("WatchList results: User:%v; unsupported HTTP Verb '%v'", userId, r.Method), http.StatusMethodNotAllowed)
+			return
+		}
 
-		var response map[string][]server.DisplayEntity
-		if !strutil.IsEmpty(searchString) {
-			searchResults := entitySearch.Find(searchString)
-			response = map[string][]server.DisplayEntity{
-				"Person": searchResults[server.PersonEntity],
-				"Org":    searchResults[server.OrgEntity],
-				"Place":  searchResults[server.PlaceEntity],
-			}
-		} else {
-			noEntities := []server.DisplayEntity{}
-			response = map[string][]server.DisplayEntity{
-				"Person": noEntities,
-				"Org":    noEntities,
-				"Place":  noEntities,
+		watchListId, err := parseObjectIdFromPath(strings.TrimSuffix(r.URL.Path, "/results"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not determine WatchList Id from '%v': %v", r.URL.Path, err), http.StatusBadRequest)
+			return
+		}
+
+		watchLists, err := userDb.GetWatchLists(userId)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting watchlists for User:%v: %v", userId, err), http.StatusInternalServerError)
+			return
+		}
+		var watchList *WatchList
+		for i := range watchLists {
+			if watchLists[i].Id == watchListId {
+				watchList = &watchLists[i]
 			}
 		}
+		if watchList == nil {
+			http.Error(w, fmt.Sprintf("User:%v has no WatchList:%v", userId, watchListId), http.StatusNotFound)
+			return
+		}
 
-		sendJsonResponse(response, w)
+		filterQuery, err := overrideTimeRange(watchList.Filter, r.URL.Query())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+			return
+		}
+		runQuery(w, r, userId, filterQuery)
 	}
 }
 
-// PA-241/PA-198: Support for disjunctive querying.
-func GetAllEntityInfo(mgr *server.EntityManager) webapp.UserHttpHandler {
+// Returns a copy of the filter query with its time range replaced by the one
+// in the 'hours', or 'start' and 'end', params (if any).
+func overrideTimeRange(filterQuery FilterQuery, params url.Values) (FilterQuery, error) {
+	hours, start, end := params.Get("hours"), params.Get("start"), params.Get("end")
+	if hours == "" && start == "" && end == "" {
+		return filterQuery, nil
+	}
+	if hours != "" && (start != "" || end != "") {
+		return filterQuery, errors.New("The hours param can't be combined with the start and end params")
+	}
+
+	filterQuery.TimeRangeInHours, filterQuery.StartTime, filterQuery.EndTime = 0, nil, nil
+	if hours != "" {
+		timeRangeInHours, err := strconv.Atoi(hours)
+		if err != nil || timeRangeInHours <= 0 {
+			return filterQuery, errors.New(fmt.Sprintf("Invalid hours '%v': must be a positive number", hours))
+		}
+		filterQuery.TimeRangeInHours = timeRangeInHours
+	}
+	parseTime := func(name string, value string) (*time.Time, error) {
+		if value == "" {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid %v '%v': must be an RFC 3339 time", name, value))
+		}
+		return &t, nil
+	}
+	var err error
+	if filterQuery.StartTime, err = parseTime("start", start); err != nil {
+		return filterQuery, err
+	}
+	if filterQuery.EndTime, err = parseTime("end", end); err != nil {
+		return filterQuery, err
+	}
+	return filterQuery, nil
+}
+
+// Assigns new sort positions to the authenticated user's watchlists.  The POST
+// body lists watchlist ids in the desired order, e.g. {"Ids": [12, 7, 9]}.
+func ReorderWatchLists(userDb *UserDb) webapp.UserHttpHandler {
+	return bulkUpdateWatchLists(userDb, func(userId int, update bulkWatchListUpdate) error {
+		return userDb.ReorderWatchLists(userId, update.Ids)
+	})
+}
+
+// Pins or unpins several of the authenticated user's watchlists at once, e.g.
+// {"Ids": [12, 7], "Pinned": true}.
+func PinWatchLists(userDb *UserDb) webapp.UserHttpHandler {
+	return bulkUpdateWatchLists(userDb, func(userId int, update bulkWatchListUpdate) error {
+		return userDb.PinWatchLists(userId, update.Ids, update.Pinned)
+	})
+}
+
+// Moves several of the authenticated user's watchlists into a folder at once,
+// e.g. {"Ids": [12, 7], "Folder": "Sports"}.
+func MoveWatchLists(userDb *UserDb) webapp.UserHttpHandler {
+	return bulkUpdateWatchLists(userDb, func(userId int, update bulkWatchListUpdate) error {
+		return userDb.MoveWatchLists(userId, update.Ids, update.Folder)
+	})
+}
+
+// The POST body accepted by the bulk watchlist endpoints.  Each endpoint only
+// looks at the fields relevant to it.
+type bulkWatchListUpdate struct {
+	Ids    []int
+	Pinned bool
+	Folder string
+}
+
+// Parses a bulkWatchListUpdate from the request body, applies it, and then
+// responds with the user's watchlists in their (possibly new) display order.
+func bulkUpdateWatchLists(userDb *UserDb, apply func(userId int, update bulkWatchListUpdate) error) webapp.UserHttpHandler {
 	return func(w http.ResponseWriter, r *http.Request, userId int) {
 		w.Header().Set("Content-Type", "application/json")
 
-		entityStr2entityType := map[string]server.EntityType{
-			"Person": server.PersonEntity,
-			"Org":    server.OrgEntity,
-			"Place":  server.PlaceEntity,
+		getHttpRequestBody(w, r, func(postBody []byte) {
+			var update bulkWatchListUpdate
+			if err := json.Unmarshal(postBody, &update); err != nil {
+				http.Error(w, fmt.Sprintf("User:%v: Error parsing bulk WatchList update: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+
+			if err := apply(userId, update); err != nil {
+				http.Error(w, fmt.Sprintf("User:%v: Error updating WatchLists: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+
+			watchLists, err := userDb.GetWatchLists(userId)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error getting watchlists for User:%v: %v", userId, err), http.StatusInternalServerError)
+				return
+			}
+
+			sendJsonResponse(watchLists, w)
+		})
+	}
+}
+
+// Returns the watchlists matching the optional 'tag' and 'folder' queryparams.
+// Passing an empty folder (i.e. "?folder=") selects top-level watchlists only.
+func filterWatchLists(watchLists []WatchList, queryParams url.Values) []WatchList {
+	tag := queryParams.Get("tag")
+	folders, isFolderSpecified := queryParams["folder"]
+
+	filteredWatchLists := make([]WatchList, 0, len(watchLists))
+	for _, watchList := range watchLists {
+		if tag != "" && !watchList.HasTag(tag) {
+			continue
+		}
+		if isFolderSpecified && watchList.Folder != folders[0] {
+			continue
 		}
+		filteredWatchLists = append(filteredWatchLists, watchList)
+	}
 
-		// This function calculates the 'AND' co-occurence of the conjunct expression
-		// of the form: ["and", "<entityType>:<id>", "<entityType:id", ...]
-		calcConjunctExpr := func(g *server.ContentBuffer, expr ConjunctiveExpr) (*server.ContentBuffer, error) {
-			logger.Printf("Calculating co-occurences for conjuncts: %v", expr.And)
-			for _, entity := range expr.And {
-				logger.Printf("Filtering on %v", entity.Id)
-				entityTypeStr, entityId, err := parseEntityStr(entity.Id)
-				if err != nil {
-					return nil, err
-				}
+	return filteredWatchLists
+}
 
-				entityType, isValidEntityType := entityStr2entityType[entityTypeStr]
-				if !isValidEntityType {
-					return nil, errors.New(fmt.Sprintf("Unknown entity type: '%v'", entityTypeStr))
-				}
+// Returns all entities in the EntityManager that match a given search term.
+// Matching logic is currently just a substring match.
+func FindEntities(entitySearch server.EntitySearch) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
 
-				g = g.FilterOnEntity(entityType, entityId)
-			}
+		searchString := strings.TrimSpace(strings.ToLower(strutil.LastToken(r.URL.Path, "/")))
 
-			return g, nil
+		searchResults := map[server.EntityType][]server.DisplayEntity{}
+		if !strutil.IsEmpty(searchString) {
+			searchResults = entitySearch.Find(searchString)
 		}
 
+		response := map[string][]server.DisplayEntity{}
+		for _, def := range entityTypes.All() {
+			if entities, found := searchResults[def.Type]; found {
+				response[def.Name] = entities
+			} else {
+				response[def.Name] = []server.DisplayEntity{}
+			}
+		}
+
+		sendJsonResponse(response, w)
+	}
+}
+
+// PA-241/PA-198: Support for disjunctive querying.
+func GetAllEntityInfo(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, entitySearch server.EntitySearch, resultCache *ResultCache, budget QueryBudget, userDb *UserDb) webapp.UserHttpHandler {
+	runQuery := entityInfoQueryRunner(mgr, docIndex, placeIndex, entitySearch, resultCache, budget, userDb)
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+
 		// Parse the posted data into the filter query in JSON format.
 		// This query is essentially a LISP expression of the form:
 		//
@@ -305,87 +559,434 @@ func GetAllEntityInfo(mgr *server.EntityManager) webapp.UserHttpHandler {
 		// where op is (for now) an 'or' operator (i.e. a disjunction).
 		// Each arg is a nested LISP conjunct expression of the form (and arg1 arg2...),
 		// where each arg is a string representing a distinct entity of the form
-		// "<entity type>:<entity id>" (e.g. "Person:9283742").
+		// "<entity type>:<entity id>" (e.g. "Person:9283742").  A conjunct expression
+		// may also exclude entities, i.e. (and arg1 ... (not argN ...)).
 		getHttpRequestBody(w, r, func(postedData []byte) {
-			var stats server.EntityStats
 			var err error
-			var finalContentBuffer *server.ContentBuffer
 
 			// Default filter query: no time range specified, and no entity filters specified.
 			filterQuery := FilterQuery{}
 
 			httpRequestContainsData := !strutil.IsEmpty(string(postedData))
-			if httpRequestContainsData {
+			if textQuery := r.URL.Query().Get("q"); textQuery != "" {
+				// The filter query may be given as a text query instead (see parseTextQuery).
+				if httpRequestContainsData {
+					http.Error(w, fmt.Sprintf("User %v: The q param can't be combined with a posted filter query", userId), http.StatusBadRequest)
+					return
+				}
+				if filterQuery, err = parseTextQuery(textQuery); err != nil {
+					sendQueryParseError(userId, err, w)
+					return
+				}
+			} else if httpRequestContainsData {
 				if err = json.Unmarshal(postedData, &filterQuery); err != nil {
 					http.Error(w, fmt.Sprintf("User %v: Error parsing posted JSON: %v", userId, err), http.StatusBadRequest)
 					return
 				}
 			}
 
-			var baseContentBuffer *server.ContentBuffer
-			if filterQuery.IsTimeRangeSpecified() {
-				timeRange := time.Duration(filterQuery.TimeRangeInHours) * time.Hour
-				logger.Printf("Getting content buffer for timeRange=%v", timeRange)
-				baseContentBuffer = mgr.ContentBufferForTimeRange(timeRange)
-			} else {
-				logger.Printf("Getting global content buffer")
-				baseContentBuffer = mgr.ContentBuffer()
+			runQuery(w, r, userId, filterQuery)
+		}) // End getHttpRequestBody()
+	}
+}
+
+// Responds with the network of entities that co-occur within the content
+// selected by the posted EntityNetworkRequest's filter, for the client to draw
+// as a relationship graph (see calcEntityNetwork).
+func GetEntityNetwork(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, entitySearch server.EntitySearch, budget QueryBudget) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+
+		getHttpRequestBody(w, r, func(postedData []byte) {
+			var request EntityNetworkRequest
+			if err := json.Unmarshal(postedData, &request); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: Error parsing posted JSON: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+			if err := request.Validate(); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				return
 			}
 
-			if filterQuery.IsEntityFilterSpecified() {
-				logger.Printf("Calculating entity co-occurrences with disjunct query: %+V", filterQuery.Or)
-				tmpContentBuffer := baseContentBuffer
-				finalContentBuffer = server.NewContentBuffer()
-				// Each disjunct is itself a conjunct expression of the form (and arg1 arg2 ...)
-				for _, conjunctiveExpr := range filterQuery.Or {
-					tmpContentBuffer, err = calcConjunctExpr(baseContentBuffer, conjunctiveExpr)
+			filterQuery, err := resolveFilterItems(request.Filter, entitySearch)
+			if err != nil {
+				sendFilterValidationError(userId, err, w)
+				return
+			}
+
+			var seed *entityKey
+			if request.Seed != nil {
+				seedItem, err := resolveFilterItem(*request.Seed, entitySearch)
+				if err != nil {
+					sendFilterValidationError(userId, err, w)
+					return
+				}
+				entityType, entityId, err := parseFilterItem(seedItem)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("User %v: Invalid Seed '%v': %v", userId, seedItem.Id, err), http.StatusBadRequest)
+					return
+				}
+				seed = &entityKey{entityType, entityId}
+			}
+
+			if err := budget.Check(filterQuery); err != nil {
+				sendQueryBudgetError(userId, err, budget, w)
+				return
+			}
+			ctx, cancel := budget.WithDeadline(r.Context())
+			defer cancel()
+
+			g, err := selectContent(ctx, mgr, docIndex, placeIndex, filterQuery, nil)
+			if err != nil {
+				sendContentSelectionError(userId, err, budget, w)
+				return
+			}
+			network, err := calcEntityNetwork(ctx, g, mgr.ContentDAO, seed, request)
+			if err != nil {
+				sendQueryBudgetError(userId, err, budget, w)
+				return
+			}
+
+			sendJsonResponse(network, w)
+		})
+	}
+}
+
+// Compares the coverage of several entities and/or the authenticated user's
+// watchlists over a shared time range (see ComparisonRequest), and responds
+// with their time series on shared buckets, each one's share of their total
+// coverage, and their change since the previous period.
+func GetComparison(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, entitySearch server.EntitySearch, budget QueryBudget, userDb *UserDb) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+
+		getHttpRequestBody(w, r, func(postedData []byte) {
+			var request ComparisonRequest
+			if err := json.Unmarshal(postedData, &request); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: Error parsing posted JSON: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+			if err := request.Validate(); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+
+			timeRange := request.TimeRange()
+			bucket, _ := timeRange.TrendBucketDuration()
+			g := mgr.ContentBuffer()
+			retained := g.LatestEntityStats()
+			start, end, err := resolveChartWindow(timeRange, retained, time.Now())
+			if err != nil {
+				sendTimeWindowError(userId, err, w)
+				return
+			}
+
+			// The entities are resolved together, one disjunct per item, so that
+			// each unresolved item's Disjunct is its position in the request.
+			entityQuery := FilterQuery{Or: make([]ConjunctiveExpr, len(request.Items))}
+			for i, item := range request.Items {
+				if item.Entity != nil {
+					entityQuery.Or[i].And = []FilterItem{*item.Entity}
+				}
+			}
+			entityQuery, err = resolveFilterItems(entityQuery, entitySearch)
+			if err != nil {
+				sendFilterValidationError(userId, err, w)
+				return
+			}
+			userDb.RecordEntityInfoQuery(userId, time.Now())
+
+			var watchLists []WatchList
+			ctx, cancel := budget.WithDeadline(r.Context())
+			defer cancel()
+			items := make([]comparedItem, len(request.Items))
+			for i, item := range request.Items {
+				if item.Entity != nil {
+					entityItem := entityQuery.Or[i].And[0]
+					entityType, entityId, err := parseFilterItem(entityItem)
 					if err != nil {
-						http.Error(w, fmt.Sprintf("User %v: Error processing conjunct expression: %v", userId, err), http.StatusBadRequest)
+						http.Error(w, fmt.Sprintf("User %v: Invalid Entity '%v' in item %v: %v", userId, entityItem.Id, i, err), http.StatusBadRequest)
 						return
 					}
-					finalContentBuffer = finalContentBuffer.Union(tmpContentBuffer)
+					def, _ := entityTypes.ByType(entityType)
+					items[i].series = ComparisonSeries{Id: entityItem.Id, Label: def.DAO(mgr.ContentDAO).GetLabel(entityId)}
+					if items[i].series.Label == "" {
+						items[i].series.Label = entityItem.Label
+					}
+					items[i].docIds = def.Graph(g).DocumentIdsForEntity(entityId)
+					continue
 				}
 
-				stats = finalContentBuffer.CalcEntityStats()
-			} else {
-				// Use the global stats, since this user has no filter set.
-				logger.Printf("No entity filter provided, so using global entity stats.")
-				finalContentBuffer = baseContentBuffer
-				stats = finalContentBuffer.LatestEntityStats()
+				if watchLists == nil {
+					if watchLists, err = userDb.GetWatchLists(userId); err != nil {
+						http.Error(w, fmt.Sprintf("Error getting watchlists for User:%v: %v", userId, err), http.StatusInternalServerError)
+						return
+					}
+				}
+				var watchList *WatchList
+				for j := range watchLists {
+					if watchLists[j].Id == item.WatchListId {
+						watchList = &watchLists[j]
+					}
+				}
+				if watchList == nil {
+					http.Error(w, fmt.Sprintf("User:%v has no WatchList:%v (item %v)", userId, item.WatchListId, i), http.StatusBadRequest)
+					return
+				}
+
+				// The watchlist's filter selects from all of the content, and the
+				// comparison's window is applied when its mentions are counted.
+				filterQuery, err := resolveFilterItems(watchList.Filter, entitySearch)
+				if err != nil {
+					sendFilterValidationError(userId, err, w)
+					return
+				}
+				filterQuery.TimeRangeInHours, filterQuery.StartTime, filterQuery.EndTime = 0, nil, nil
+				if err := budget.Check(filterQuery); err != nil {
+					sendQueryBudgetError(userId, err, budget, w)
+					return
+				}
+				content, err := selectContent(ctx, mgr, docIndex, placeIndex, filterQuery, nil)
+				if err != nil {
+					sendContentSelectionError(userId, err, budget, w)
+					return
+				}
+				items[i].series = ComparisonSeries{WatchListId: watchList.Id, Label: watchList.Title}
+				items[i].docIds = documentIds(content)
 			}
 
-			topEntities := map[string][]server.Entity{
-				"Person": annotateEntities(mgr.ContentDAO.PersonDAO, stats.TopPersons),
-				"Org":    annotateEntities(mgr.ContentDAO.OrgDAO, stats.TopOrgs),
-				"Place":  annotateEntities(mgr.ContentDAO.PlaceDAO, stats.TopPlaces),
+			comparison, err := calcComparison(ctx, docIndex, items, start, end, bucket, retained.OldestContent.Time())
+			if err != nil {
+				if ctx.Err() != nil {
+					sendQueryBudgetError(userId, err, budget, w)
+				} else {
+					http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				}
+				return
 			}
+			comparison.Bucket = request.TrendBucket
 
-			entityTimes, entityValues := stats.EntityTrend.Data()
+			sendJsonResponse(comparison, w)
+		})
+	}
+}
 
-			latestNews := make([]server.NewsArticle, 0, len(stats.LatestNews))
-			for _, doc := range stats.LatestNews {
-				newsArticle := server.NewsArticle{
-					Document: doc,
-					Persons:  annotateEntities(mgr.ContentDAO.PersonDAO, makeEntities(finalContentBuffer.PersonGraph.EntityIdsForDocument(doc.Id).Items())),
-					Orgs:     annotateEntities(mgr.ContentDAO.OrgDAO, makeEntities(finalContentBuffer.OrgGraph.EntityIdsForDocument(doc.Id).Items())),
-					Places:   annotateEntities(mgr.ContentDAO.PlaceDAO, makeEntities(finalContentBuffer.PlaceGraph.EntityIdsForDocument(doc.Id).Items())),
-				}
-				latestNews = append(latestNews, newsArticle)
+// Runs a filter query for a user, and responds with the TopEntities,
+// EntityTrend and LatestNews of the content that it selects.  The request's
+// URL params may page through the LatestNews, and ask for an explanation (see
+// GetAllEntityInfo).
+type entityInfoQueryFunc func(w http.ResponseWriter, r *http.Request, userId int, filterQuery FilterQuery)
+
+func entityInfoQueryRunner(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, entitySearch server.EntitySearch, resultCache *ResultCache, budget QueryBudget, userDb *UserDb) entityInfoQueryFunc {
+	return func(w http.ResponseWriter, r *http.Request, userId int, filterQuery FilterQuery) {
+		var stats server.EntityStats
+		var err error
+		var finalContentBuffer *server.ContentBuffer
+
+		if err := filterQuery.ValidateStatsParams(); err != nil {
+			http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+			return
+		}
+
+		// FilterItems may be given by Type and Label instead of by Id.
+		if filterQuery, err = resolveFilterItems(filterQuery, entitySearch); err != nil {
+			sendFilterValidationError(userId, err, w)
+			return
+		}
+
+		// The LatestNews can be paged through, instead of being the fixed-size
+		// list calculated with the stats (see parseNewsPageRequest).
+		var newsPageRequest *NewsPageRequest
+		if isNewsPageRequested(r.URL.Query()) {
+			pageRequest, err := parseNewsPageRequest(r.URL.Query())
+			if err != nil {
+				http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+			newsPageRequest = &pageRequest
+		}
+
+		// In explain mode, the response also describes how the query was run.
+		var explanation *QueryExplanation
+		if explainParam := r.URL.Query().Get("explain"); explainParam != "" {
+			explain, err := strconv.ParseBool(explainParam)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("User %v: Invalid explain param '%v'", userId, explainParam), http.StatusBadRequest)
+				return
+			}
+			if explain {
+				explanation = &QueryExplanation{FilterQuery: filterQuery}
+			}
+		}
+		queryStartTime := time.Now()
+
+		userDb.RecordEntityInfoQuery(userId, time.Now())
+		userDb.RecordFilterUse(userId, filterQuery, time.Now())
+
+		// Equivalent queries share their cached response (see ResultCache).
+		// Explained queries are always run, so that there's something to
+		// explain.
+		filterQuery = normalizeFilterQuery(filterQuery)
+		cacheKey := resultCacheKey(filterQuery, newsPageRequest)
+		var cacheGeneration int
+		if explanation != nil {
+			explanation.NormalizedQuery = filterQuery
+			explanation.ResultCacheHit = resultCache.Contains(cacheKey)
+		} else {
+			cachedResponse, generation, found := resultCache.Get(cacheKey)
+			if found {
+				w.Write(cachedResponse)
+				return
+			}
+			cacheGeneration = generation
+		}
+
+		if err := budget.Check(filterQuery); err != nil {
+			sendQueryBudgetError(userId, err, budget, w)
+			return
+		}
+		ctx, cancel := budget.WithDeadline(r.Context())
+		defer cancel()
+
+		baseContentBuffer, err := selectBaseContent(mgr, docIndex, placeIndex, filterQuery, explanation)
+		if err != nil {
+			sendContentSelectionError(userId, err, budget, w)
+			return
+		}
+
+		if err := ctx.Err(); err != nil {
+			sendQueryBudgetError(userId, err, budget, w)
+			return
+		}
+
+		if filterQuery.IsEntityFilterSpecified() {
+			if finalContentBuffer, err = selectEntityContent(ctx, baseContentBuffer, filterQuery, explanation); err != nil {
+				sendContentSelectionError(userId, err, budget, w)
+				return
 			}
 
-			response := map[string]interface{}{
-				"EntityTrend": EntityTrend{entityTimes, entityValues},
-				"TopEntities": topEntities,
-				"LatestNews":  latestNews,
+			start := time.Now()
+			stats = finalContentBuffer.CalcEntityStats()
+			explanation.SetStats("CalcEntityStats", start, finalContentBuffer)
+		} else if filterQuery.IsTimeWindowSpecified() || filterQuery.IsDocumentFilterSpecified() {
+			// The content was cut out for this request, so there are no stats to reuse.
+			finalContentBuffer = baseContentBuffer
+			start := time.Now()
+			stats = finalContentBuffer.CalcEntityStats()
+			explanation.SetStats("CalcEntityStats", start, finalContentBuffer)
+		} else {
+			// Use the global stats, since this user has no filter set.
+			logger.Printf("No entity filter provided, so using global entity stats.")
+			finalContentBuffer = baseContentBuffer
+			start := time.Now()
+			stats = finalContentBuffer.LatestEntityStats()
+			explanation.SetStats("LatestEntityStats", start, finalContentBuffer)
+		}
+
+		entityTimes, entityValues := stats.EntityTrend.Data()
+		entityTrend := EntityTrend{entityTimes, entityValues}
+		if filterQuery.IsTrendBucketSpecified() {
+			bucket, _ := filterQuery.TrendBucketDuration()
+			if entityTrend, err = docIndex.CalcEntityTrend(finalContentBuffer, bucket); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				return
 			}
+		}
+
+		// The stats are calculated with the default sizes, so anything else is
+		// calculated separately (see EntityTypeDef.TopEntities).
+		topEntities := map[string][]server.Entity{}
+		for _, def := range entityTypes.All() {
+			topEntities[def.Name] = annotateEntities(def.DAO(mgr.ContentDAO), def.TopEntities(finalContentBuffer, stats, filterQuery.TopN))
+		}
+
+		latestDocs := stats.LatestNews
+		var newsPage NewsPage
+		if newsPageRequest != nil {
+			if newsPage, err = docIndex.PageDocuments(finalContentBuffer, *newsPageRequest); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+			latestDocs = newsPage.Docs
+		} else {
+			newsPage.TotalMatches = docIndex.CountPageableDocuments(finalContentBuffer)
+		}
+
+		latestNews := make([]map[string]interface{}, 0, len(latestDocs))
+		for _, doc := range latestDocs {
+			latestNews = append(latestNews, annotateNewsArticle(finalContentBuffer, mgr.ContentDAO, doc))
+		}
 
+		response := map[string]interface{}{
+			"EntityTrend":  entityTrend,
+			"TopEntities":  topEntities,
+			"LatestNews":   latestNews,
+			"TotalMatches": newsPage.TotalMatches,
+		}
+		if newsPageRequest != nil {
+			response["NextCursor"] = newsPage.NextCursor
+		}
+		if explanation != nil {
+			// Explained responses aren't cached, since they're specific to this run.
+			explanation.TotalDuration = time.Since(queryStartTime).String()
+			response["Explain"] = explanation
 			sendJsonResponse(response, w)
-		}) // End getHttpRequestBody()
+			return
+		}
+
+		b, err := json.MarshalIndent(response, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b = append(b, '\n')
+		resultCache.Put(cacheKey, cacheGeneration, b)
+		w.Write(b)
 	}
 }
 
-// Saves the global data (a.k.a. the "content buffer") to disk.
-func SaveGlobalData(entityMgr *server.EntityManager, cfg AppConfig) webapp.HttpHandler {
+// Responds to a query whose content couldn't be selected (see selectContent):
+// with an HTTP 400 if the query is invalid, or as for sendTimeWindowError or
+// sendQueryBudgetError.
+func sendContentSelectionError(userId int, err error, budget QueryBudget, w http.ResponseWriter) {
+	switch err.(type) {
+	case *TimeWindowError:
+		sendTimeWindowError(userId, err, w)
+	default:
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			sendQueryBudgetError(userId, err, budget, w)
+			return
+		}
+		http.Error(w, fmt.Sprintf("User %v: %v", userId, err), http.StatusBadRequest)
+	}
+}
+
+// Responds to a query that's over its budget (see QueryBudget): with an HTTP
+// 422 if it has too many disjuncts or conjuncts, or an HTTP 503 if it ran out
+// of time.  Nothing is sent if the client has disconnected.
+func sendQueryBudgetError(userId int, err error, budget QueryBudget, w http.ResponseWriter) {
+	switch err := err.(type) {
+	case *QueryBudgetError:
+		logger.Printf("User:%v: Query over budget: %v", userId, err)
+		sendJsonErrorResponse(err, http.StatusUnprocessableEntity, w)
+	default:
+		if err == context.Canceled {
+			logger.Printf("User:%v: Query cancelled, since the client disconnected", userId)
+			return
+		}
+		logger.Printf("User:%v: Query timed out after %v", userId, budget.Timeout)
+		response := map[string]string{
+			"Error":   fmt.Sprintf("The query didn't complete within %v; try fewer disjuncts, or a shorter time range", budget.Timeout),
+			"Timeout": budget.Timeout.String(),
+		}
+		sendJsonErrorResponse(response, http.StatusServiceUnavailable, w)
+	}
+}
+
+// Saves the global data (a.k.a. the "content buffer") to disk, as a new
+// snapshot within the data directory.  The saved files are encrypted if the
+// keyring is enabled.
+func SaveGlobalData(entityMgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, cfg AppConfig, snapshots *SnapshotStore, keyring *Keyring) webapp.HttpHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -393,18 +994,94 @@ func SaveGlobalData(entityMgr *server.EntityManager, cfg AppConfig) webapp.HttpH
 			"SAVING GLOBAL DATA!\n" +
 			"========================\n\n")
 
-		dataDir := cfg.DataDir
-
-		createDataDirIfNotExists(dataDir)
-
-		refreshStatsLock.Lock()
-		entityMgr.ContentBuffer().SaveState(dataDir)
-		entityMgr.ContentDAO.Save(dataDir)
-		refreshStatsLock.Unlock()
+		createDataDirIfNotExists(cfg.DataDir)
+
+		snapshot, err := snapshots.Save(globalDataKind, func(dir string) error {
+			func() {
+				refreshStatsLock.Lock()
+				defer refreshStatsLock.Unlock()
+				entityMgr.ContentBuffer().SaveState(dir)
+				entityMgr.ContentDAO.Save(dir)
+			}()
+			if err := entityTypes.SaveDAOs(entityMgr.ContentDAO, dir); err != nil {
+				return err
+			}
+			if err := docIndex.Save(filepath.Join(dir, documentIndexFileName), keyring); err != nil {
+				return err
+			}
+			if err := placeIndex.Save(filepath.Join(dir, placeIndexFileName), keyring); err != nil {
+				return err
+			}
+			return keyring.EncryptFilesInDir(dir)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error saving global data to %v: %v", cfg.DataDir, err), http.StatusInternalServerError)
+			return
+		}
 
 		logger.Printf("\n\n========================\n" +
 			"GLOBAL DATA SAVED!\n" +
 			"========================\n\n")
+
+		sendJsonResponse(snapshot, w)
+	}
+}
+
+// Formats the posted filter query as a text query (see parseTextQuery), or
+// parses the text query in the q param into a filter query.
+func TranslateQuery() webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == "GET" {
+			filterQuery, err := parseTextQuery(r.URL.Query().Get("q"))
+			if err != nil {
+				sendQueryParseError(userId, err, w)
+				return
+			}
+			sendJsonResponse(filterQuery, w)
+			return
+		}
+
+		getHttpRequestBody(w, r, func(postedData []byte) {
+			var filterQuery FilterQuery
+			if err := json.Unmarshal(postedData, &filterQuery); err != nil {
+				http.Error(w, fmt.Sprintf("User %v: Error parsing posted JSON: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+
+			textQuery, err := formatFilterQuery(filterQuery)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("User %v: Can't format filter query: %v", userId, err), http.StatusBadRequest)
+				return
+			}
+			sendJsonResponse(map[string]string{"Q": textQuery}, w)
+		})
+	}
+}
+
+// Responds with an HTTP 400 and a JSON body describing why the text query
+// couldn't be parsed, including the position of the error.
+func sendQueryParseError(userId int, err error, w http.ResponseWriter) {
+	logger.Printf("User:%v: Invalid text query: %v", userId, err)
+
+	response := map[string]interface{}{
+		"Error": err.Error(),
+	}
+	if parseErr, ok := err.(*QueryParseError); ok {
+		response["Position"] = parseErr.Position
+		response["Message"] = parseErr.Message
+	}
+
+	sendJsonErrorResponse(response, http.StatusBadRequest, w)
+}
+
+// Lists the news sources of the content in the content buffer, with the
+// number of documents from each, most documents first.
+func GetSources(docIndex *DocumentIndex) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		w.Header().Set("Content-Type", "application/json")
+		sendJsonResponse(docIndex.CountSources(), w)
 	}
 }
 
@@ -444,46 +1121,129 @@ func CalcHotEntities(hotEntityCalc *cache.MemoizingFunc) webapp.UserHttpHandler
 	}
 }
 
+// Reports on all users that match the filters given by the query params:
+//
+//   last_login_within  only users who logged in within this duration (e.g. "72h")
+//   last_login_from    only users who last logged in on or after this date
+//   last_login_to      only users who last logged in on or before this date
+//   terms_accepted     only users who have ("true") or haven't ("false") accepted the terms
+//   role               only users with one of these (comma-separated) roles
+//
+// The 'columns' param selects the (comma-separated) report columns, and the
+// 'format' param (or else the Accept header) selects CSV, JSON or NDJSON
+// output.  Rows are streamed to the client as they're written.
 func CreateUsageReport(userDb *UserDb) webapp.HttpHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/csv")
+		spec, err := parseReportSpec(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid usage report request: %v", err), http.StatusBadRequest)
+			return
+		}
 
-		headerRow := "email, last_login, terms_accepted, watchlists"
-		fmt.Fprintln(w, headerRow)
+		w.Header().Set("Content-Type", reportContentTypes[spec.format])
+		flusher, canFlush := w.(http.Flusher)
 
-		// data rows
-		userDb.ForEachUser(func(user User) {
-			lastLogin := fmt.Sprintf("%v", user.LastLogin)
-			if user.LastLogin.IsEmpty() {
-				lastLogin = "NEVER"
+		reportWriter := newReportWriter(spec.format, w)
+		if err := reportWriter.writeHeader(spec.columns); err != nil {
+			logger.Printf("ERROR: writing usage report: %v", err)
+			return
+		}
+
+		rowCount := 0
+		for _, user := range userDb.usersWithLastActivity() {
+			if !spec.filter.matches(user) {
+				continue
+			}
+			if err = reportWriter.writeRow(spec.columns, user); err != nil {
+				break
 			}
+			rowCount++
+			if canFlush && rowCount%reportFlushInterval == 0 {
+				reportWriter.flush()
+				flusher.Flush()
+			}
+		}
+		if err == nil {
+			err = reportWriter.close()
+		}
+		if err != nil {
+			// The response has already started, so the error can only be logged.
+			logger.Printf("ERROR: writing usage report: %v", err)
+		}
+	}
+}
 
-			dataRow := fmt.Sprintf("%v, %v, %v, %v", user.Email, lastLogin, user.TermsAccepted, len(user.WatchLists))
-			fmt.Fprintln(w, dataRow)
-		})
+// Returns each user's activity (see UsageAnalytics), aggregated over the date
+// range given by the optional 'from' and 'to' query params (inclusive, in
+// the format YYYY-MM-DD).  The optional 'top_watchlists' param determines how
+// many of each user's most-used watchlists are listed.
+func GetUsageAnalytics(userDb *UserDb) webapp.HttpHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		queryParams := r.URL.Query()
+		from, to := queryParams.Get("from"), queryParams.Get("to")
+		for _, day := range []string{from, to} {
+			if _, err := time.Parse(activityDayFormat, day); day != "" && err != nil {
+				http.Error(w, fmt.Sprintf("Invalid date '%v' (expected YYYY-MM-DD)", day), http.StatusBadRequest)
+				return
+			}
+		}
+		if from != "" && to != "" && from > to {
+			http.Error(w, fmt.Sprintf("'from' (%v) is after 'to' (%v)", from, to), http.StatusBadRequest)
+			return
+		}
+
+		topWatchListCount := defaultTopWatchListCount
+		if topParam := queryParams.Get("top_watchlists"); topParam != "" {
+			var err error
+			if topWatchListCount, err = strconv.Atoi(topParam); err != nil || topWatchListCount < 0 {
+				http.Error(w, fmt.Sprintf("Invalid top_watchlists value: '%v'", topParam), http.StatusBadRequest)
+				return
+			}
+		}
+
+		response := map[string]interface{}{
+			"From":  from,
+			"To":    to,
+			"Users": userDb.CalcUsageAnalytics(from, to, topWatchListCount),
+		}
+		sendJsonResponse(response, w)
+	}
+}
+
+// Wraps a handler, counting each request towards the user's activity (see
+// UserDb.RecordRequest).  The endpoint is the route's path pattern (e.g.
+// "/api/watchlists/{id}"), which is combined with the request method.
+func TrackUsage(userDb *UserDb, endpoint string, h webapp.UserHttpHandler) webapp.UserHttpHandler {
+	return func(w http.ResponseWriter, r *http.Request, userId int) {
+		userDb.RecordRequest(userId, r.Method+" "+endpoint, time.Now())
+		h(w, r, userId)
 	}
 }
 
-// Saves all user-specific data to a data file named "user_data.dat" within
-// the directory specified by the SYNTHOS_DATA_DIR config (default directory
-// is /tmp/synthos/data).
-func SaveUserData(userDb *UserDb, cfg AppConfig) webapp.HttpHandler {
+// Saves all user-specific data to a data file named "user_data.json" within
+// a new snapshot of the directory specified by the SYNTHOS_DATA_DIR config
+// (default directory is /tmp/synthos/data).  The file is encrypted if the
+// keyring is enabled.
+func SaveUserData(userDb *UserDb, cfg AppConfig, snapshots *SnapshotStore, keyring *Keyring) webapp.HttpHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		dataDir := cfg.DataDir
-		userDataFilePath := filepath.Join(dataDir, "user_data.json")
-		logger.Printf("Saving user data to %v", userDataFilePath)
+		logger.Printf("Saving user data to a new snapshot in %v", cfg.DataDir)
 
-		createDataDirIfNotExists(dataDir)
+		createDataDirIfNotExists(cfg.DataDir)
 
-		err := userDb.Save(userDataFilePath)
+		snapshot, err := snapshots.Save(userDataKind, func(dir string) error {
+			return userDb.Save(filepath.Join(dir, userDataFileName), keyring)
+		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error saving user data to %v: %v", userDataFilePath, err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error saving user data to %v: %v", cfg.DataDir, err), http.StatusInternalServerError)
 			return
 		}
 
-		logger.Printf("User data saved to %v.", userDataFilePath)
+		logger.Printf("User data saved to %v.", snapshot.Dir)
+		sendJsonResponse(snapshot, w)
 	}
 }
 
@@ -508,7 +1268,15 @@ func parseObjectIdFromPath(urlPath string) (id int, err error) {
 }
 
 func parseWatchList(watchListJson []byte) (WatchList, error) {
-	var watchList WatchList
+	return parseWatchListUpdate(watchListJson, WatchList{})
+}
+
+// Parses an update to the stored watchlist.  The Title, Description and
+// Filter are replaced, but the organization fields (Tags, Folder, Pinned and
+// Position) keep their stored values unless the update sets them explicitly,
+// so that clients that don't know about them can't reset them.
+func parseWatchListUpdate(watchListJson []byte, stored WatchList) (WatchList, error) {
+	watchList := WatchList{Tags: stored.Tags, Folder: stored.Folder, Pinned: stored.Pinned, Position: stored.Position}
 	if err := json.Unmarshal(watchListJson, &watchList); err != nil {
 		return WatchList{}, err
 	}
@@ -520,6 +1288,69 @@ func parseWatchList(watchListJson []byte) (WatchList, error) {
 	return watchList, nil
 }
 
+// Returns true if the client asked for stale FilterItem labels to be replaced
+// with the entities' current labels (e.g. "/api/watchlists?refresh_labels=true").
+func isRefreshLabelsRequested(r *http.Request) bool {
+	return r.URL.Query().Get("refresh_labels") == "true"
+}
+
+// Returns true if the client asked for the FilterItems given by Type and Label
+// to be saved with the Ids they resolve to (e.g.
+// "/api/watchlists?resolve_ids=true").
+func isResolveIdsRequested(r *http.Request) bool {
+	return r.URL.Query().Get("resolve_ids") == "true"
+}
+
+// Resolves and validates a watchlist's filter (see resolveFilterItems and
+// validateFilterQuery), as requested by the refresh_labels and resolve_ids
+// params.  Unless resolve_ids is set, items given by Type and Label are kept
+// as they are, and resolved afresh whenever the watchlist is run.
+func validateWatchListFilter(filterQuery *FilterQuery, contentDAO *server.ContentDAO, entitySearch server.EntitySearch, r *http.Request) error {
+	resolved, err := resolveFilterItems(*filterQuery, entitySearch)
+	if err != nil {
+		return err
+	}
+	if isResolveIdsRequested(r) {
+		*filterQuery = resolved
+	}
+	return validateFilterQuery(filterQuery, contentDAO, isRefreshLabelsRequested(r))
+}
+
+// Responds with an HTTP 400 and a JSON body describing every FilterItem that
+// failed validation or couldn't be resolved, so that the client can flag the
+// offending entities.
+func sendFilterValidationError(userId int, err error, w http.ResponseWriter) {
+	logger.Printf("User:%v: Filter failed validation: %v", userId, err)
+
+	response := map[string]interface{}{
+		"Error": err.Error(),
+	}
+	if validationErr, ok := err.(*FilterValidationError); ok {
+		response["InvalidItems"] = validationErr.InvalidItems
+	}
+	if resolutionErr, ok := err.(*FilterResolutionError); ok {
+		response["UnresolvedItems"] = resolutionErr.UnresolvedItems
+	}
+
+	sendJsonErrorResponse(response, http.StatusBadRequest, w)
+}
+
+// Responds with an HTTP 400 and a JSON body describing why the requested
+// StartTime/EndTime window can't be served.
+func sendTimeWindowError(userId int, err error, w http.ResponseWriter) {
+	logger.Printf("User:%v: Invalid time window: %v", userId, err)
+
+	response := map[string]interface{}{
+		"Error": err.Error(),
+	}
+	if windowErr, ok := err.(*TimeWindowError); ok && !windowErr.RetainedFrom.IsZero() {
+		response["RetainedFrom"] = windowErr.RetainedFrom
+		response["RetainedTo"] = windowErr.RetainedTo
+	}
+
+	sendJsonErrorResponse(response, http.StatusBadRequest, w)
+}
+
 // Parses a string of the form "<entity type>:<entity id>" and returns the
 // constituent entity type string and entity id.  The browser client sends
 // entity IDs in this format.
@@ -550,6 +1381,18 @@ func makeEntities(entityIds []int) []server.Entity {
 	return entities
 }
 
+// Returns the document with the annotated entities of each registered type
+// that it mentions in g, keyed by the type's PluralName (so that the built-in
+// types are keyed as in a server.NewsArticle).
+func annotateNewsArticle(g *server.ContentBuffer, contentDAO *server.ContentDAO, doc server.Document) map[string]interface{} {
+	newsArticle := map[string]interface{}{"Document": doc}
+	for _, def := range entityTypes.All() {
+		entityIds := def.Graph(g).EntityIdsForDocument(doc.Id).Items()
+		newsArticle[def.PluralName] = annotateEntities(def.DAO(contentDAO), makeEntities(entityIds))
+	}
+	return newsArticle
+}
+
 func annotateEntities(entityDAO server.EntityDAO, entities []server.Entity) []server.Entity {
 	annotatedEntities := make([]server.Entity, 0, len(entities))
 	for _, entity := range entities {
@@ -579,6 +1422,18 @@ func sendJsonResponse(object interface{}, w http.ResponseWriter) {
 	fmt.Fprintln(w, string(b))
 }
 
+// Same as sendJsonResponse(), but responds with the specified HTTP error status code.
+func sendJsonErrorResponse(object interface{}, statusCode int, w http.ResponseWriter) {
+	b, err := json.MarshalIndent(object, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	fmt.Fprintln(w, string(b))
+}
+
 // Wraps an existing function, handling various IO error checking prior to
 // passing the request body into said function.  Example usage:
 //
@@ -5,8 +5,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	mock "qbase/synthos/heelix_ws/mock"
 	"qbase/synthos/synthos_core/json"
+	"qbase/synthos/synthos_core/unixtime"
+	"qbase/synthos/synthos_core/webapp"
 	server "qbase/synthos/synthos_svr"
 	"strings"
 	"testing"
@@ -23,7 +26,9 @@ func TestGetSystemInfo(t *testing.T) {
 		TimeRanges: []time.Duration{1 * time.Hour, 8 * time.Hour, 12 * time.Hour},
 	}
 
-	systemInfoHandler := GetSystemInfo(mgr, appCfg)
+	dataHealth := DataHealth{Degraded: true, Issues: []DataIssue{DataIssue{Kind: userDataKind, Error: "bad JSON"}}}
+
+	systemInfoHandler := GetSystemInfo(mgr, appCfg, dataHealth, NewResultCache(1<<20))
 
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "/api/system_info", nil)
@@ -38,6 +43,8 @@ func TestGetSystemInfo(t *testing.T) {
 	assert.True(t, response.Get("Runtime").Get("ItemCounts").Exists())
 	assert.True(t, response.Get("Runtime").Get("OldestContent").Exists())
 	assert.True(t, response.Get("Runtime").Get("NewestContent").Exists())
+	assert.True(t, response.Get("Runtime").Get("DataHealth").Get("Degraded").AsBool())
+	assert.True(t, response.Get("Runtime").Get("ResultCache").Get("HitRate").Exists())
 }
 
 func TestFetchEntityInfo_badHttpPath(t *testing.T) {
@@ -160,6 +167,21 @@ func TestFindEntities_emptySearchString(t *testing.T) {
 	assert.Equal(t, 0, len(response.Get("Place").AsList()))
 }
 
+func TestFindEntities_registeredEntityType(t *testing.T) {
+	defer registerEntityTypeForTest(t, newTopicEntityTypeForTest(&FakeEntityDAO{}))()
+
+	handler := FindEntities(&MockEntitySearch{})
+	mockWriter := httptest.NewRecorder()
+	mockRequest, _ := http.NewRequest("GET", "/api/search/alpha", nil)
+	handler(mockWriter, mockRequest, -1)
+
+	// The topics take the place of the orgs, so the orgs found are topics.
+	response := json.ParseBytes(mockWriter.Body.Bytes())
+	assert.Equal(t, 1, len(response.Get("Topic").AsList()))
+	assert.False(t, response.Get("Org").Exists())
+	assert.Equal(t, 1, len(response.Get("Person").AsList()))
+}
+
 func TestGetAllEntityInfo_noFiltersApplied(t *testing.T) {
 	config := server.EntityManagerConfig{
 		ContentSource: mock.NewMockContentSource(),
@@ -176,12 +198,432 @@ func TestGetAllEntityInfo_noFiltersApplied(t *testing.T) {
 	postBody := strings.NewReader("")
 	r, _ := http.NewRequest("GET", "/api/some/path", postBody)
 	userId := 123
-	handler := GetAllEntityInfo(entityMgr)
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
 	handler(w, r, userId)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestGetAllEntityInfo_timeWindow(t *testing.T) {
+	config := server.EntityManagerConfig{
+		ContentSource: mock.NewMockContentSource(),
+		TimeRanges:    []time.Duration{1 * time.Hour},
+	}
+	entityMgr := server.NewEntityManager(config)
+	now := unixtime.Now()
+	entityMgr.PreFill(now.Subtract(2*time.Hour), now)
+	entityMgr.RefreshStats(now)
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	windowStart := time.Now().Add(-1 * time.Hour).UTC().Format(time.RFC3339)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(fmt.Sprintf(`{"StartTime": "%v"}`, windowStart)))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, json.ParseBytes(w.Body.Bytes()).Get("EntityTrend").Exists())
+
+	// error case: the window reaches back further than the retained content
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"StartTime": "2001-01-01T00:00:00Z"}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, json.ParseBytes(w.Body.Bytes()).Get("RetainedFrom").Exists())
+}
+
+func TestGetAllEntityInfo_documentFilters(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Keywords": "strike boe*"}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// error case: malformed keywords
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Keywords": "\"labor union"}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// error case: invalid geographic area
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"GeoRadius": {"Lat": 47.6, "Lng": -122.3}}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAllEntityInfo_statsParams(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"TopN": 5, "TrendBucket": "1m"}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, len(json.ParseBytes(w.Body.Bytes()).Get("TopEntities").Get("Person").AsList()) <= 5)
+
+	// error case: TopN out of bounds
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"TopN": 1000}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAllEntityInfo_registeredEntityType(t *testing.T) {
+	// The test type is kept in the org graph, so topic 1 is mentioned by docs 1
+	// and 2, and topic 2 by docs 2 and 3.
+	topicDAO := &labelFileDAOForTest{labels: map[int]string{1: "Aviation", 2: "Labor"}}
+	defer registerEntityTypeForTest(t, newTopicEntityTypeForTest(topicDAO))()
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	docIndex := NewDocumentIndex()
+	now := unixtime.Now()
+	for docId, orgIds := range map[int][]int{1: {1}, 2: {1, 2}, 3: {2}} {
+		doc := server.Document{Id: docId, InsertDate: now.Subtract(time.Duration(docId) * time.Minute)}
+		entityMgr.ContentBuffer().AddNewsArticle(server.NewsArticle{Document: doc, Orgs: makeEntities(orgIds)})
+		docIndex.AddDocuments([]server.Document{doc})
+	}
+	entityMgr.RefreshStats(now)
+	handler := GetAllEntityInfo(entityMgr, docIndex, NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Topic:1"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, 2, response.Get("TotalMatches").AsInt())
+	topTopics := response.Get("TopEntities").Get("Topic").AsList()
+	assert.Equal(t, 2, len(topTopics))
+	assert.Equal(t, "Aviation", topTopics[0].Get("Name").AsString())
+	latestNews := response.Get("LatestNews").AsList()
+	assert.Equal(t, 2, len(latestNews))
+	for _, newsArticle := range latestNews {
+		assert.True(t, newsArticle.Get("Document").Exists())
+		assert.True(t, len(newsArticle.Get("Topics").AsList()) > 0)
+		assert.False(t, newsArticle.Get("Orgs").Exists())
+	}
+}
+
+func TestGetAllEntityInfo_resultCache(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	resultCache := NewResultCache(1 << 20)
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, resultCache, testQueryBudget, createUserDbForTest())
+
+	// The second query is the first one's disjuncts in another order.
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Person:1"}]}, {"And": [{"Id": "Org:2"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	firstResponse := w.Body.String()
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Org:2"}]}, {"And": [{"Id": "Person:1"}]}]}`))
+	handler(w, r, 456)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, firstResponse, w.Body.String())
+	assert.Equal(t, int64(1), resultCache.Stats().Hits)
+}
+
+func TestGetAllEntityInfo_queryBudget(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	budget := QueryBudget{MaxDisjuncts: 1, MaxConjuncts: 2, Timeout: time.Minute}
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(0), budget, createUserDbForTest())
+
+	// Duplicate disjuncts don't count towards the budget.
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Org:1"}]}, {"And": [{"Id": "Org:1"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// error case: too many disjuncts
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Org:1"}]}, {"And": [{"Id": "Org:2"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, 2, response.Get("Disjuncts").AsInt())
+	assert.Equal(t, 1, response.Get("MaxDisjuncts").AsInt())
+
+	// error case: the query runs out of time
+	budget.Timeout = time.Nanosecond
+	handler = GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(0), budget, createUserDbForTest())
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Id": "Org:1"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1ns", json.ParseBytes(w.Body.Bytes()).Get("Timeout").AsString())
+}
+
+func TestGetAllEntityInfo_explain(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	resultCache := NewResultCache(1 << 20)
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, resultCache, testQueryBudget, createUserDbForTest())
+	query := `{"Or": [{"And": [{"Id": "Org:1"}, {"Id": "Org:1"}]}, {"And": [{"Id": "Person:2"}]}]}`
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(query))
+	handler(w, r, 123)
+	assert.False(t, json.ParseBytes(w.Body.Bytes()).Get("Explain").Exists())
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info?explain=true", strings.NewReader(query))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	explanation := json.ParseBytes(w.Body.Bytes()).Get("Explain")
+	assert.Equal(t, 2, len(explanation.Get("FilterQuery").Get("Or").AsList()[0].Get("And").AsList()))
+	assert.Equal(t, 1, len(explanation.Get("NormalizedQuery").Get("Or").AsList()[0].Get("And").AsList()))
+	assert.Equal(t, "global", explanation.Get("BaseBuffer").AsString())
+	assert.Equal(t, 2, len(explanation.Get("Disjuncts").AsList()))
+	assert.Equal(t, "CalcEntityStats", explanation.Get("Stats").Get("Step").AsString())
+	assert.True(t, explanation.Get("ResultCacheHit").AsBool())
+
+	// Explained queries don't count as uses of the cache.
+	assert.Equal(t, int64(0), resultCache.Stats().Hits)
+
+	// error case: invalid explain param
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info?explain=please", strings.NewReader(query))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAllEntityInfo_newsPage(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info?limit=10&sort=oldest", strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.True(t, response.Get("TotalMatches").Exists())
+	assert.True(t, response.Get("NextCursor").Exists())
+
+	// error case: invalid sort order
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info?sort=relevance", strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAllEntityInfo_textQuery(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info?q="+url.QueryEscape("Person:1 OR NOT Org:2 headline:strike"), strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// error case: the text query doesn't parse
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info?q="+url.QueryEscape("Person:1 AND (Org:2"), strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 20, json.ParseBytes(w.Body.Bytes()).Get("Position").AsInt())
+
+	// error case: both a text query and a posted filter query
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info?q=Person:1", strings.NewReader(`{"TimeRangeInHours": 8}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAllEntityInfo_resolvesFilterItems(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetAllEntityInfo(entityMgr, NewDocumentIndex(), NewPlaceIndex(), newEntitySearchForTest(), NewResultCache(1<<20), testQueryBudget, createUserDbForTest())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Type": "Org", "Label": "Boeing"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// error case: ambiguous label
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/all_entity_info", strings.NewReader(`{"Or": [{"And": [{"Type": "Place", "Label": "Paris"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	unresolvedItems := json.ParseBytes(w.Body.Bytes()).Get("UnresolvedItems").AsList()
+	if assert.Equal(t, 1, len(unresolvedItems)) {
+		assert.Equal(t, 2, len(unresolvedItems[0].Get("Candidates").AsList()))
+	}
+}
+
+func TestGetEntityNetwork(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetEntityNetwork(entityMgr, NewDocumentIndex(), NewPlaceIndex(), newEntitySearchForTest(), testQueryBudget)
+	postNetworkRequest := func(postBody string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/api/entity_network", strings.NewReader(postBody))
+		handler(w, r, 123)
+		return w
+	}
+
+	w := postNetworkRequest(`{"Seed": {"Type": "Org", "Label": "Boeing"}, "Depth": 2, "Filter": {"TimeRangeInHours": 1}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, "Org:1", response.Get("Nodes").AsList()[0].Get("Id").AsString())
+	assert.True(t, response.Get("Edges").Exists())
+
+	w = postNetworkRequest(`{"MaxNodes": 10}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// error cases
+	w = postNetworkRequest(`{"Seed": {"Type": "Place", "Label": "Paris"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 1, len(json.ParseBytes(w.Body.Bytes()).Get("UnresolvedItems").AsList()))
+	for _, postBody := range []string{`{"Depth": 9}`, `{"Seed": {"Id": "Persn:1"}}`, `not json`} {
+		assert.Equal(t, http.StatusBadRequest, postNetworkRequest(postBody).Code, postBody)
+	}
+}
+
+func TestGetEntityTimeline(t *testing.T) {
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	docIndex := NewDocumentIndex()
+	now := unixtime.Now()
+	for docId := 1; docId <= 3; docId++ {
+		doc := server.Document{Id: docId, InsertDate: now.Subtract(time.Duration(docId) * time.Hour), Source: "Reuters"}
+		article := server.NewsArticle{Document: doc, Orgs: []server.Entity{server.DisplayEntity{Id: 1, Name: "Boeing"}}}
+		entityMgr.ContentBuffer().AddNewsArticle(article)
+		entityMgr.ContentDAO.Update(article)
+		docIndex.AddDocuments([]server.Document{doc})
+	}
+	entityMgr.RefreshStats(now)
+	handler := GetEntityTimeline(entityMgr, docIndex)
+	getTimeline := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, strings.NewReader(""))
+		handler(w, r, 123)
+		return w
+	}
+
+	w := getTimeline("/api/entity/org/1/timeline?bucket=30m&by=source")
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, "Org:1", response.Get("Id").AsString())
+	assert.Equal(t, "Boeing", response.Get("Label").AsString())
+	assert.Equal(t, 3, response.Get("TotalMentions").AsInt())
+	assert.Equal(t, "Reuters", response.Get("BySource").AsList()[0].Get("Source").AsString())
+
+	// The hours are cut short at the oldest retained content.
+	w = getTimeline("/api/entity/Org/1/timeline?hours=1000")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, json.ParseBytes(w.Body.Bytes()).Get("BySource").Exists())
+
+	// error cases
+	assert.Equal(t, http.StatusNotFound, getTimeline("/api/entity/Topic/1/timeline").Code)
+	assert.Equal(t, http.StatusNotFound, getTimeline("/api/entity/Org/99/timeline").Code)
+	assert.Equal(t, http.StatusNotFound, getTimeline("/api/entity/Org/1").Code)
+	for _, query := range []string{"bucket=90s", "by=person", "by=source&sources=0", "hours=2&start=2026-10-01T00:00:00Z", "start=2001-01-01T00:00:00Z"} {
+		assert.Equal(t, http.StatusBadRequest, getTimeline("/api/entity/Org/1/timeline?"+query).Code, query)
+	}
+}
+
+func TestGetComparison(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	watchList := makeWatchList("Airbus")
+	watchList.Filter = FilterQuery{Or: []ConjunctiveExpr{ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:2"}}}}}
+	watchList, _ = userDb.SaveWatchList(user.Id, watchList)
+
+	// Boeing (org 1) is mentioned 30, 90 and 150 minutes ago, and Airbus (org 2)
+	// 30 minutes ago.
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	docIndex := NewDocumentIndex()
+	now := unixtime.Now()
+	boeing, airbus := server.DisplayEntity{Id: 1, Name: "Boeing"}, server.DisplayEntity{Id: 2, Name: "Airbus"}
+	minutesAgo := map[int]int{1: 30, 2: 90, 3: 150, 4: 30}
+	for docId, org := range map[int]server.DisplayEntity{1: boeing, 2: boeing, 3: boeing, 4: airbus} {
+		doc := server.Document{Id: docId, InsertDate: now.Subtract(time.Duration(minutesAgo[docId]) * time.Minute)}
+		article := server.NewsArticle{Document: doc, Orgs: []server.Entity{org}}
+		entityMgr.ContentBuffer().AddNewsArticle(article)
+		entityMgr.ContentDAO.Update(article)
+		docIndex.AddDocuments([]server.Document{doc})
+	}
+	entityMgr.RefreshStats(now)
+	handler := GetComparison(entityMgr, docIndex, NewPlaceIndex(), newEntitySearchForTest(), testQueryBudget, userDb)
+	postComparison := func(postBody string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/api/compare", strings.NewReader(postBody))
+		handler(w, r, user.Id)
+		return w
+	}
+
+	w := postComparison(fmt.Sprintf(`{"Items": [{"Entity": {"Type": "Org", "Label": "boeing"}}, {"Entity": {"Id": "Org:2"}}, {"WatchListId": %v}], "TimeRangeInHours": 1, "TrendBucket": "30m"}`, watchList.Id))
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, "30m", response.Get("Bucket").AsString())
+	series := response.Get("Series").AsList()
+	assert.Equal(t, 3, len(series))
+	assert.Equal(t, "Org:1", series[0].Get("Id").AsString())
+	assert.Equal(t, "Boeing", series[0].Get("Label").AsString())
+	assert.Equal(t, 1, series[0].Get("PreviousMentions").AsInt())
+	assert.Equal(t, 0, series[1].Get("PreviousMentions").AsInt())
+	assert.Equal(t, "Airbus", series[2].Get("Label").AsString())
+	for _, s := range series {
+		assert.Equal(t, 1, s.Get("TotalMentions").AsInt())
+		assert.Equal(t, len(response.Get("Times").AsList()), len(s.Get("Values").AsList()))
+	}
+	assert.Equal(t, 1, countEntityInfoQueriesForTest(userDb, user.Id))
+
+	// error cases
+	w = postComparison(`{"Items": [{"Entity": {"Id": "Org:1"}}, {"Entity": {"Type": "Place", "Label": "Paris"}}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 1, json.ParseBytes(w.Body.Bytes()).Get("UnresolvedItems").AsList()[0].Get("Disjunct").AsInt())
+	for _, postBody := range []string{
+		`{"Items": []}`,
+		`{"Items": [{"Entity": {"Id": "Persn:1"}}]}`,
+		`{"Items": [{"WatchListId": 999}]}`,
+		`{"Items": [{"Entity": {"Id": "Org:1"}}], "StartTime": "2001-01-01T00:00:00Z"}`,
+		`not json`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, postComparison(postBody).Code, postBody)
+	}
+}
+
+func TestTranslateQuery(t *testing.T) {
+	handler := TranslateQuery()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/query?q="+url.QueryEscape("Person:1 AND NOT Org:2 last 8h"), strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, 8, response.Get("TimeRangeInHours").AsInt())
+	assert.Equal(t, "Org:2", response.Get("Or").AsList()[0].Get("Not").AsList()[0].Get("Id").AsString())
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/query", strings.NewReader(`{"TimeRangeInHours": 8, "Or": [{"And": [{"Id": "Person:1"}], "Not": [{"Id": "Org:2"}]}]}`))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Person:1 AND NOT Org:2 last 8h", json.ParseBytes(w.Body.Bytes()).Get("Q").AsString())
+
+	// error case: the text query doesn't parse
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/query?q="+url.QueryEscape("Person:abc"), strings.NewReader(""))
+	handler(w, r, 123)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 1, json.ParseBytes(w.Body.Bytes()).Get("Position").AsInt())
+}
+
+func TestGetSources(t *testing.T) {
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Source: "Reuters"},
+		server.Document{Id: 2, Source: "Reuters"},
+		server.Document{Id: 3, Source: "BBC News"},
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/sources", nil)
+	GetSources(docIndex)(w, r, 123)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	response := json.ParseBytes(w.Body.Bytes()).AsList()
+	assert.Equal(t, 2, len(response))
+	assert.Equal(t, "Reuters", response[0].Get("Source").AsString())
+	assert.Equal(t, 2, response[0].Get("DocumentCount").AsInt())
+}
+
 func TestAddNewUser(t *testing.T) {
 	// Here's the handler we're going to be testing
 	userDb := NewUserDb()
@@ -216,6 +658,45 @@ func TestAddNewUser_malformedPost(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
+func TestGetUsageAnalytics(t *testing.T) {
+	userDb := NewUserDb()
+	userDb.AddUser("john@example.com", "blah-12345678")
+	user, _ := userDb.GetUserByEmail("john@example.com")
+
+	// Make a request through the TrackUsage wrapper, so that it's counted.
+	trackedHandler := TrackUsage(userDb, "/api/hot_entities", func(w http.ResponseWriter, r *http.Request, userId int) {})
+	request, _ := http.NewRequest("GET", "/api/hot_entities", nil)
+	trackedHandler(httptest.NewRecorder(), request, user.Id)
+
+	handler := GetUsageAnalytics(userDb)
+	today := time.Now().UTC().Format(activityDayFormat)
+	request, _ = http.NewRequest("GET", "/api/users/analytics?from="+today+"&to="+today, nil)
+	w := httptest.NewRecorder()
+	handler(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	response := json.ParseBytes(w.Body.Bytes())
+	users := response.Get("Users").AsList()
+	assert.Equal(t, 1, len(users))
+	assert.Equal(t, "john@example.com", users[0].Get("Email").AsString())
+	assert.Equal(t, 1, users[0].Get("Requests").Get("GET /api/hot_entities").AsInt())
+
+	// Date range in the past
+	request, _ = http.NewRequest("GET", "/api/users/analytics?to=2015-01-01", nil)
+	w = httptest.NewRecorder()
+	handler(w, request)
+	response = json.ParseBytes(w.Body.Bytes())
+	assert.Equal(t, 0, response.Get("Users").AsList()[0].Get("TotalRequests").AsInt())
+
+	// error cases: malformed dates and inverted range
+	for _, query := range []string{"from=yesterday", "to=2015-13-01", "from=2015-02-01&to=2015-01-01", "top_watchlists=-1"} {
+		request, _ = http.NewRequest("GET", "/api/users/analytics?"+query, nil)
+		w = httptest.NewRecorder()
+		handler(w, request)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
 func TestPutOrDeleteWatchList(t *testing.T) {
 	userDb := NewUserDb()
 	userDb.AddUser("john@example.com", "blah-12345678")
@@ -227,7 +708,7 @@ func TestPutOrDeleteWatchList(t *testing.T) {
 	assert.Equal(t, 1, len(watchLists))
 
 	// Here's the handler we're going to be testing
-	handler := PutOrDeleteWatchList(userDb)
+	handler := PutOrDeleteWatchList(userDb, NewFakeContentDAO(), &MockEntitySearch{})
 
 	// Update the title and description of the existing watchlist
 	postBody := "{\"Title\": \"WatchList_1A\", \"Description\": \"Updated description\"}"
@@ -256,13 +737,45 @@ func TestPutOrDeleteWatchList(t *testing.T) {
 	assert.Equal(t, 0, len(watchLists))
 }
 
+func TestPutOrDeleteWatchList_keepsOrganization(t *testing.T) {
+	userDb := NewUserDb()
+	userDb.AddUser("john@example.com", "blah-12345678")
+	user, _ := userDb.GetUserByEmail("john@example.com")
+	watchList := makeWatchList("WatchList_1")
+	watchList.Tags, watchList.Folder, watchList.Pinned, watchList.Position = []string{"aerospace"}, "Work", true, 7
+	watchList, _ = userDb.SaveWatchList(user.Id, watchList)
+	handler := PutOrDeleteWatchList(userDb, NewFakeContentDAO(), &MockEntitySearch{})
+	putWatchList := func(postBody string) WatchList {
+		request, _ := http.NewRequest("PUT", fmt.Sprintf("/api/watchlists/%v", watchList.Id), strings.NewReader(postBody))
+		mockWriter := httptest.NewRecorder()
+		handler(mockWriter, request, user.Id)
+		assert.Equal(t, http.StatusOK, mockWriter.Code)
+		updated, _ := userDb.GetWatchList(user.Id, watchList.Id)
+		return updated
+	}
+
+	// An older client only sends the title, description and filter.
+	updated := putWatchList(`{"Title": "WatchList_1A", "Description": "Updated", "Filter": {"TimeRangeInHours": 8}}`)
+	assert.Equal(t, "WatchList_1A", updated.Title)
+	assert.Equal(t, []string{"aerospace"}, updated.Tags)
+	assert.Equal(t, "Work", updated.Folder)
+	assert.True(t, updated.Pinned)
+	assert.Equal(t, 7, updated.Position)
+
+	// The organization fields can still be set explicitly.
+	updated = putWatchList(`{"Title": "WatchList_1A", "Pinned": false, "Folder": ""}`)
+	assert.False(t, updated.Pinned)
+	assert.Equal(t, "", updated.Folder)
+	assert.Equal(t, []string{"aerospace"}, updated.Tags)
+}
+
 func TestPutOrDeleteWatchList_errorCases(t *testing.T) {
 	userDb := NewUserDb()
 	userDb.AddUser("john@example.com", "blah-12345678")
 	user, _ := userDb.GetUserByEmail("john@example.com")
 
 	// Here's the handler we're going to be testing
-	handler := PutOrDeleteWatchList(userDb)
+	handler := PutOrDeleteWatchList(userDb, NewFakeContentDAO(), &MockEntitySearch{})
 
 	// A malformed request path should result in an HTTP 400 error response.
 	// In this case "UNPARSEABLE_ID" obviously cannot be parsed into an integer,
@@ -279,6 +792,189 @@ func TestPutOrDeleteWatchList_errorCases(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, mockWriter.Code)
 }
 
+func TestGetWatchListResults(t *testing.T) {
+	userDb := NewUserDb()
+	userDb.AddUser("john@example.com", "blah-12345678")
+	userDb.AddUser("jane@example.com", "blah-12345678")
+	john, _ := userDb.GetUserByEmail("john@example.com")
+	jane, _ := userDb.GetUserByEmail("jane@example.com")
+	watchList, _ := userDb.SaveWatchList(john.Id, makeWatchList("WatchList_1"))
+
+	entityMgr := server.NewEntityManager(server.EntityManagerConfig{ContentSource: mock.NewMockContentSource()})
+	handler := GetWatchListResults(entityMgr, NewDocumentIndex(), NewPlaceIndex(), &MockEntitySearch{}, NewResultCache(1<<20), testQueryBudget, userDb)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/watchlists/%v/results?hours=8&limit=5", watchList.Id), strings.NewReader(""))
+	handler(w, r, john.Id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := json.ParseBytes(w.Body.Bytes())
+	for _, key := range []string{"TopEntities", "EntityTrend", "LatestNews", "NextCursor"} {
+		assert.True(t, response.Get(key).Exists(), key)
+	}
+	assert.Equal(t, 1, countEntityInfoQueriesForTest(userDb, john.Id))
+
+	// error case: another user's watchlist
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", fmt.Sprintf("/api/watchlists/%v/results", watchList.Id), strings.NewReader(""))
+	handler(w, r, jane.Id)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// error cases: malformed id and time range overrides
+	for _, path := range []string{
+		"/api/watchlists/abc/results",
+		fmt.Sprintf("/api/watchlists/%v/results?hours=-1", watchList.Id),
+		fmt.Sprintf("/api/watchlists/%v/results?hours=8&start=2026-10-01T00:00:00Z", watchList.Id),
+		fmt.Sprintf("/api/watchlists/%v/results?end=yesterday", watchList.Id),
+	} {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", path, strings.NewReader(""))
+		handler(w, r, john.Id)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestOverrideTimeRange(t *testing.T) {
+	filterQuery := FilterQuery{TimeRangeInHours: 24, Keywords: "strike"}
+
+	overridden, err := overrideTimeRange(filterQuery, url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, filterQuery, overridden)
+
+	overridden, err = overrideTimeRange(filterQuery, url.Values{"hours": {"8"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, overridden.TimeRangeInHours)
+	assert.Equal(t, "strike", overridden.Keywords)
+
+	overridden, err = overrideTimeRange(filterQuery, url.Values{"start": {"2026-10-01T00:00:00Z"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, overridden.TimeRangeInHours)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), *overridden.StartTime)
+	assert.Nil(t, overridden.EndTime)
+}
+
+func TestGetOrPostWatchLists_invalidFilter(t *testing.T) {
+	userDb := NewUserDb()
+	user, _ := userDb.AddUser("john@example.com", "blah-12345678")
+
+	handler := GetOrPostWatchLists(userDb, newLabeledContentDAO(), &MockEntitySearch{})
+
+	// Person:1 exists, but Org:99999 doesn't and "Persn" is not an entity type.
+	postBody := `{"Title": "Bad WatchList", "Filter": {"Or": [{"And": [{"Id": "Person:1"}, {"Id": "Org:99999"}]}, {"And": [{"Id": "Persn:1"}]}]}}`
+	request, _ := http.NewRequest("POST", "/api/watchlists", strings.NewReader(postBody))
+	mockWriter := httptest.NewRecorder()
+	handler(mockWriter, request, user.Id)
+	assert.Equal(t, http.StatusBadRequest, mockWriter.Code)
+
+	response := json.ParseBytes(mockWriter.Body.Bytes())
+	invalidItems := response.Get("InvalidItems").AsList()
+	assert.Equal(t, 2, len(invalidItems))
+	assert.Equal(t, "Org:99999", invalidItems[0].Get("Id").AsString())
+	assert.Equal(t, "Persn:1", invalidItems[1].Get("Id").AsString())
+
+	// Nothing should have been saved.
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, 0, len(watchLists))
+
+	// Now a valid filter with a stale label, which should be refreshed on request.
+	postBody = `{"Title": "Good WatchList", "Filter": {"Or": [{"And": [{"Id": "Person:1", "Label": "Joe"}]}]}}`
+	request, _ = http.NewRequest("POST", "/api/watchlists?refresh_labels=true", strings.NewReader(postBody))
+	mockWriter = httptest.NewRecorder()
+	handler(mockWriter, request, user.Id)
+	assert.Equal(t, http.StatusOK, mockWriter.Code)
+
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, 1, len(watchLists))
+	assert.Equal(t, "Joe Smith", watchLists[0].Filter.Or[0].And[0].Label)
+}
+
+func TestGetOrPostWatchLists_resolveIds(t *testing.T) {
+	userDb := NewUserDb()
+	user, _ := userDb.AddUser("john@example.com", "blah-12345678")
+	handler := GetOrPostWatchLists(userDb, NewFakeContentDAO(), newEntitySearchForTest())
+	postWatchList := func(path string, label string) int {
+		postBody := `{"Title": "Boeing", "Filter": {"Or": [{"And": [{"Type": "Org", "Label": "` + label + `"}]}]}}`
+		request, _ := http.NewRequest("POST", path, strings.NewReader(postBody))
+		mockWriter := httptest.NewRecorder()
+		handler(mockWriter, request, user.Id)
+		return mockWriter.Code
+	}
+
+	// The item is saved as it was given, unless its id is asked for.
+	assert.Equal(t, http.StatusOK, postWatchList("/api/watchlists", "Boeing"))
+	assert.Equal(t, http.StatusOK, postWatchList("/api/watchlists?resolve_ids=true", "Boeing"))
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, FilterItem{Type: "Org", Label: "Boeing"}, watchLists[0].Filter.Or[0].And[0])
+	assert.Equal(t, FilterItem{Id: "Org:1", Label: "Boeing"}, watchLists[1].Filter.Or[0].And[0])
+
+	// error case: the label doesn't match an entity
+	assert.Equal(t, http.StatusBadRequest, postWatchList("/api/watchlists", "Airbus"))
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, 2, len(watchLists))
+}
+
+func TestGetOrPostWatchLists_filterByTagAndFolder(t *testing.T) {
+	userDb := NewUserDb()
+	user, _ := userDb.AddUser("john@example.com", "blah-12345678")
+	userDb.SaveWatchList(user.Id, WatchList{Title: "Tennis", Tags: []string{"sports"}, Folder: "Fun"})
+	userDb.SaveWatchList(user.Id, WatchList{Title: "Golf", Tags: []string{"sports"}})
+	userDb.SaveWatchList(user.Id, WatchList{Title: "Airbus", Folder: "Work"})
+
+	handler := GetOrPostWatchLists(userDb, NewFakeContentDAO(), &MockEntitySearch{})
+	getTitles := func(path string) []string {
+		request, _ := http.NewRequest("GET", path, nil)
+		mockWriter := httptest.NewRecorder()
+		handler(mockWriter, request, user.Id)
+		assert.Equal(t, http.StatusOK, mockWriter.Code)
+
+		titles := []string{}
+		for _, watchList := range json.ParseBytes(mockWriter.Body.Bytes()).AsList() {
+			titles = append(titles, watchList.Get("Title").AsString())
+		}
+		return titles
+	}
+
+	assert.Equal(t, []string{"Tennis", "Golf", "Airbus"}, getTitles("/api/watchlists"))
+	assert.Equal(t, []string{"Tennis", "Golf"}, getTitles("/api/watchlists?tag=sports"))
+	assert.Equal(t, []string{"Airbus"}, getTitles("/api/watchlists?folder=Work"))
+	assert.Equal(t, []string{"Golf"}, getTitles("/api/watchlists?folder="))
+	assert.Equal(t, []string{"Tennis"}, getTitles("/api/watchlists?tag=sports&folder=Fun"))
+}
+
+func TestBulkWatchListEndpoints(t *testing.T) {
+	userDb := NewUserDb()
+	user, _ := userDb.AddUser("john@example.com", "blah-12345678")
+	w1, _ := userDb.SaveWatchList(user.Id, makeWatchList("One"))
+	w2, _ := userDb.SaveWatchList(user.Id, makeWatchList("Two"))
+
+	post := func(handler webapp.UserHttpHandler, postBody string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/api/watchlists/bulk", strings.NewReader(postBody))
+		mockWriter := httptest.NewRecorder()
+		handler(mockWriter, request, user.Id)
+		return mockWriter
+	}
+
+	mockWriter := post(ReorderWatchLists(userDb), fmt.Sprintf(`{"Ids": [%v, %v]}`, w2.Id, w1.Id))
+	assert.Equal(t, http.StatusOK, mockWriter.Code)
+	response := json.ParseBytes(mockWriter.Body.Bytes()).AsList()
+	assert.Equal(t, "Two", response[0].Get("Title").AsString())
+
+	mockWriter = post(PinWatchLists(userDb), fmt.Sprintf(`{"Ids": [%v], "Pinned": true}`, w1.Id))
+	assert.Equal(t, http.StatusOK, mockWriter.Code)
+	response = json.ParseBytes(mockWriter.Body.Bytes()).AsList()
+	assert.Equal(t, "One", response[0].Get("Title").AsString())
+
+	mockWriter = post(MoveWatchLists(userDb), fmt.Sprintf(`{"Ids": [%v], "Folder": "Work"}`, w2.Id))
+	assert.Equal(t, http.StatusOK, mockWriter.Code)
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, "Work", watchLists[1].Folder)
+
+	// Error cases: malformed JSON and watchlists that don't belong to the user
+	mockWriter = post(MoveWatchLists(userDb), "NOT JSON")
+	assert.Equal(t, http.StatusBadRequest, mockWriter.Code)
+	mockWriter = post(PinWatchLists(userDb), `{"Ids": [-12345], "Pinned": true}`)
+	assert.Equal(t, http.StatusBadRequest, mockWriter.Code)
+}
+
 func TestCreateUsageReport(t *testing.T) {
 	userDb := NewUserDb()
 	userDb.AddUser("joe1@example.com", "blah-12345678")
@@ -291,11 +987,79 @@ func TestCreateUsageReport(t *testing.T) {
 	assert.Equal(t, http.StatusOK, mockWriter.Code)
 
 	expectedResponse := "" +
-		"email, last_login, terms_accepted, watchlists\n" +
-		"joe1@example.com, NEVER, false, 0\n" +
-		"joe2@example.com, NEVER, false, 0\n"
+		"email,last_login,terms_accepted,watchlists\n" +
+		"joe1@example.com,NEVER,false,0\n" +
+		"joe2@example.com,NEVER,false,0\n"
 
 	assert.Equal(t, expectedResponse, mockWriter.Body.String())
+	assert.Equal(t, "text/csv", mockWriter.Header().Get("Content-Type"))
+}
+
+func TestCreateUsageReport_quotesCsvValues(t *testing.T) {
+	userDb := NewUserDb()
+	userDb.AddUser(`"joe,jr"@example.com`, "blah-12345678")
+
+	request, _ := http.NewRequest("GET", "/api/users/report?columns=email", nil)
+	mockWriter := httptest.NewRecorder()
+	CreateUsageReport(userDb)(mockWriter, request)
+
+	assert.Equal(t, "email\n\"\"\"joe,jr\"\"@example.com\"\n", mockWriter.Body.String())
+}
+
+func TestCreateUsageReport_filtersAndFormats(t *testing.T) {
+	userDb := NewUserDb()
+	joe1, _ := userDb.AddUser("joe1@example.com", "blah-12345678")
+	joe2, _ := userDb.AddUser("joe2@example.com", "blah-12345678")
+	userDb.AddUser("joe3@example.com", "blah-12345678")
+	userDb.SetRole(joe1.Id, RoleAdmin)
+	userDb.SetTermsAccepted(joe1.Id)
+	userDb.SetTermsAccepted(joe2.Id)
+	userDb.SetLastLoginToNow(joe2.Id)
+
+	getReport := func(query string, accept string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", "/api/users/report?"+query, nil)
+		request.Header.Set("Accept", accept)
+		mockWriter := httptest.NewRecorder()
+		CreateUsageReport(userDb)(mockWriter, request)
+		return mockWriter
+	}
+
+	// JSON, negotiated through the Accept header
+	mockWriter := getReport("terms_accepted=true&columns=id,email,role", "application/json")
+	assert.Equal(t, http.StatusOK, mockWriter.Code)
+	assert.Equal(t, "application/json", mockWriter.Header().Get("Content-Type"))
+	rows := json.ParseBytes(mockWriter.Body.Bytes()).AsList()
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "joe1@example.com", rows[0].Get("email").AsString())
+	assert.Equal(t, "admin", rows[0].Get("role").AsString())
+	assert.Equal(t, "user", rows[1].Get("role").AsString())
+	assert.False(t, strings.Contains(mockWriter.Body.String(), "last_login"))
+
+	// NDJSON, selected through the format param
+	mockWriter = getReport("format=ndjson&role=user&last_login_within=1h&columns=email", "application/json")
+	assert.Equal(t, "application/x-ndjson", mockWriter.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"email\":\"joe2@example.com\"}\n", mockWriter.Body.String())
+
+	// JSON keys are in the requested column order.
+	userDb.RecordRequest(joe2.Id, "GET /api/watchlists", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	mockWriter = getReport("format=ndjson&role=user&last_login_within=1h&columns=watchlists,last_activity,email,id", "")
+	assert.Equal(t, fmt.Sprintf("{\"watchlists\":0,\"last_activity\":\"2026-10-01T12:00:00Z\",\"email\":\"joe2@example.com\",\"id\":%v}\n", joe2.Id),
+		mockWriter.Body.String())
+
+	// Last login window by date
+	mockWriter = getReport("last_login_to=2015-01-01&columns=email", "")
+	assert.Equal(t, "email\n", mockWriter.Body.String())
+
+	// An empty JSON report is still a valid JSON array.
+	mockWriter = getReport("format=json&role=admin&terms_accepted=false", "")
+	assert.Equal(t, 0, len(json.ParseBytes(mockWriter.Body.Bytes()).AsList()))
+
+	// error cases: bad format, column, role, terms and last login params
+	for _, query := range []string{"format=xml", "columns=email,password", "role=superuser", "terms_accepted=maybe",
+		"last_login_within=forever", "last_login_from=yesterday", "last_login_within=1h&last_login_from=2015-01-01"} {
+		mockWriter = getReport(query, "")
+		assert.Equal(t, http.StatusBadRequest, mockWriter.Code, query)
+	}
 }
 
 func TestGetMemStats(t *testing.T) {
@@ -389,6 +1153,20 @@ func NewFakeContentDAO() *server.ContentDAO {
 	return contentDAO
 }
 
+// Returns the number of dashboard queries that the user has made (see
+// UserDb.RecordEntityInfoQuery).
+func countEntityInfoQueriesForTest(userDb *UserDb, userId int) int {
+	count := 0
+	for _, analytics := range userDb.CalcUsageAnalytics("", "", 0) {
+		if analytics.UserId == userId {
+			for _, queries := range analytics.EntityInfoQueriesPerDay {
+				count += queries
+			}
+		}
+	}
+	return count
+}
+
 type FakeEntityDAO struct {
 }
 
@@ -407,3 +1185,5 @@ func (dao *FakeEntityDAO) Size() int {
 func (dao *FakeEntityDAO) Update(entities []server.Entity) {
 	panic("Not implemented!")
 }
+
+var testQueryBudget = QueryBudget{MaxDisjuncts: 100, MaxConjuncts: 500, Timeout: time.Minute}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	server "qbase/synthos/synthos_svr"
+	"strings"
+	"unicode"
+)
+
+// A parsed FilterQuery.Keywords clause.  A document matches if its headline
+// matches every term.
+type keywordQuery struct {
+	terms []keywordTerm
+}
+
+// A single word, a quoted phrase, or a prefix wildcard (e.g. strik*).
+type keywordTerm struct {
+	// The term's tokens (see tokenizeText).  A phrase matches if its tokens
+	// occur consecutively.
+	tokens []string
+	// If true, the last token matches any word that starts with it.
+	isPrefix bool
+}
+
+func (me keywordTerm) String() string {
+	s := strings.Join(me.tokens, " ")
+	if me.isPrefix {
+		s += "*"
+	}
+	if len(me.tokens) > 1 {
+		s = fmt.Sprintf("\"%v\"", s)
+	}
+	return s
+}
+
+// Parses a keyword clause, e.g. `strike "labor union" boe*`.  Terms are
+// separated by whitespace; quoted phrases match consecutive words, and a
+// trailing '*' matches any word with that prefix (within a phrase, only the
+// last word may be a prefix, e.g. "labor uni*").
+// Matching is case-insensitive, and on word boundaries: punctuation within a
+// term separates words, so "Boeing's" is the phrase "boeing s".
+func parseKeywordQuery(keywords string) (keywordQuery, error) {
+	query := keywordQuery{terms: []keywordTerm{}}
+
+	addTerm := func(text string, isPrefix bool) error {
+		tokens := tokenizeText(text)
+		if len(tokens) == 0 {
+			return errors.New(fmt.Sprintf("Keyword term '%v' doesn't contain any letters or digits", text))
+		}
+		query.terms = append(query.terms, keywordTerm{tokens: tokens, isPrefix: isPrefix})
+		return nil
+	}
+
+	rest := strings.TrimSpace(keywords)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return query, errors.New(fmt.Sprintf("Unterminated quoted phrase: %v", rest))
+			}
+			phrase := strings.TrimSpace(rest[1 : end+1])
+			if err := addTerm(strings.TrimSuffix(phrase, "*"), strings.HasSuffix(phrase, "*")); err != nil {
+				return query, err
+			}
+			rest = strings.TrimSpace(rest[end+2:])
+			continue
+		}
+
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		if strings.Contains(word, "\"") {
+			return query, errors.New(fmt.Sprintf("Unexpected quote in keyword term: %v", word))
+		}
+		isPrefix := strings.HasSuffix(word, "*")
+		if err := addTerm(strings.TrimSuffix(word, "*"), isPrefix); err != nil {
+			return query, err
+		}
+		rest = strings.TrimSpace(rest[end:])
+	}
+
+	if len(query.terms) == 0 {
+		return query, errors.New("Keyword clause is empty")
+	}
+	return query, nil
+}
+
+// Splits the text into lower-case words, i.e. runs of letters and digits.
+func tokenizeText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Returns the ids of the documents whose headline matches the query.  Must
+// be called with the lock held.
+func (me *DocumentIndex) matchKeywords(query keywordQuery) *server.IntSet {
+	var matches *server.IntSet
+	for _, term := range query.terms {
+		termMatches := me.matchKeywordTerm(term)
+		if matches == nil {
+			matches = termMatches
+			continue
+		}
+		intersection := server.NewIntSet()
+		matches.ForEach(func(docId int) {
+			if termMatches.Contains(docId) {
+				intersection.Put(docId)
+			}
+		})
+		matches = intersection
+	}
+
+	if matches == nil {
+		return server.NewIntSet()
+	}
+	return matches
+}
+
+func (me *DocumentIndex) matchKeywordTerm(term keywordTerm) *server.IntSet {
+	lastToken := term.tokens[len(term.tokens)-1]
+	matchesToken := func(i int, token string) bool {
+		if i == len(term.tokens)-1 && term.isPrefix {
+			return strings.HasPrefix(token, lastToken)
+		}
+		return token == term.tokens[i]
+	}
+
+	// Candidates are the documents that contain the term's first token.  The
+	// prefix of a single-word term has to be looked up across all tokens.
+	candidates := server.NewIntSet()
+	if len(term.tokens) == 1 && term.isPrefix {
+		for token, docIds := range me.headlineTokens {
+			if strings.HasPrefix(token, lastToken) {
+				candidates.PutAll(docIds)
+			}
+		}
+		return candidates
+	}
+	if docIds, exists := me.headlineTokens[term.tokens[0]]; exists {
+		candidates.PutAll(docIds)
+	}
+	if len(term.tokens) == 1 {
+		return candidates
+	}
+
+	// Check that the phrase occurs in each candidate's headline.
+	matches := server.NewIntSet()
+	candidates.ForEach(func(docId int) {
+		headlineTokens := me.docs[docId].headlineTokens
+		for start := 0; start+len(term.tokens) <= len(headlineTokens); start++ {
+			isMatch := true
+			for i := range term.tokens {
+				if !matchesToken(i, headlineTokens[start+i]) {
+					isMatch = false
+					break
+				}
+			}
+			if isMatch {
+				matches.Put(docId)
+				return
+			}
+		}
+	})
+	return matches
+}
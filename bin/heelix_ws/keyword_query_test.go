@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+)
+
+func TestParseKeywordQuery(t *testing.T) {
+	query, err := parseKeywordQuery(`  Strike "Labor  Union" boe*  Boeing's`)
+	assert.Nil(t, err)
+	assert.Equal(t, []keywordTerm{
+		keywordTerm{tokens: []string{"strike"}},
+		keywordTerm{tokens: []string{"labor", "union"}},
+		keywordTerm{tokens: []string{"boe"}, isPrefix: true},
+		keywordTerm{tokens: []string{"boeing", "s"}},
+	}, query.terms)
+
+	// error cases
+	for _, keywords := range []string{``, `   `, `"labor union`, `labor"union`, `*`, `strike --`} {
+		_, err := parseKeywordQuery(keywords)
+		assert.NotNil(t, err, keywords)
+	}
+}
+
+func TestMatchKeywords(t *testing.T) {
+	docIndex := NewDocumentIndex()
+	docIndex.AddDocuments([]server.Document{
+		server.Document{Id: 1, Headline: "Boeing workers go on STRIKE"},
+		server.Document{Id: 2, Headline: "Labor union strikes deal with Boeing"},
+		server.Document{Id: 3, Headline: "Union labor: a history"},
+		server.Document{Id: 4, Headline: "Airstrike hits depot"},
+	})
+
+	matches := func(keywords string) []int {
+		query, err := parseKeywordQuery(keywords)
+		assert.Nil(t, err)
+		docIds := docIndex.matchKeywords(query)
+		ids := []int{}
+		for docId := 1; docId <= 4; docId++ {
+			if docIds.Contains(docId) {
+				ids = append(ids, docId)
+			}
+		}
+		return ids
+	}
+
+	// Case-insensitive, and on word boundaries only.
+	assert.Equal(t, []int{1}, matches("strike"))
+	assert.Equal(t, []int{1, 2}, matches("strike*"))
+	assert.Equal(t, []int{2}, matches(`"labor union"`))
+	assert.Equal(t, []int{2}, matches(`"labor uni*"`))
+	assert.Equal(t, []int{2, 3}, matches("labor union"))
+	assert.Equal(t, []int{1, 2}, matches("boeing strik*"))
+	assert.Equal(t, []int{}, matches("boeing history"))
+	assert.Equal(t, []int{}, matches(`"union labor strikes"`))
+}
@@ -16,6 +16,7 @@ import (
 	server "qbase/synthos/synthos_svr"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -34,8 +35,12 @@ var refreshStatsLock sync.Locker
 // Fires up the EntityManager service.  Once started, the service will pull
 // the latest content (documents and entities) from the configured ContentSource
 // calculate some aggreate stats on them, and then make the stats available to
-// this web app.
-func startEntityManager(cfg AppConfig, contentSource server.ContentSource) *server.EntityManager {
+// this web app.  Saved content is loaded from dataDir, which is either a data
+// snapshot or (for data saved before snapshots existed) the configured DataDir.
+// If the saved content can't be loaded, the dataLoader falls back to an older
+// snapshot, or else the content buffer is filled from the content source.
+// The docIndex is pruned along with the content buffer.
+func startEntityManager(cfg AppConfig, contentSource server.ContentSource, dataDir string, dataLoader *DataLoader, docIndex *DocumentIndex, resultCache *ResultCache) *server.EntityManager {
 	// Create and configure a new EntityManager object.
 	entityManager := server.NewEntityManager(server.EntityManagerConfig{
 		TimeRanges:    cfg.TimeRanges,
@@ -45,12 +50,7 @@ func startEntityManager(cfg AppConfig, contentSource server.ContentSource) *serv
 	now := unixtime.Now()
 
 	// If it exists, load global content saved prior to previous app shutdown.
-	dataDir := cfg.DataDir
-	if server.FileExists(dataDir) {
-		logger.Printf("Loading saved content from %v", dataDir)
-		entityManager.LoadState(dataDir, now)
-		entityManager.ContentDAO.Load(dataDir)
-	} else {
+	if !dataLoader.LoadGlobalData(entityManager, dataDir, now) {
 		logger.Printf("Loading recent content directly from content source into content buffer.")
 		entityManager.PreFill(now.Subtract(cfg.DataPreFetchWindow), now)
 	}
@@ -78,6 +78,8 @@ func startEntityManager(cfg AppConfig, contentSource server.ContentSource) *serv
 					refreshStatsLock.Lock()
 					startTime := time.Now()
 					entityManager.FetchMoreContent(unixtime.Now())
+					docIndex.RemoveDocumentsOlderThan(entityManager.ContentBuffer().LatestEntityStats().OldestContent)
+					resultCache.Invalidate()
 					logger.Printf("entityManager.FetchMoreContent() took %v", time.Since(startTime))
 					refreshStatsLock.Unlock()
 				}
@@ -122,17 +124,65 @@ func createContentSource(useMockData bool, finchDb finch.DB) server.ContentSourc
 	return &server.ValidatingContentSource{TargetContentSource: rawContentSource}
 }
 
-// Creates an instance of the application user db, which stores all
-// user-specific data (user's personal info, watchlists, etc.).
-func createUserDb(dataDir string) (userDb *UserDb) {
-	userDataFilePath := filepath.Join(dataDir, "user_data.json")
+// Loads the indexes of the saved content from globalDataDir, i.e. the
+// directory that the content was loaded from.  Content saved before the
+// indexes existed isn't indexed, so it won't match any keyword or source
+// filters until it's been replaced by newly fetched content.  The place index
+// is also seeded with the coordinates of all known places (see
+// seedPlaceIndex), so that saved content can be filtered on its places either
+// way.
+func loadContentIndexes(docIndex *DocumentIndex, placeIndex *PlaceIndex, globalDataDir string, keyring *Keyring, contentDAO *server.ContentDAO, useMockData bool) {
+	if globalDataDir != "" {
+		load := func(fileName string, load func(filePath string, keyring *Keyring) error) {
+			filePath := filepath.Join(globalDataDir, fileName)
+			if !server.FileExists(filePath) {
+				logger.Printf("No %v was saved in %v, so saved content won't be indexed", fileName, globalDataDir)
+				return
+			}
+			if err := load(filePath, keyring); err != nil {
+				logger.Printf("ERROR: couldn't load %v, so saved content won't be indexed: %v", fileName, err)
+			}
+		}
+		load(documentIndexFileName, docIndex.Load)
+		load(placeIndexFileName, placeIndex.Load)
+	}
 
-	if server.FileExists(userDataFilePath) {
-		userDb = LoadUserDb(userDataFilePath)
+	seedPlaceIndex(placeIndex, contentDAO, useMockData)
+}
+
+// Adds the coordinates of all known places to the place index: the mock
+// places when using mock data, and otherwise the places held by the content
+// DAO, if it holds their coordinates (see placeLister).
+func seedPlaceIndex(placeIndex *PlaceIndex, contentDAO *server.ContentDAO, useMockData bool) {
+	var places []server.Entity
+	if useMockData {
+		places = mock.MockPlaces()
+	} else if lister, ok := contentDAO.PlaceDAO.(placeLister); ok {
+		places = lister.Places()
 	} else {
-		logger.Printf("%v doesn't exist, so loading hardcoded test users", userDataFilePath)
+		logger.Printf("The place DAO doesn't hold coordinates, so only places mentioned by indexed content can be filtered on")
+		return
+	}
+
+	placeIndex.AddPlaces(places)
+	logger.Printf("Seeded the place index with %v places", len(places))
+}
+
+// Creates an instance of the application user db, which stores all
+// user-specific data (user's personal info, watchlists, etc.).  The hardcoded
+// test users are only loaded if no user data was ever saved.  If saved user
+// data exists but none of it could be loaded, the app runs degraded with no
+// users, rather than with test users whose password is known.
+func createUserDb(dataDir string, dataLoader *DataLoader) *UserDb {
+	userDb, loaded := dataLoader.LoadUserDb(dataDir)
+	if !loaded {
 		userDb = NewUserDb()
-		createHardcodedUsers(userDb)
+		if dataLoader.Health().HasIssues(userDataKind) {
+			logger.Printf("ERROR: none of the saved user data could be loaded, so starting with no users (see DataHealth in /api/system_info)")
+		} else {
+			logger.Printf("No saved user data, so loading hardcoded test users")
+			createHardcodedUsers(userDb)
+		}
 	}
 
 	return userDb
@@ -167,15 +217,34 @@ func createHardcodedUsers(userDb *UserDb) {
 	}
 }
 
+// Migrates the latest saved data to the current data version, as a new
+// snapshot (see SnapshotStore.MigrateLatest).
+func runMigration(appConfig AppConfig) {
+	keyring, err := LoadKeyring(appConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	snapshotStore := NewSnapshotStore(appConfig.DataDir, appConfig.SnapshotKeepLast, appConfig.SnapshotKeepDays)
+	snapshot, migrated, err := snapshotStore.MigrateLatest(keyring, migrate.Migrate)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if migrated {
+		logger.Printf("Migrated data saved as snapshot %v", snapshot.Dir)
+	}
+}
+
 // This is the starting point of the application.
 func main() {
 	appConfig := MakeAppConfig()
 
 	// Handle command line options
 	runMigrationPtr := flag.Bool("migrate", false, "Run the data migration.")
+	strictLoadPtr := flag.Bool("strict", false, "Fail at startup if any saved data is corrupt, instead of quarantining it and falling back to older data.")
+	restoreSnapshotPtr := flag.String("restore", "", "Name of the data snapshot (see <data dir>/snapshots) to restore at startup.")
 	flag.Parse()
 	if *runMigrationPtr {
-		migrate.Migrate(appConfig.DataDir)
+		runMigration(appConfig)
 		os.Exit(0)
 	}
 
@@ -197,8 +266,27 @@ func main() {
 
 	useMockData := appConfig.UseMockData()
 
+	// Encrypts and decrypts the saved data files.
+	keyring, err := LoadKeyring(appConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if keyring.Enabled() {
+		logger.Printf("Encrypting saved data with key '%v'", keyring.ActiveKeyId())
+	}
+	// Every save of global or user data creates a new snapshot of the data directory.
+	snapshotStore := NewSnapshotStore(appConfig.DataDir, appConfig.SnapshotKeepLast, appConfig.SnapshotKeepDays)
+	// Saved data is loaded from the snapshot requested on the command line, or else from the latest one.
+	loadDir, err := snapshotStore.ResolveLoadDir(*restoreSnapshotPtr, appConfig.DataDir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Printf("Loading saved data from %v", loadDir)
+	// Loads the saved data, recovering from corrupt data files unless -strict is set.
+	dataLoader := NewDataLoader(appConfig.DataDir, snapshotStore, keyring, *strictLoadPtr)
+
 	// Application users and their associated user-specific content is stored here.
-	userDb := createUserDb(appConfig.DataDir)
+	userDb := createUserDb(loadDir, dataLoader)
 	// Handles user authentication and authorization.
 	auth := NewAuthenticator(userDb)
 	// Issues queries to the Finch database.
@@ -208,11 +296,19 @@ func main() {
 	}
 	// Provides info about a 'Person' entities (used for "Baseball Card" feature in app).
 	entityAnnotator := createEntityAnnotator(useMockData, finchDb)
+	// Indexes the documents' headlines (etc.), so that queries can filter on them.
+	docIndex := NewDocumentIndex()
+	// Indexes the coordinates of the places mentioned by the documents.
+	placeIndex := NewPlaceIndex()
+	// Caches the responses of the all_entity_info endpoint until the content changes.
+	resultCache := NewResultCache(appConfig.ResultCacheSizeMB << 20)
 	// Provides access to news documents and their associated entities.
-	contentSource := createContentSource(useMockData, finchDb)
+	contentSource := &IndexingContentSource{TargetContentSource: createContentSource(useMockData, finchDb), Index: docIndex, Places: placeIndex}
 	// Fire up the EntityManager component, which will periodically talk to the
 	// MemDB server to obtain the latest content.
-	entityMgr := startEntityManager(appConfig, contentSource)
+	entityMgr := startEntityManager(appConfig, contentSource, loadDir, dataLoader, docIndex, resultCache)
+	// The indexes of the saved content are saved alongside it.
+	loadContentIndexes(docIndex, placeIndex, dataLoader.Health().GlobalDataDir, keyring, entityMgr.ContentDAO, useMockData)
 	// Finds entities given a search string.
 	entitySearch := createEntitySearch(useMockData, entityMgr.ContentDAO, entityMgr.ContentBuffer(), finchDb)
 
@@ -220,10 +316,9 @@ func main() {
 	// be recalculated every few minutes or so.
 	memoizedHotEntityCalc := cache.NewMemoizingFunc(30*time.Second, func() interface{} {
 		hotEntities := entityMgr.ContentBufferForTimeRange(8 * time.Hour).CalcHotEntities()
-		annotatedHotEntities := map[string][]server.Entity{
-			"Person": annotateEntities(entityMgr.ContentDAO.PersonDAO, hotEntities[server.PersonEntity]),
-			"Org":    annotateEntities(entityMgr.ContentDAO.OrgDAO, hotEntities[server.OrgEntity]),
-			"Place":  annotateEntities(entityMgr.ContentDAO.PlaceDAO, hotEntities[server.PlaceEntity]),
+		annotatedHotEntities := map[string][]server.Entity{}
+		for _, def := range entityTypes.All() {
+			annotatedHotEntities[def.Name] = annotateEntities(def.DAO(entityMgr.ContentDAO), hotEntities[def.Type])
 		}
 		return annotatedHotEntities
 	})
@@ -238,25 +333,50 @@ func main() {
 
 	// Web service endpoints (open to the world)
 	appRouteHandler.HandleFunc("/api/health_check", HealthCheck())
-	appRouteHandler.HandleFunc("/api/system_info", GetSystemInfo(entityMgr, appConfig))
+	appRouteHandler.HandleFunc("/api/system_info", GetSystemInfo(entityMgr, appConfig, dataLoader.Health(), resultCache))
+
+	// Authorizes the request, and counts it towards the user's usage analytics.
+	authorizeAndTrack := func(endpoint string, h webapp.UserHttpHandler) webapp.HttpHandler {
+		return auth.AuthorizeUser(TrackUsage(userDb, endpoint, h))
+	}
 
 	// Web service endpoints (require user authentication/authorization)
 	appRouteHandler.HandleFunc("/api/authenticate", webapp.PostOnly(auth.AuthenticateUser()))
-	appRouteHandler.HandleFunc("/api/accept_terms", auth.AuthorizeUser(AcceptLicenseTerms(userDb)))
-	appRouteHandler.HandleFunc("/api/logout", auth.AuthorizeUser(Logout(userDb)))
-	appRouteHandler.HandleFunc("/api/all_entity_info", webapp.PostOnly(auth.AuthorizeUser(GetAllEntityInfo(entityMgr))))
-	appRouteHandler.HandleFunc("/api/person/", auth.AuthorizeUser(FetchEntityInfo(server.PersonEntity, entityAnnotator)))
-	appRouteHandler.HandleFunc("/api/org/", auth.AuthorizeUser(FetchEntityInfo(server.OrgEntity, entityAnnotator)))
-	appRouteHandler.HandleFunc("/api/watchlists", auth.AuthorizeUser(GetOrPostWatchLists(userDb)))
-	appRouteHandler.HandleFunc("/api/watchlists/", auth.AuthorizeUser(PutOrDeleteWatchList(userDb)))
-	appRouteHandler.HandleFunc("/api/search/", auth.AuthorizeUser(FindEntities(entitySearch)))
-	appRouteHandler.HandleFunc("/api/hot_entities", auth.AuthorizeUser(CalcHotEntities(memoizedHotEntityCalc)))
+	appRouteHandler.HandleFunc("/api/accept_terms", authorizeAndTrack("/api/accept_terms", AcceptLicenseTerms(userDb)))
+	appRouteHandler.HandleFunc("/api/logout", authorizeAndTrack("/api/logout", Logout(userDb)))
+	appRouteHandler.HandleFunc("/api/all_entity_info", webapp.PostOnly(authorizeAndTrack("/api/all_entity_info", GetAllEntityInfo(entityMgr, docIndex, placeIndex, entitySearch, resultCache, appConfig.QueryBudget(), userDb))))
+	appRouteHandler.HandleFunc("/api/entity_network", webapp.PostOnly(authorizeAndTrack("/api/entity_network", GetEntityNetwork(entityMgr, docIndex, placeIndex, entitySearch, appConfig.QueryBudget()))))
+	for _, def := range entityTypes.All() {
+		if def.InfoPath != "" {
+			appRouteHandler.HandleFunc("/api/"+def.InfoPath+"/", authorizeAndTrack("/api/"+def.InfoPath+"/{id}", FetchEntityInfo(def.Type, entityAnnotator)))
+		}
+	}
+	appRouteHandler.HandleFunc("/api/compare", webapp.PostOnly(authorizeAndTrack("/api/compare", GetComparison(entityMgr, docIndex, placeIndex, entitySearch, appConfig.QueryBudget(), userDb))))
+	appRouteHandler.HandleFunc("/api/entity/", authorizeAndTrack("/api/entity/{type}/{id}/timeline", GetEntityTimeline(entityMgr, docIndex)))
+	appRouteHandler.HandleFunc("/api/watchlists", authorizeAndTrack("/api/watchlists", GetOrPostWatchLists(userDb, entityMgr.ContentDAO, entitySearch)))
+	putOrDeleteWatchList := authorizeAndTrack("/api/watchlists/{id}", PutOrDeleteWatchList(userDb, entityMgr.ContentDAO, entitySearch))
+	getWatchListResults := authorizeAndTrack("/api/watchlists/{id}/results", GetWatchListResults(entityMgr, docIndex, placeIndex, entitySearch, resultCache, appConfig.QueryBudget(), userDb))
+	appRouteHandler.HandleFunc("/api/watchlists/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/results") {
+			getWatchListResults(w, r)
+		} else {
+			putOrDeleteWatchList(w, r)
+		}
+	})
+	appRouteHandler.HandleFunc("/api/watchlists/reorder", webapp.PostOnly(authorizeAndTrack("/api/watchlists/reorder", ReorderWatchLists(userDb))))
+	appRouteHandler.HandleFunc("/api/watchlists/pin", webapp.PostOnly(authorizeAndTrack("/api/watchlists/pin", PinWatchLists(userDb))))
+	appRouteHandler.HandleFunc("/api/watchlists/move", webapp.PostOnly(authorizeAndTrack("/api/watchlists/move", MoveWatchLists(userDb))))
+	appRouteHandler.HandleFunc("/api/search/", authorizeAndTrack("/api/search/{search_string}", FindEntities(entitySearch)))
+	appRouteHandler.HandleFunc("/api/hot_entities", authorizeAndTrack("/api/hot_entities", CalcHotEntities(memoizedHotEntityCalc)))
+	appRouteHandler.HandleFunc("/api/sources", authorizeAndTrack("/api/sources", GetSources(docIndex)))
+	appRouteHandler.HandleFunc("/api/query", authorizeAndTrack("/api/query", TranslateQuery()))
 
 	// WEb service endpoints (can only be called on localhost)
 	appRouteHandler.HandleFunc("/api/users", webapp.LocalOnly(webapp.PostOnly(AddNewUser(userDb))))
 	appRouteHandler.HandleFunc("/api/users/report", webapp.LocalOnly(CreateUsageReport(userDb)))
-	appRouteHandler.HandleFunc("/api/save_global_data", webapp.LocalOnly(SaveGlobalData(entityMgr, appConfig)))
-	appRouteHandler.HandleFunc("/api/save_user_data", webapp.LocalOnly(SaveUserData(userDb, appConfig)))
+	appRouteHandler.HandleFunc("/api/users/analytics", webapp.LocalOnly(GetUsageAnalytics(userDb)))
+	appRouteHandler.HandleFunc("/api/save_global_data", webapp.LocalOnly(SaveGlobalData(entityMgr, docIndex, placeIndex, appConfig, snapshotStore, keyring)))
+	appRouteHandler.HandleFunc("/api/save_user_data", webapp.LocalOnly(SaveUserData(userDb, appConfig, snapshotStore, keyring)))
 	appRouteHandler.HandleFunc("/api/memstats", webapp.LocalOnly(GetMemStats()))
 
 	// If deployment environment has an HTTPS reverse proxy, we need to redirect
@@ -88,6 +88,11 @@ func (me *MockContentSource) FetchNewsArticles(startTime unixtime.Time, endTime
 	return newsArticles
 }
 
+// Returns the places that the mock content mentions, with their coordinates.
+func MockPlaces() []server.Entity {
+	return fakePlaces
+}
+
 // Returns the next unique document Id in the sequence.
 func (me *MockContentSource) nextDocumentId() int {
 	return rnd.Intn(1000000000) + 1
@@ -131,6 +136,11 @@ func loadFakePlacesFromFile(csvFilePath string) []server.Entity {
 
 func makeFakeDocument(docId int, startTime unixtime.Time, endTime unixtime.Time) server.Document {
 	fakeNewsSources := []string{"The Onion", "NYTimes", "Wired.com", "SciCentral", "Reuters", "BBC News"}
+	// Fake headlines are made up of a random subject and predicate, so that
+	// there's something to search for.
+	fakeSubjects := []string{"Boeing", "Union workers", "Central bank", "Senate", "Tech giant", "Striking miners", "City council"}
+	fakePredicates := []string{"announces strike", "strikes deal with rivals", "raises interest rates", "faces labor dispute",
+		"unveils new aircraft", "cuts jobs amid slowdown", "wins court ruling"}
 
 	// Returns a UnixTime object that falls within the specified time endpoints (inclusive).
 	randomTimeBetween := func(startTime unixtime.Time, endTime unixtime.Time) unixtime.Time {
@@ -141,7 +151,7 @@ func makeFakeDocument(docId int, startTime unixtime.Time, endTime unixtime.Time)
 
 	return server.Document{
 		Id:         docId,
-		Headline:   fmt.Sprintf("Document %v", docId),
+		Headline:   fmt.Sprintf("%v %v (Document %v)", fakeSubjects[rnd.Intn(len(fakeSubjects))], fakePredicates[rnd.Intn(len(fakePredicates))], docId),
 		InsertDate: randomTimeBetween(startTime, endTime),
 		Source:     fakeNewsSources[rnd.Intn(len(fakeNewsSources))],
 		Url:        fmt.Sprintf("http://www.example.com/fake-document/%v", docId),
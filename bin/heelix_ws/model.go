@@ -2,7 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"qbase/synthos/synthos_core/unixtime"
+	"strings"
+	"time"
 )
 
 // An Synthos application user.
@@ -14,8 +17,32 @@ type User struct {
 	AccessToken   string `json:"-"` // Don't export this to JSON
 	LastLogin     unixtime.Time
 	TermsAccepted bool
+	// One of the Role* constants.  Empty means RoleUser.
+	Role string `json:",omitempty"`
 
 	WatchLists []WatchList
+
+	// How the user has been using the app (see UserDb.RecordRequest).
+	Activity *UserActivity `json:",omitempty"`
+}
+
+// User roles.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Returns the user's role, defaulting to RoleUser for users that were
+// created before roles existed.
+func (me *User) EffectiveRole() string {
+	if me.Role == "" {
+		return RoleUser
+	}
+	return me.Role
+}
+
+func isValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
 }
 
 // A WatchList is basically a named set of entities that can be used as a
@@ -26,6 +53,15 @@ type WatchList struct {
 	Title       string
 	Description string
 	Filter      FilterQuery
+
+	// Free-form labels that the user can group and filter watchlists by.
+	Tags []string
+	// Optional folder that the watchlist is filed under ("" means top level).
+	Folder string
+	// Pinned watchlists are listed ahead of all others.
+	Pinned bool
+	// Explicit sort position among the user's watchlists (ascending).
+	Position int
 }
 
 func (me *WatchList) IsSaved() bool {
@@ -37,9 +73,42 @@ func (me *WatchList) Validate() error {
 		return errors.New("Title was empty")
 	}
 
+	for _, tag := range me.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return errors.New("Tags may not be empty")
+		}
+	}
+
 	return nil
 }
 
+// Returns true if the watchlist has been labeled with the specified tag.
+func (me *WatchList) HasTag(tag string) bool {
+	for _, t := range me.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts watchlists in the order they should be displayed to the user: pinned
+// watchlists first, then by ascending Position, with ties broken by Id (i.e.
+// insertion order).
+type ByDisplayOrder []WatchList
+
+func (a ByDisplayOrder) Len() int      { return len(a) }
+func (a ByDisplayOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByDisplayOrder) Less(i, j int) bool {
+	if a[i].Pinned != a[j].Pinned {
+		return a[i].Pinned
+	}
+	if a[i].Position != a[j].Position {
+		return a[i].Position < a[j].Position
+	}
+	return a[i].Id < a[j].Id
+}
+
 // Represents an entity filter query in Disjunctive Normal Form (DNF).
 // In terms of LISP, this struct represents statements like this:
 //
@@ -54,6 +123,36 @@ type FilterQuery struct {
 	// from from the past 24 hours".
 	TimeRangeInHours int
 
+	// Restricts the content to an absolute time window, [StartTime, EndTime).
+	// Either end may be omitted, in which case the window extends to the
+	// oldest (or newest) content.  Can't be combined with TimeRangeInHours.
+	StartTime *time.Time `json:",omitempty"`
+	EndTime   *time.Time `json:",omitempty"`
+
+	// Restricts the content to documents whose headline matches these
+	// keywords, e.g. `strike "labor union" boe*` (see parseKeywordQuery).
+	Keywords string `json:",omitempty"`
+
+	// Restricts the content to documents from these news sources (e.g.
+	// "Reuters"), and/or excludes the documents from ExcludedSources.  Source
+	// names are matched case-insensitively.
+	Sources         []string `json:",omitempty"`
+	ExcludedSources []string `json:",omitempty"`
+
+	// Restricts the content to documents that mention at least one Place
+	// within the bounding box and/or the radius (see PlaceIndex).
+	GeoBoundingBox *GeoBoundingBox `json:",omitempty"`
+	GeoRadius      *GeoRadius      `json:",omitempty"`
+
+	// Overrides the number of top entities of each type (which is
+	// defaultTopN otherwise), within [1, maxTopN].
+	TopN int `json:",omitempty"`
+
+	// Overrides the width of the EntityTrend's buckets, as a whole number of
+	// minutes within [minTrendBucket, maxTrendBucket], e.g. "1m" or "1h".
+	// Each bucket's value is then the number of entity mentions within it.
+	TrendBucket string `json:",omitempty"`
+
 	// Entity
 	Or []ConjunctiveExpr
 }
@@ -62,14 +161,118 @@ func (me *FilterQuery) IsTimeRangeSpecified() bool {
 	return me.TimeRangeInHours > 0
 }
 
+func (me *FilterQuery) IsTimeWindowSpecified() bool {
+	return me.StartTime != nil || me.EndTime != nil
+}
+
+func (me *FilterQuery) IsKeywordFilterSpecified() bool {
+	return strings.TrimSpace(me.Keywords) != ""
+}
+
+func (me *FilterQuery) IsSourceFilterSpecified() bool {
+	return len(me.Sources) > 0 || len(me.ExcludedSources) > 0
+}
+
+func (me *FilterQuery) IsGeoFilterSpecified() bool {
+	return me.GeoBoundingBox != nil || me.GeoRadius != nil
+}
+
+// Returns true if the query filters documents by anything other than the
+// entity DNF and time range (see DocumentIndex and PlaceIndex).
+func (me *FilterQuery) IsDocumentFilterSpecified() bool {
+	return me.IsKeywordFilterSpecified() || me.IsSourceFilterSpecified() || me.IsGeoFilterSpecified()
+}
+
 func (me *FilterQuery) IsEntityFilterSpecified() bool {
 	return len(me.Or) > 0
 }
 
+// Returns true if the query asks for a different number of top entities than
+// the ContentBuffer's stats include.
+func (me *FilterQuery) IsTopNSpecified() bool {
+	return me.TopN != 0 && me.TopN != defaultTopN
+}
+
+func (me *FilterQuery) IsTrendBucketSpecified() bool {
+	return strings.TrimSpace(me.TrendBucket) != ""
+}
+
+// Checks that TopN and TrendBucket are within their bounds.
+func (me *FilterQuery) ValidateStatsParams() error {
+	if me.TopN != 0 && (me.TopN < 1 || me.TopN > maxTopN) {
+		return errors.New(fmt.Sprintf("TopN must be within [1, %v]", maxTopN))
+	}
+	if me.IsTrendBucketSpecified() {
+		if _, err := me.TrendBucketDuration(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses the TrendBucket.
+func (me *FilterQuery) TrendBucketDuration() (time.Duration, error) {
+	bucket, err := time.ParseDuration(strings.TrimSpace(me.TrendBucket))
+	if err != nil || bucket < minTrendBucket || bucket > maxTrendBucket || bucket%time.Minute != 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid TrendBucket '%v': must be a whole number of minutes within [%v, %v], e.g. 1m or 1h",
+			me.TrendBucket, minTrendBucket, maxTrendBucket))
+	}
+	return bucket, nil
+}
+
+// A geographic area bounded by latitudes and longitudes (in degrees).  If
+// MinLng is greater than MaxLng, the box crosses the antimeridian.
+type GeoBoundingBox struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+func (me *GeoBoundingBox) Validate() error {
+	if err := validateGeoCoord(me.MinLat, me.MinLng); err != nil {
+		return err
+	}
+	if err := validateGeoCoord(me.MaxLat, me.MaxLng); err != nil {
+		return err
+	}
+	if me.MinLat > me.MaxLat {
+		return errors.New("GeoBoundingBox MinLat must not be greater than MaxLat")
+	}
+	return nil
+}
+
+// A circular geographic area around a center point (in degrees).
+type GeoRadius struct {
+	Lat      float64
+	Lng      float64
+	RadiusKm float64
+}
+
+func (me *GeoRadius) Validate() error {
+	if err := validateGeoCoord(me.Lat, me.Lng); err != nil {
+		return err
+	}
+	if me.RadiusKm <= 0 {
+		return errors.New("GeoRadius RadiusKm must be positive")
+	}
+	return nil
+}
+
+func validateGeoCoord(lat float64, lng float64) error {
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return errors.New(fmt.Sprintf("Invalid coordinates (%v, %v): latitude must be within [-90, 90], and longitude within [-180, 180]", lat, lng))
+	}
+	return nil
+}
+
 // Represents a conjunctive expression of the form (and entity1 entity2 ...).
-// The 'and' operator is implied by the name of this type.
+// The 'and' operator is implied by the name of this type.  Entities in Not are
+// negated, i.e. content that mentions any of them is excluded:
+// (and entity1 ... (not entity3 entity4 ...)).
 type ConjunctiveExpr struct {
 	And []FilterItem
+	Not []FilterItem `json:",omitempty"`
 }
 
 // In atomic term representing a specific entity of a given type.
@@ -79,6 +282,15 @@ type FilterItem struct {
 	Id string
 	// The entity's display label
 	Label string
+	// The entity's type (e.g. "Org"), for items that are given by their Type
+	// and Label instead of by their Id (see resolveFilterItems).
+	Type string `json:",omitempty"`
+}
+
+// Returns true if the FilterItem is given by its Type and Label, rather than
+// by its Id.
+func (me *FilterItem) IsUnresolved() bool {
+	return me.Id == "" && me.Type != ""
 }
 
 // Represents the time series data points for an entity type in the JSON format
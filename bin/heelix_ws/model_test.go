@@ -3,6 +3,7 @@ package main
 import (
 	//	"fmt"
 	"github.com/stretchr/testify/assert"
+	"sort"
 	"testing"
 )
 
@@ -19,3 +20,45 @@ func TestWatchList_Validate(t *testing.T) {
 	w.Title = "Some Title"
 	assert.Nil(t, w.Validate()) // Title specified now, so ok.
 }
+
+func TestWatchList_ValidateTags(t *testing.T) {
+	w := WatchList{Title: "Some Title", Tags: []string{"sports", " "}}
+	assert.NotNil(t, w.Validate()) // blank tag
+	w.Tags = []string{"sports", "tennis"}
+	assert.Nil(t, w.Validate())
+}
+
+func TestWatchList_HasTag(t *testing.T) {
+	w := WatchList{Tags: []string{"sports", "tennis"}}
+	assert.True(t, w.HasTag("tennis"))
+	assert.False(t, w.HasTag("golf"))
+}
+
+func TestByDisplayOrder(t *testing.T) {
+	watchLists := []WatchList{
+		WatchList{Id: 1, Position: 2},
+		WatchList{Id: 2, Position: 1},
+		WatchList{Id: 3, Position: 3, Pinned: true},
+		WatchList{Id: 4, Position: 1},
+	}
+	sort.Sort(ByDisplayOrder(watchLists))
+
+	ids := []int{}
+	for _, w := range watchLists {
+		ids = append(ids, w.Id)
+	}
+	assert.Equal(t, []int{3, 2, 4, 1}, ids)
+}
+
+func TestFilterQuery_ValidateStatsParams(t *testing.T) {
+	assert.Nil(t, (&FilterQuery{}).ValidateStatsParams())
+	assert.Nil(t, (&FilterQuery{TopN: 100, TrendBucket: "1h"}).ValidateStatsParams())
+	assert.False(t, (&FilterQuery{TopN: defaultTopN}).IsTopNSpecified())
+
+	// error cases
+	assert.NotNil(t, (&FilterQuery{TopN: 101}).ValidateStatsParams())
+	assert.NotNil(t, (&FilterQuery{TopN: -1}).ValidateStatsParams())
+	assert.NotNil(t, (&FilterQuery{TrendBucket: "hourly"}).ValidateStatsParams())
+	assert.NotNil(t, (&FilterQuery{TrendBucket: "90s"}).ValidateStatsParams())
+	assert.NotNil(t, (&FilterQuery{TrendBucket: "48h"}).ValidateStatsParams())
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+	"strconv"
+)
+
+// Default and maximum number of documents in a page of news.
+const defaultNewsPageLimit = 20
+const maxNewsPageLimit = 200
+
+// The orders in which a page of news can be sorted.
+type NewsSortOrder string
+
+const (
+	NewestFirst       NewsSortOrder = "newest"
+	OldestFirst       NewsSortOrder = "oldest"
+	MostEntitiesFirst NewsSortOrder = "most_entities"
+)
+
+// Requests a page of the documents that match a query.  Cursor is empty for
+// the first page, and is otherwise the NextCursor of the previous page.
+type NewsPageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   NewsSortOrder
+}
+
+// A page of the documents that match a query.  NextCursor is empty if this is
+// the last page.
+type NewsPage struct {
+	Docs         []server.Document
+	TotalMatches int
+	NextCursor   string
+}
+
+// Identifies the last document of a page.  The next page starts with the
+// document that sorts after it, so that pages stay consistent as new content
+// arrives (or old content is dropped) in between requests.
+type newsCursor struct {
+	Sort        NewsSortOrder
+	EntityCount int `json:",omitempty"`
+	InsertDate  int32
+	Id          int
+}
+
+// Returns true if the params request a page of news (see
+// parseNewsPageRequest), rather than the default LatestNews.
+func isNewsPageRequested(params url.Values) bool {
+	return params.Get("limit") != "" || params.Get("cursor") != "" || params.Get("sort") != ""
+}
+
+// Parses the limit, cursor and sort params into a NewsPageRequest.  The sort
+// order defaults to NewestFirst, and has to match the cursor's (if any).
+func parseNewsPageRequest(params url.Values) (NewsPageRequest, error) {
+	pageRequest := NewsPageRequest{Limit: defaultNewsPageLimit, Cursor: params.Get("cursor"), Sort: NewestFirst}
+
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxNewsPageLimit {
+			return pageRequest, errors.New(fmt.Sprintf("Invalid limit '%v': must be between 1 and %v", limitStr, maxNewsPageLimit))
+		}
+		pageRequest.Limit = limit
+	}
+
+	if sortStr := params.Get("sort"); sortStr != "" {
+		switch NewsSortOrder(sortStr) {
+		case NewestFirst, OldestFirst, MostEntitiesFirst:
+			pageRequest.Sort = NewsSortOrder(sortStr)
+		default:
+			return pageRequest, errors.New(fmt.Sprintf("Invalid sort '%v': must be one of %v, %v or %v", sortStr, NewestFirst, OldestFirst, MostEntitiesFirst))
+		}
+	}
+
+	if pageRequest.Cursor != "" {
+		cursor, err := decodeNewsCursor(pageRequest.Cursor)
+		if err != nil {
+			return pageRequest, err
+		}
+		if params.Get("sort") == "" {
+			pageRequest.Sort = cursor.Sort
+		} else if cursor.Sort != pageRequest.Sort {
+			return pageRequest, errors.New(fmt.Sprintf("The cursor is for sort '%v', not '%v'", cursor.Sort, pageRequest.Sort))
+		}
+	}
+
+	return pageRequest, nil
+}
+
+func encodeNewsCursor(cursor newsCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeNewsCursor(s string) (newsCursor, error) {
+	var cursor newsCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &cursor)
+	}
+	if err != nil || cursor.Sort == "" {
+		return cursor, errors.New(fmt.Sprintf("Invalid cursor '%v'", s))
+	}
+	return cursor, nil
+}
+
+// Returns the requested page of the documents in g.  Only the documents that
+// mention an entity, and that are in the index, can be paged through (the
+// ContentBuffer doesn't expose its other documents), and TotalMatches counts
+// these documents (see CountPageableDocuments).
+func (me *DocumentIndex) PageDocuments(g *server.ContentBuffer, pageRequest NewsPageRequest) (NewsPage, error) {
+	var after *newsCursor
+	if pageRequest.Cursor != "" {
+		cursor, err := decodeNewsCursor(pageRequest.Cursor)
+		if err != nil {
+			return NewsPage{}, err
+		}
+		after = &cursor
+	}
+
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	matches := []newsCursor{}
+	documentIds(g).ForEach(func(docId int) {
+		doc, exists := me.docs[docId]
+		if !exists {
+			return
+		}
+		match := newsCursor{Sort: pageRequest.Sort, InsertDate: doc.InsertDate, Id: docId}
+		if pageRequest.Sort == MostEntitiesFirst {
+			match.EntityCount = entityTypes.MentionCount(g, docId)
+		}
+		matches = append(matches, match)
+	})
+	sort.Sort(byNewsSortOrder(matches))
+
+	page := NewsPage{Docs: []server.Document{}, TotalMatches: len(matches)}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool { return newsCursorLess(*after, matches[i]) })
+	}
+	end := start + pageRequest.Limit
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	for _, match := range matches[start:end] {
+		page.Docs = append(page.Docs, me.docs[match.Id].document(match.Id))
+	}
+	if end < len(matches) {
+		page.NextCursor = encodeNewsCursor(matches[end-1])
+	}
+	return page, nil
+}
+
+// Returns the number of documents in g that can be paged through (see
+// PageDocuments).
+func (me *DocumentIndex) CountPageableDocuments(g *server.ContentBuffer) int {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	count := 0
+	documentIds(g).ForEach(func(docId int) {
+		if _, exists := me.docs[docId]; exists {
+			count++
+		}
+	})
+	return count
+}
+
+// Returns true if document a sorts before document b.  Ties are broken by
+// document id, so that the order is total and cursors are unambiguous.
+func newsCursorLess(a newsCursor, b newsCursor) bool {
+	if a.Sort == MostEntitiesFirst && a.EntityCount != b.EntityCount {
+		return a.EntityCount > b.EntityCount
+	}
+	if a.Sort == OldestFirst {
+		if a.InsertDate != b.InsertDate {
+			return a.InsertDate < b.InsertDate
+		}
+		return a.Id < b.Id
+	}
+	if a.InsertDate != b.InsertDate {
+		return a.InsertDate > b.InsertDate
+	}
+	return a.Id > b.Id
+}
+
+// Sorts documents by their (shared) sort order.
+type byNewsSortOrder []newsCursor
+
+func (a byNewsSortOrder) Len() int           { return len(a) }
+func (a byNewsSortOrder) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNewsSortOrder) Less(i, j int) bool { return newsCursorLess(a[i], a[j]) }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+	"time"
+)
+
+func TestParseNewsPageRequest(t *testing.T) {
+	assert.False(t, isNewsPageRequested(url.Values{}))
+
+	pageRequest, err := parseNewsPageRequest(url.Values{"limit": {"5"}})
+	assert.Nil(t, err)
+	assert.Equal(t, NewsPageRequest{Limit: 5, Sort: NewestFirst}, pageRequest)
+
+	// The sort order defaults to the cursor's.
+	cursor := encodeNewsCursor(newsCursor{Sort: OldestFirst, InsertDate: 1000, Id: 1})
+	pageRequest, err = parseNewsPageRequest(url.Values{"cursor": {cursor}})
+	assert.Nil(t, err)
+	assert.Equal(t, NewsPageRequest{Limit: defaultNewsPageLimit, Cursor: cursor, Sort: OldestFirst}, pageRequest)
+
+	// error cases
+	for _, params := range []url.Values{
+		url.Values{"limit": {"0"}},
+		url.Values{"limit": {"1000"}},
+		url.Values{"limit": {"ten"}},
+		url.Values{"sort": {"relevance"}},
+		url.Values{"cursor": {"not-a-cursor"}},
+		url.Values{"cursor": {cursor}, "sort": {"newest"}},
+	} {
+		_, err = parseNewsPageRequest(params)
+		assert.NotNil(t, err, params.Encode())
+	}
+}
+
+func TestDocumentIndex_PageDocuments(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := newDocumentIndexForTest(g)
+
+	// Newest first, in pages of 3.
+	page, err := docIndex.PageDocuments(g, NewsPageRequest{Limit: 3, Sort: NewestFirst})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 3, 2}, pageDocIds(page))
+	assert.Equal(t, 4, page.TotalMatches)
+	assert.Equal(t, "Document 4", page.Docs[0].Headline)
+	page, err = docIndex.PageDocuments(g, NewsPageRequest{Limit: 3, Cursor: page.NextCursor, Sort: NewestFirst})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, pageDocIds(page))
+	assert.Equal(t, "", page.NextCursor)
+
+	page, _ = docIndex.PageDocuments(g, NewsPageRequest{Limit: 3, Sort: OldestFirst})
+	assert.Equal(t, []int{1, 2, 3}, pageDocIds(page))
+
+	// Doc 2 mentions 2 orgs, and the rest are sorted newest first.
+	page, _ = docIndex.PageDocuments(g, NewsPageRequest{Limit: 10, Sort: MostEntitiesFirst})
+	assert.Equal(t, []int{2, 4, 3, 1}, pageDocIds(page))
+
+	// Content that arrives in between requests doesn't shift the next page.
+	page, _ = docIndex.PageDocuments(g, NewsPageRequest{Limit: 2, Sort: NewestFirst})
+	assert.Equal(t, []int{4, 3}, pageDocIds(page))
+	newDoc := server.Document{Id: 5, InsertDate: unixtime.Unix(int32(testContentStartTime.Add(5 * time.Hour).Unix()))}
+	g.AddNewsArticle(server.NewsArticle{Document: newDoc, Orgs: []server.Entity{server.DisplayEntity{Id: 1}}})
+	docIndex.AddDocuments([]server.Document{newDoc})
+	page, _ = docIndex.PageDocuments(g, NewsPageRequest{Limit: 2, Cursor: page.NextCursor, Sort: NewestFirst})
+	assert.Equal(t, []int{2, 1}, pageDocIds(page))
+	assert.Equal(t, 5, page.TotalMatches)
+
+	// Documents that don't mention any entity, or that aren't indexed, can't
+	// be paged through, so they don't count towards TotalMatches either.
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 6, InsertDate: newDoc.InsertDate}})
+	docIndex.AddDocuments([]server.Document{server.Document{Id: 6, InsertDate: newDoc.InsertDate}})
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 7}, Orgs: []server.Entity{server.DisplayEntity{Id: 1}}})
+	page, _ = docIndex.PageDocuments(g, NewsPageRequest{Limit: 10, Sort: NewestFirst})
+	assert.Equal(t, []int{5, 4, 3, 2, 1}, pageDocIds(page))
+	assert.Equal(t, 5, page.TotalMatches)
+	assert.Equal(t, 5, docIndex.CountPageableDocuments(g))
+}
+
+//
+// TEST HELPERS
+//
+
+// Returns a DocumentIndex of the documents in the content buffer, with
+// headlines of the form "Document <id>".
+func newDocumentIndexForTest(g *server.ContentBuffer) *DocumentIndex {
+	docIndex := NewDocumentIndex()
+	documentIds(g).ForEach(func(docId int) {
+		insertDate := unixtime.Unix(int32(testContentStartTime.Add(time.Duration(docId) * time.Hour).Unix()))
+		docIndex.AddDocuments([]server.Document{server.Document{Id: docId, InsertDate: insertDate, Headline: fmt.Sprintf("Document %v", docId)}})
+	})
+	return docIndex
+}
+
+func pageDocIds(page NewsPage) []int {
+	docIds := []int{}
+	for _, doc := range page.Docs {
+		docIds = append(docIds, doc.Id)
+	}
+	return docIds
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	server "qbase/synthos/synthos_svr"
+	"sync"
+)
+
+// Name of the file that the place index is saved to, alongside the rest of
+// the global data (see SaveGlobalData).
+const placeIndexFileName = "place_index.json"
+
+// Mean radius of the earth, used for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// Width and height (in degrees) of the cells of the place index's grid.
+const placeIndexCellSize = 1.0
+
+// A spatial index over the coordinates of the Place entities, so that
+// queries can find the places within a geographic area.  The coordinates are
+// collected from the places mentioned by fetched documents (see
+// IndexingContentSource) and seeded at startup (see seedPlaceIndex), and
+// bucketed into a grid of
+// placeIndexCellSize-degree cells.
+type PlaceIndex struct {
+	lock   sync.RWMutex
+	places map[int]server.GeoCoord
+	cells  map[geoCell]*server.IntSet
+}
+
+// A cell of the place index's grid, identified by the (rounded down)
+// latitude and longitude of its south-west corner.
+type geoCell struct {
+	lat int
+	lng int
+}
+
+func geoCellFor(lat float64, lng float64) geoCell {
+	return geoCell{int(math.Floor(lat / placeIndexCellSize)), int(math.Floor(lng / placeIndexCellSize))}
+}
+
+// Implemented by entity DAOs that hold the coordinates of their places, which
+// the place index can be seeded from.  The places are returned as
+// server.Place entities (see AddPlaces).
+type placeLister interface {
+	Places() []server.Entity
+}
+
+// Creates an empty PlaceIndex.
+func NewPlaceIndex() *PlaceIndex {
+	return &PlaceIndex{
+		places: map[int]server.GeoCoord{},
+		cells:  map[geoCell]*server.IntSet{},
+	}
+}
+
+// Adds the coordinates of the places to the index.  Entities that don't carry
+// coordinates (i.e. that aren't a server.Place) are ignored.
+func (me *PlaceIndex) AddPlaces(entities []server.Entity) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for _, entity := range entities {
+		switch place := entity.(type) {
+		case server.Place:
+			me.add(place.Id, place.Location)
+		case *server.Place:
+			me.add(place.Id, place.Location)
+		}
+	}
+}
+
+func (me *PlaceIndex) add(placeId int, location server.GeoCoord) {
+	if oldLocation, exists := me.places[placeId]; exists {
+		if oldLocation == location {
+			return
+		}
+		me.cells[geoCellFor(float64(oldLocation.Lat), float64(oldLocation.Lng))].Remove(placeId)
+	}
+
+	me.places[placeId] = location
+	cell := geoCellFor(float64(location.Lat), float64(location.Lng))
+	placeIds, exists := me.cells[cell]
+	if !exists {
+		placeIds = server.NewIntSet()
+		me.cells[cell] = placeIds
+	}
+	placeIds.Put(placeId)
+}
+
+// Returns the number of places with known coordinates.
+func (me *PlaceIndex) PlaceCount() int {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	return len(me.places)
+}
+
+// Returns the ids of the places within the bounding box.
+func (me *PlaceIndex) FindPlacesInBoundingBox(box GeoBoundingBox) *server.IntSet {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	return me.findPlaces(box, func(lat float64, lng float64) bool { return true })
+}
+
+// Returns the ids of the places within the radius.
+func (me *PlaceIndex) FindPlacesInRadius(radius GeoRadius) *server.IntSet {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	return me.findPlaces(boundingBoxForRadius(radius), func(lat float64, lng float64) bool {
+		return greatCircleDistanceKm(radius.Lat, radius.Lng, lat, lng) <= radius.RadiusKm
+	})
+}
+
+// Returns the ids of the places within the box for which isMatch() returns
+// true.  Must be called with the lock held.
+func (me *PlaceIndex) findPlaces(box GeoBoundingBox, isMatch func(lat float64, lng float64) bool) *server.IntSet {
+	placeIds := server.NewIntSet()
+	searchCells := func(minLng float64, maxLng float64) {
+		minCell, maxCell := geoCellFor(box.MinLat, minLng), geoCellFor(box.MaxLat, maxLng)
+		for cellLat := minCell.lat; cellLat <= maxCell.lat; cellLat++ {
+			for cellLng := minCell.lng; cellLng <= maxCell.lng; cellLng++ {
+				candidates, exists := me.cells[geoCell{cellLat, cellLng}]
+				if !exists {
+					continue
+				}
+				candidates.ForEach(func(placeId int) {
+					location := me.places[placeId]
+					lat, lng := float64(location.Lat), float64(location.Lng)
+					if lat >= box.MinLat && lat <= box.MaxLat && lng >= minLng && lng <= maxLng && isMatch(lat, lng) {
+						placeIds.Put(placeId)
+					}
+				})
+			}
+		}
+	}
+
+	if box.MinLng <= box.MaxLng {
+		searchCells(box.MinLng, box.MaxLng)
+	} else {
+		// The box crosses the antimeridian, so search either side of it.
+		searchCells(box.MinLng, 180)
+		searchCells(-180, box.MaxLng)
+	}
+	return placeIds
+}
+
+// Returns a copy of g with only the documents that mention a place within
+// the bounding box and/or the radius (whichever are non-nil).  The documents
+// are copied through the document index, so ones that aren't indexed are
+// left out (see DocumentIndex.KeepDocuments).
+func (me *PlaceIndex) FilterOnArea(g *server.ContentBuffer, docIndex *DocumentIndex, box *GeoBoundingBox, radius *GeoRadius) *server.ContentBuffer {
+	mentionsPlaceIn := func(placeIds *server.IntSet) *server.IntSet {
+		docIds := server.NewIntSet()
+		placeIds.ForEach(func(placeId int) {
+			docIds.PutAll(g.PlaceGraph.DocumentIdsForEntity(placeId))
+		})
+		return docIds
+	}
+
+	var docIds *server.IntSet
+	if box != nil {
+		docIds = mentionsPlaceIn(me.FindPlacesInBoundingBox(*box))
+	}
+	if radius != nil {
+		radiusDocIds := mentionsPlaceIn(me.FindPlacesInRadius(*radius))
+		if docIds == nil {
+			docIds = radiusDocIds
+		} else {
+			boxDocIds := docIds
+			docIds = server.NewIntSet()
+			boxDocIds.ForEach(func(docId int) {
+				if radiusDocIds.Contains(docId) {
+					docIds.Put(docId)
+				}
+			})
+		}
+	}
+	if docIds == nil {
+		docIds = server.NewIntSet()
+	}
+	return docIndex.KeepDocuments(g, docIds)
+}
+
+// Saves the index to the specified file, encrypting it if the keyring is
+// enabled.
+func (me *PlaceIndex) Save(filePath string, keyring *Keyring) error {
+	me.lock.RLock()
+	b, err := json.Marshal(me.places)
+	me.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return keyring.WriteFile(filePath, b)
+}
+
+// Adds the places saved in the specified file (see Save()) to the index.
+func (me *PlaceIndex) Load(filePath string, keyring *Keyring) error {
+	b, err := keyring.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	places := map[int]server.GeoCoord{}
+	if err := json.Unmarshal(b, &places); err != nil {
+		return errors.New(fmt.Sprintf("Error decoding %v: %v", filePath, err))
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	for placeId, location := range places {
+		if _, exists := me.places[placeId]; !exists {
+			me.add(placeId, location)
+		}
+	}
+	return nil
+}
+
+// Returns the smallest bounding box that contains the radius.  Near the
+// poles, the box spans all longitudes.
+func boundingBoxForRadius(radius GeoRadius) GeoBoundingBox {
+	angularRadius := radius.RadiusKm / earthRadiusKm
+	latDelta := toDegrees(angularRadius)
+	box := GeoBoundingBox{MinLat: radius.Lat - latDelta, MaxLat: radius.Lat + latDelta, MinLng: -180, MaxLng: 180}
+	if box.MinLat <= -90 || box.MaxLat >= 90 {
+		box.MinLat, box.MaxLat = math.Max(box.MinLat, -90), math.Min(box.MaxLat, 90)
+		return box
+	}
+
+	lngDeltaSin := math.Sin(angularRadius) / math.Cos(toRadians(radius.Lat))
+	if lngDeltaSin >= 1 {
+		return box
+	}
+	lngDelta := toDegrees(math.Asin(lngDeltaSin))
+	box.MinLng, box.MaxLng = radius.Lng-lngDelta, radius.Lng+lngDelta
+	if box.MinLng < -180 {
+		box.MinLng += 360
+	}
+	if box.MaxLng > 180 {
+		box.MaxLng -= 360
+	}
+	return box
+}
+
+// Returns the great-circle (haversine) distance between two points.
+func greatCircleDistanceKm(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func toDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+	"testing"
+)
+
+func TestPlaceIndex_FindPlacesInBoundingBox(t *testing.T) {
+	placeIndex := newPlaceIndexForTest()
+
+	placeIds := placeIndex.FindPlacesInBoundingBox(GeoBoundingBox{MinLat: 47, MinLng: -123, MaxLat: 48, MaxLng: -122})
+	assert.Equal(t, []int{seattle, tacoma}, sortedItems(placeIds))
+
+	// A box that crosses the antimeridian.
+	placeIds = placeIndex.FindPlacesInBoundingBox(GeoBoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170})
+	assert.Equal(t, []int{suva, apia}, sortedItems(placeIds))
+
+	placeIds = placeIndex.FindPlacesInBoundingBox(GeoBoundingBox{MinLat: 0, MinLng: 0, MaxLat: 10, MaxLng: 10})
+	assert.Equal(t, 0, placeIds.Size())
+}
+
+func TestPlaceIndex_FindPlacesInRadius(t *testing.T) {
+	placeIndex := newPlaceIndexForTest()
+
+	// Tacoma is ~40km from Seattle, and Portland ~235km.
+	assert.Equal(t, []int{seattle, tacoma}, sortedItems(placeIndex.FindPlacesInRadius(GeoRadius{Lat: 47.6062, Lng: -122.3321, RadiusKm: 50})))
+	assert.Equal(t, []int{seattle, tacoma, portland}, sortedItems(placeIndex.FindPlacesInRadius(GeoRadius{Lat: 47.6062, Lng: -122.3321, RadiusKm: 300})))
+
+	// Suva and Apia are on either side of the antimeridian, ~1150km apart.
+	assert.Equal(t, []int{suva, apia}, sortedItems(placeIndex.FindPlacesInRadius(GeoRadius{Lat: -18.1416, Lng: 178.4419, RadiusKm: 1200})))
+
+	// Near the poles, all longitudes are searched.
+	assert.Equal(t, 5, placeIndex.FindPlacesInRadius(GeoRadius{Lat: 90, Lng: 0, RadiusKm: 20000}).Size())
+}
+
+func TestPlaceIndex_FilterOnArea(t *testing.T) {
+	placeIndex := newPlaceIndexForTest()
+	g := server.NewContentBuffer()
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 1}, Places: []server.Entity{server.DisplayEntity{Id: seattle}}})
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 2}, Places: []server.Entity{server.DisplayEntity{Id: portland}, server.DisplayEntity{Id: suva}}})
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 3}, Persons: []server.Entity{server.DisplayEntity{Id: 1}}})
+	// Doc 4 doesn't mention any entity, so it can't mention a place.
+	g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 4}})
+	docIndex := NewDocumentIndex()
+	for docId := 1; docId <= 4; docId++ {
+		docIndex.AddDocuments([]server.Document{server.Document{Id: docId}})
+	}
+
+	result := placeIndex.FilterOnArea(g, docIndex, nil, &GeoRadius{Lat: 47.6062, Lng: -122.3321, RadiusKm: 300})
+	assert.Equal(t, 2, result.DocumentCount())
+
+	// Both areas must be matched.
+	result = placeIndex.FilterOnArea(g, docIndex, &GeoBoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}, &GeoRadius{Lat: 47.6062, Lng: -122.3321, RadiusKm: 300})
+	assert.Equal(t, 1, result.DocumentCount())
+	assert.Equal(t, 1, result.PlaceGraph.DocumentIdsForEntity(suva).Size())
+	assert.Equal(t, 4, g.DocumentCount())
+}
+
+func TestPlaceIndex_saveAndLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "heelix_place_index")
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, placeIndexFileName)
+
+	assert.Nil(t, newPlaceIndexForTest().Save(filePath, NewKeyring()))
+	loadedIndex := NewPlaceIndex()
+	assert.Nil(t, loadedIndex.Load(filePath, NewKeyring()))
+	assert.Equal(t, 5, loadedIndex.PlaceCount())
+	assert.Equal(t, []int{seattle, tacoma}, sortedItems(loadedIndex.FindPlacesInRadius(GeoRadius{Lat: 47.6062, Lng: -122.3321, RadiusKm: 50})))
+}
+
+func TestGeoFilterValidation(t *testing.T) {
+	assert.Nil(t, (&GeoBoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}).Validate())
+	assert.NotNil(t, (&GeoBoundingBox{MinLat: 10, MinLng: 0, MaxLat: -10, MaxLng: 10}).Validate())
+	assert.NotNil(t, (&GeoBoundingBox{MinLat: 0, MinLng: 0, MaxLat: 91, MaxLng: 10}).Validate())
+	assert.Nil(t, (&GeoRadius{Lat: 47.6, Lng: -122.3, RadiusKm: 10}).Validate())
+	assert.NotNil(t, (&GeoRadius{Lat: 47.6, Lng: -122.3}).Validate())
+	assert.NotNil(t, (&GeoRadius{Lat: 47.6, Lng: -190, RadiusKm: 10}).Validate())
+}
+
+func TestSeedPlaceIndex(t *testing.T) {
+	// The content DAO's places are used if it holds their coordinates.
+	contentDAO := server.NewContentDAO()
+	placeIndex := NewPlaceIndex()
+	seedPlaceIndex(placeIndex, contentDAO, false)
+	assert.Equal(t, 0, placeIndex.PlaceCount())
+
+	contentDAO.PlaceDAO = &placeListerDAOForTest{places: []server.Entity{
+		server.Place{Id: seattle, Name: "Seattle", Location: server.GeoCoord{Lat: 47.6062, Lng: -122.3321}},
+	}}
+	seedPlaceIndex(placeIndex, contentDAO, false)
+	assert.Equal(t, []int{seattle}, sortedItems(placeIndex.FindPlacesInRadius(GeoRadius{Lat: 47.6, Lng: -122.3, RadiusKm: 10})))
+
+	// The mock places are used with mock data.
+	placeIndex = NewPlaceIndex()
+	seedPlaceIndex(placeIndex, server.NewContentDAO(), true)
+	assert.True(t, placeIndex.PlaceCount() > 0)
+}
+
+//
+// TEST HELPERS
+//
+
+const (
+	seattle = iota + 1
+	tacoma
+	portland
+	suva
+	apia
+)
+
+func newPlaceIndexForTest() *PlaceIndex {
+	placeIndex := NewPlaceIndex()
+	placeIndex.AddPlaces([]server.Entity{
+		server.Place{Id: seattle, Name: "Seattle", Location: server.GeoCoord{Lat: 47.6062, Lng: -122.3321}},
+		server.Place{Id: tacoma, Name: "Tacoma", Location: server.GeoCoord{Lat: 47.2529, Lng: -122.4443}},
+		server.Place{Id: portland, Name: "Portland", Location: server.GeoCoord{Lat: 45.5152, Lng: -122.6784}},
+		&server.Place{Id: suva, Name: "Suva", Location: server.GeoCoord{Lat: -18.1416, Lng: 178.4419}},
+		server.Place{Id: apia, Name: "Apia", Location: server.GeoCoord{Lat: -13.8333, Lng: -171.7667}},
+		// No coordinates, so ignored.
+		server.DisplayEntity{Id: 99, Name: "Atlantis"},
+	})
+	return placeIndex
+}
+
+func sortedItems(s *server.IntSet) []int {
+	items := s.Items()
+	sort.Ints(items)
+	return items
+}
+
+// A place DAO that holds its places' coordinates.
+type placeListerDAOForTest struct {
+	FakeEntityDAO
+	places []server.Entity
+}
+
+func (dao *placeListerDAOForTest) Places() []server.Entity {
+	return dao.places
+}
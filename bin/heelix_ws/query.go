@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Limits on the cost of running a filter query.  Conjuncts is the total
+// number of (possibly negated) entities across all of the disjuncts.
+type QueryBudget struct {
+	MaxDisjuncts int
+	MaxConjuncts int
+	// The query is abandoned if it runs for longer than this (if non-zero).
+	Timeout time.Duration
+}
+
+// Describes why a filter query is over its budget.
+type QueryBudgetError struct {
+	Reason       string `json:"Error"`
+	Disjuncts    int
+	Conjuncts    int
+	MaxDisjuncts int
+	MaxConjuncts int
+}
+
+func (me *QueryBudgetError) Error() string {
+	return me.Reason
+}
+
+// Returns a QueryBudgetError if the filter query has more disjuncts or
+// conjuncts than the budget allows.
+func (me QueryBudget) Check(filterQuery FilterQuery) error {
+	conjuncts := 0
+	for _, expr := range filterQuery.Or {
+		conjuncts += len(expr.And) + len(expr.Not)
+	}
+
+	budgetErr := &QueryBudgetError{
+		Disjuncts:    len(filterQuery.Or),
+		Conjuncts:    conjuncts,
+		MaxDisjuncts: me.MaxDisjuncts,
+		MaxConjuncts: me.MaxConjuncts,
+	}
+	if budgetErr.Disjuncts > me.MaxDisjuncts {
+		budgetErr.Reason = fmt.Sprintf("The query has %v disjuncts, but at most %v are allowed", budgetErr.Disjuncts, me.MaxDisjuncts)
+		return budgetErr
+	}
+	if budgetErr.Conjuncts > me.MaxConjuncts {
+		budgetErr.Reason = fmt.Sprintf("The query has %v entities, but at most %v are allowed", budgetErr.Conjuncts, me.MaxConjuncts)
+		return budgetErr
+	}
+	return nil
+}
+
+// Returns a context for running a query within the budget's deadline (if
+// any), which is also cancelled along with the parent (e.g. when the client
+// disconnects).
+func (me QueryBudget) WithDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	if me.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, me.Timeout)
+}
+
+// Returns the maximum number of goroutines that each query uses to evaluate
+// its disjuncts (see calcDisjunctiveExpr).  It's read on each call, since
+// main sets GOMAXPROCS after the package is initialized.
+func maxDisjunctWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// Calculates the 'OR' of the conjunctive expressions, i.e. the content of g
+// that matches any of them.  Returns ctx.Err() if the context is done before
+// the calculation is.
+func calcDisjunctiveExpr(ctx context.Context, g *server.ContentBuffer, disjuncts []ConjunctiveExpr, explanation *QueryExplanation) (*server.ContentBuffer, error) {
+	return calcDisjunctiveExprConcurrently(ctx, g, disjuncts, maxDisjunctWorkers(), explanation)
+}
+
+// Same as calcDisjunctiveExpr(), but evaluates the disjuncts on at most the
+// specified number of goroutines, and then merges their results pairwise
+// (which also happens concurrently), rather than one after another.  The
+// steps are recorded in the explanation, if it's non-nil.
+func calcDisjunctiveExprConcurrently(ctx context.Context, g *server.ContentBuffer, disjuncts []ConjunctiveExpr, workers int, explanation *QueryExplanation) (*server.ContentBuffer, error) {
+	// Each disjunct is itself a conjunct expression of the form (and arg1 arg2 ...)
+	results := make([]*server.ContentBuffer, len(disjuncts))
+	traces := make([]*DisjunctExplanation, len(disjuncts))
+	for i := range disjuncts {
+		traces[i] = explanation.disjunct(i, len(disjuncts))
+	}
+	err := forEachConcurrently(ctx, len(disjuncts), workers, func(ctx context.Context, i int) error {
+		start := time.Now()
+		matches, err := calcConjunctiveExpr(ctx, g, disjuncts[i], traces[i])
+		traces[i].finish(start, matches)
+		results[i] = matches
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A disjunct's result may be g itself (e.g. if none of its Not items are
+	// mentioned), so it's never merged into, and isn't returned as is.
+	if len(results) == 1 {
+		return server.NewContentBuffer().Union(results[0]), nil
+	}
+
+	// Merge the results as a binary tree, i.e. in rounds that each halve the
+	// number of results by merging pairs of them into new buffers.
+	for len(results) > 1 {
+		merged := make([]*server.ContentBuffer, (len(results)+1)/2)
+		unions := make([]QueryStep, len(results)/2)
+		err := forEachConcurrently(ctx, len(merged), workers, func(ctx context.Context, i int) error {
+			if 2*i+1 < len(results) {
+				start := time.Now()
+				merged[i] = server.NewContentBuffer().Union(results[2*i]).Union(results[2*i+1])
+				if explanation != nil {
+					unions[i] = newQueryStep("Union", "", start, merged[i])
+				}
+			} else {
+				merged[i] = results[2*i]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		explanation.addUnions(unions)
+		results = merged
+	}
+
+	if len(results) == 0 {
+		return server.NewContentBuffer(), nil
+	}
+	return results[0], nil
+}
+
+// Calls f(i) for each i in [0, n), on at most the specified number of
+// goroutines.  Returns the first error that f() returns, after cancelling
+// the context passed to the other calls; or ctx.Err() if the context is done
+// before all of the calls have been made.
+func forEachConcurrently(ctx context.Context, n int, workers int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var firstErr error
+	var errLock sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := f(ctx, i); err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Stop handing out work as soon as the context is done.
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Calculates the 'AND' co-occurrence of the conjunctive expression, i.e. the
+// content of g that mentions every entity in expr.And, minus the content that
+// mentions any of the entities in expr.Not.  The context is checked before
+// each entity is applied, so that a cancelled query stops early.  The steps
+// are recorded in the trace, if it's non-nil.
+func calcConjunctiveExpr(ctx context.Context, g *server.ContentBuffer, expr ConjunctiveExpr, trace *DisjunctExplanation) (*server.ContentBuffer, error) {
+	logger.Printf("Calculating co-occurences for conjuncts: %v", expr.And)
+	for _, entity := range expr.And {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		logger.Printf("Filtering on %v", entity.Id)
+		entityType, entityId, err := parseFilterItem(entity)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		g = g.FilterOnEntity(entityType, entityId)
+		trace.addStep("FilterOnEntity", entity.Id, start, g)
+	}
+
+	for _, entity := range expr.Not {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		logger.Printf("Excluding %v", entity.Id)
+		entityType, entityId, err := parseFilterItem(entity)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		g = excludeEntity(g, entityType, entityId)
+		trace.addStep("ExcludeEntity", entity.Id, start, g)
+	}
+
+	return g, nil
+}
+
+// Returns the set difference of g and the content that mentions the entity,
+// i.e. a copy of g without the documents that mention the entity.  If no
+// documents mention the entity, g itself is returned.
+func excludeEntity(g *server.ContentBuffer, entityType server.EntityType, entityId int) *server.ContentBuffer {
+	docIds := entityGraphForType(g, entityType).DocumentIdsForEntity(entityId)
+	if docIds == nil || docIds.Size() == 0 {
+		return g
+	}
+
+	result := server.NewContentBuffer().Union(g)
+	docIds.ForEach(func(docId int) {
+		result.RemoveDocument(docId)
+	})
+	return result
+}
+
+// Returns the content that the filter query selects (see selectBaseContent
+// and selectEntityContent).
+func selectContent(ctx context.Context, mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, filterQuery FilterQuery, explanation *QueryExplanation) (*server.ContentBuffer, error) {
+	g, err := selectBaseContent(mgr, docIndex, placeIndex, filterQuery, explanation)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !filterQuery.IsEntityFilterSpecified() {
+		return g, nil
+	}
+	return selectEntityContent(ctx, g, filterQuery, explanation)
+}
+
+// Returns the content that the filter query's entity filters are applied to:
+// the content within its time range or window, narrowed down by its document
+// filters (i.e. keywords, sources and geographic area).  Returns a
+// *TimeWindowError if the time window can't be served.
+func selectBaseContent(mgr *server.EntityManager, docIndex *DocumentIndex, placeIndex *PlaceIndex, filterQuery FilterQuery, explanation *QueryExplanation) (*server.ContentBuffer, error) {
+	var g *server.ContentBuffer
+	if filterQuery.IsTimeWindowSpecified() {
+		start, end, err := resolveTimeWindow(filterQuery, mgr.ContentBuffer().LatestEntityStats(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("Getting content buffer for window=[%v, %v)", start, end)
+		g = contentInTimeWindow(mgr.ContentBuffer(), docIndex, start, end)
+		explanation.SetBaseBuffer(fmt.Sprintf("window=[%v, %v)", start.Format(time.RFC3339), end.Format(time.RFC3339)), g)
+	} else if filterQuery.IsTimeRangeSpecified() {
+		timeRange := time.Duration(filterQuery.TimeRangeInHours) * time.Hour
+		logger.Printf("Getting content buffer for timeRange=%v", timeRange)
+		g = mgr.ContentBufferForTimeRange(timeRange)
+		explanation.SetBaseBuffer(fmt.Sprintf("TimeRangeInHours=%v", filterQuery.TimeRangeInHours), g)
+	} else {
+		logger.Printf("Getting global content buffer")
+		g = mgr.ContentBuffer()
+		explanation.SetBaseBuffer("global", g)
+	}
+
+	if filterQuery.IsKeywordFilterSpecified() {
+		keywords, err := parseKeywordQuery(filterQuery.Keywords)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing keywords: %v", err))
+		}
+		logger.Printf("Filtering on headline keywords: %v", keywords.terms)
+		start := time.Now()
+		g = docIndex.FilterOnKeywords(g, keywords)
+		explanation.AddDocumentFilter("FilterOnKeywords", start, g)
+	}
+	if filterQuery.IsSourceFilterSpecified() {
+		logger.Printf("Filtering on sources: %v, excluding: %v", filterQuery.Sources, filterQuery.ExcludedSources)
+		start := time.Now()
+		g = docIndex.FilterOnSources(g, filterQuery.Sources, filterQuery.ExcludedSources)
+		explanation.AddDocumentFilter("FilterOnSources", start, g)
+	}
+	if filterQuery.IsGeoFilterSpecified() {
+		if err := validateGeoFilter(filterQuery); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid geographic filter: %v", err))
+		}
+		logger.Printf("Filtering on places within bbox=%+v, radius=%+v", filterQuery.GeoBoundingBox, filterQuery.GeoRadius)
+		start := time.Now()
+		g = placeIndex.FilterOnArea(g, docIndex, filterQuery.GeoBoundingBox, filterQuery.GeoRadius)
+		explanation.AddDocumentFilter("FilterOnArea", start, g)
+	}
+	return g, nil
+}
+
+// Returns the content within g that the filter query's entity filters (i.e.
+// its disjuncts) select.  Returns the context's error if the query is
+// cancelled or runs out of time.
+func selectEntityContent(ctx context.Context, g *server.ContentBuffer, filterQuery FilterQuery, explanation *QueryExplanation) (*server.ContentBuffer, error) {
+	logger.Printf("Calculating entity co-occurrences with disjunct query: %+v", filterQuery.Or)
+	result, err := calcDisjunctiveExpr(ctx, g, filterQuery.Or, explanation)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error processing conjunct expression: %v", err))
+	}
+	return result, nil
+}
+
+// Returns the content buffer's graph for the specified entity type.
+func entityGraphForType(g *server.ContentBuffer, entityType server.EntityType) *server.EntityGraph {
+	if def, found := entityTypes.ByType(entityType); found {
+		return def.Graph(g)
+	}
+	return nil
+}
+
+// Describes a StartTime/EndTime window that can't be served, e.g. because it
+// reaches back further than the content that's retained in the content
+// buffer.
+type TimeWindowError struct {
+	Reason string
+	// The range of content that's retained, if known.
+	RetainedFrom time.Time
+	RetainedTo   time.Time
+}
+
+func (me *TimeWindowError) Error() string {
+	if me.RetainedFrom.IsZero() {
+		return me.Reason
+	}
+	return fmt.Sprintf("%v (content is retained from %v to %v)", me.Reason,
+		me.RetainedFrom.Format(time.RFC3339), me.RetainedTo.Format(time.RFC3339))
+}
+
+// Returns the [start, end) window selected by the filter query's StartTime
+// and EndTime.  A missing StartTime defaults to the oldest retained content,
+// and a missing EndTime to now.  The window must lie within the retained
+// range, i.e. between the oldest retained content and now, as described by
+// the content buffer's stats.
+func resolveTimeWindow(filterQuery FilterQuery, retained server.EntityStats, now time.Time) (start time.Time, end time.Time, err error) {
+	if filterQuery.IsTimeRangeSpecified() {
+		return start, end, &TimeWindowError{Reason: "TimeRangeInHours can't be combined with StartTime or EndTime"}
+	}
+	if retained.OldestContent.IsEmpty() {
+		return start, end, &TimeWindowError{Reason: "No content is retained"}
+	}
+
+	retainedFrom := retained.OldestContent.Time()
+	newWindowError := func(reason string) error {
+		return &TimeWindowError{Reason: reason, RetainedFrom: retainedFrom, RetainedTo: now}
+	}
+
+	start, end = retainedFrom, now
+	if filterQuery.StartTime != nil {
+		start = *filterQuery.StartTime
+	}
+	if filterQuery.EndTime != nil {
+		end = *filterQuery.EndTime
+	}
+
+	switch {
+	case !start.Before(end):
+		return start, end, newWindowError("StartTime must be before EndTime")
+	case start.Before(retainedFrom):
+		return start, end, newWindowError(fmt.Sprintf("StartTime %v is before the oldest retained content", start.Format(time.RFC3339)))
+	case end.After(now):
+		return start, end, newWindowError(fmt.Sprintf("EndTime %v is in the future", end.Format(time.RFC3339)))
+	}
+	return start, end, nil
+}
+
+// Returns the [start, end) window selected by the filter query's time range,
+// for series that are charted over time.  This is the same as
+// resolveTimeWindow's, except that TimeRangeInHours is also allowed, and
+// selects the last so many hours (cut short at the oldest retained content).
+func resolveChartWindow(filterQuery FilterQuery, retained server.EntityStats, now time.Time) (start time.Time, end time.Time, err error) {
+	if filterQuery.IsTimeRangeSpecified() && !filterQuery.IsTimeWindowSpecified() && !retained.OldestContent.IsEmpty() {
+		start := now.Add(-time.Duration(filterQuery.TimeRangeInHours) * time.Hour)
+		if retainedFrom := retained.OldestContent.Time(); start.Before(retainedFrom) {
+			start = retainedFrom
+		}
+		filterQuery.TimeRangeInHours, filterQuery.StartTime = 0, &start
+	}
+	return resolveTimeWindow(filterQuery, retained, now)
+}
+
+// Returns a copy of g containing only the content inserted within the
+// [start, end) window.  Newer documents that don't mention any entity can't
+// be enumerated through the entity graphs, so they're looked up in the
+// document index instead.
+func contentInTimeWindow(g *server.ContentBuffer, docIndex *DocumentIndex, start time.Time, end time.Time) *server.ContentBuffer {
+	endTime := unixtime.Unix(int32(end.Unix()))
+	window := g.KeepContentNewerThan(unixtime.Unix(int32(start.Unix())))
+	tooNew := documentIds(window.KeepContentNewerThan(endTime))
+	tooNew.PutAll(docIndex.DocumentIdsInsertedSince(endTime))
+	tooNew.ForEach(func(docId int) {
+		window.RemoveDocument(docId)
+	})
+	return window
+}
+
+// Returns the ids of the documents in g that mention at least one entity.
+func documentIds(g *server.ContentBuffer) *server.IntSet {
+	docIds := server.NewIntSet()
+	for _, def := range entityTypes.All() {
+		graph := def.Graph(g)
+		graph.ForEachEntityId(func(entityId int) {
+			docIds.PutAll(graph.DocumentIdsForEntity(entityId))
+		})
+	}
+	return docIds
+}
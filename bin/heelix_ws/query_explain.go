@@ -0,0 +1,120 @@
+package main
+
+import (
+	server "qbase/synthos/synthos_svr"
+	"time"
+)
+
+// Describes how an all_entity_info query was run, i.e. its "explain" mode.
+// The methods that record the steps do nothing on a nil QueryExplanation, so
+// that queries that aren't being explained don't pay for it.
+type QueryExplanation struct {
+	// The filter query as posted (or parsed from the q param), and after
+	// normalization (see normalizeFilterQuery).
+	FilterQuery     FilterQuery
+	NormalizedQuery FilterQuery
+
+	// Which content buffer the query started from (e.g. "global",
+	// "TimeRangeInHours=8" or "window=[start, end)"), and its size.
+	BaseBuffer              string
+	BaseBufferDocumentCount int
+
+	// The keyword, source and geographic filters applied to the base buffer.
+	DocumentFilters []QueryStep
+	// Each disjunct's FilterOnEntity (and exclusion) steps, in order.
+	Disjuncts []DisjunctExplanation
+	// The Union steps that merged the disjuncts' results.
+	Unions []QueryStep
+	// The CalcEntityStats step (or LatestEntityStats, if the cached global
+	// stats were used).
+	Stats QueryStep
+
+	// Whether a response to an equivalent query was already cached (see
+	// ResultCache), and whether the cached global stats were used.
+	ResultCacheHit  bool
+	UsedCachedStats bool
+
+	TotalDuration string
+}
+
+// A single step of a query, with the number of documents left after it.
+type QueryStep struct {
+	Step          string
+	Id            string `json:",omitempty"`
+	DocumentCount int
+	Duration      string
+}
+
+// The steps of a single disjunct.
+type DisjunctExplanation struct {
+	Steps         []QueryStep
+	DocumentCount int
+	Duration      string
+}
+
+func newQueryStep(step string, id string, start time.Time, g *server.ContentBuffer) QueryStep {
+	return QueryStep{Step: step, Id: id, DocumentCount: g.DocumentCount(), Duration: time.Since(start).String()}
+}
+
+func (me *QueryExplanation) SetBaseBuffer(description string, g *server.ContentBuffer) {
+	if me == nil {
+		return
+	}
+	me.BaseBuffer = description
+	me.BaseBufferDocumentCount = g.DocumentCount()
+}
+
+// Records a document filter that started at the specified time, and produced g.
+func (me *QueryExplanation) AddDocumentFilter(step string, start time.Time, g *server.ContentBuffer) {
+	if me == nil {
+		return
+	}
+	me.DocumentFilters = append(me.DocumentFilters, newQueryStep(step, "", start, g))
+}
+
+// Records the stats step that started at the specified time.
+func (me *QueryExplanation) SetStats(step string, start time.Time, g *server.ContentBuffer) {
+	if me == nil {
+		return
+	}
+	me.Stats = newQueryStep(step, "", start, g)
+	me.UsedCachedStats = step == "LatestEntityStats"
+}
+
+// Returns the explanation of the i'th of n disjuncts, or nil if the query
+// isn't being explained.  Must be called before the disjuncts are evaluated
+// (which may happen concurrently).
+func (me *QueryExplanation) disjunct(i int, n int) *DisjunctExplanation {
+	if me == nil {
+		return nil
+	}
+	if len(me.Disjuncts) != n {
+		me.Disjuncts = make([]DisjunctExplanation, n)
+	}
+	return &me.Disjuncts[i]
+}
+
+func (me *QueryExplanation) addUnions(unions []QueryStep) {
+	if me == nil {
+		return
+	}
+	me.Unions = append(me.Unions, unions...)
+}
+
+// Records a step of the disjunct that started at the specified time, and
+// produced g.
+func (me *DisjunctExplanation) addStep(step string, id string, start time.Time, g *server.ContentBuffer) {
+	if me == nil {
+		return
+	}
+	me.Steps = append(me.Steps, newQueryStep(step, id, start, g))
+}
+
+// Records the disjunct's result, and the time taken by all of its steps.
+func (me *DisjunctExplanation) finish(start time.Time, g *server.ContentBuffer) {
+	if me == nil || g == nil {
+		return
+	}
+	me.DocumentCount = g.DocumentCount()
+	me.Duration = time.Since(start).String()
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The text query language compiles to a FilterQuery.  A query is a boolean
+// expression over entities, optionally followed (or preceded) by clauses:
+//
+//	(Person:175952 AND Org:22198950) OR Person:624426 AND NOT Org:5 last 8h
+//
+// AND binds tighter than OR, and NOT applies to the term that follows it.
+// Operators are case-insensitive.  The expression is compiled to disjunctive
+// normal form, i.e. FilterQuery.Or.  The clauses are:
+//
+//	last <n>h | last <n>d        TimeRangeInHours
+//	from <time>, to <time>       StartTime, EndTime (YYYY-MM-DD or RFC 3339)
+//	headline:<term>              Keywords, e.g. headline:strik* or headline:"labor union"
+//	source:<name>                Sources, e.g. source:"BBC News"
+//	-source:<name>               ExcludedSources
+//	within:<lat>,<lng>,<n>km     GeoRadius
+//	bbox:<minLat>,<minLng>,<maxLat>,<maxLng>   GeoBoundingBox
+//	top:<n>                      TopN
+//	bucket:<duration>            TrendBucket, e.g. bucket:1h
+//
+// See formatFilterQuery for the reverse transformation.
+
+// Maximum number of disjuncts that an expression may expand to, when it's
+// converted to disjunctive normal form.
+const maxQueryDisjuncts = 100
+
+// Describes why a text query couldn't be parsed.  Position is the 1-based
+// character position of the offending token within the query.
+type QueryParseError struct {
+	Position int
+	Message  string
+}
+
+func (me *QueryParseError) Error() string {
+	return fmt.Sprintf("Error at position %v: %v", me.Position, me.Message)
+}
+
+type queryTokenKind int
+
+const (
+	wordToken queryTokenKind = iota
+	leftParenToken
+	rightParenToken
+	endToken
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	// 0-based character position of the token within the query.
+	pos int
+}
+
+// Splits the query into words and parentheses.  A word may contain a quoted
+// string (e.g. source:"BBC News"), which may contain whitespace and
+// parentheses.
+func tokenizeQuery(query string) ([]queryToken, error) {
+	runes := []rune(query)
+	tokens := []queryToken{}
+
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{leftParenToken, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{rightParenToken, ")", i})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				if runes[i] == '"' {
+					quoteStart := i
+					for i++; i < len(runes) && runes[i] != '"'; i++ {
+					}
+					if i == len(runes) {
+						return nil, &QueryParseError{quoteStart + 1, "Unterminated quoted string"}
+					}
+				}
+				i++
+			}
+			tokens = append(tokens, queryToken{wordToken, string(runes[start:i]), start})
+		}
+	}
+
+	return append(tokens, queryToken{endToken, "", len(runes)}), nil
+}
+
+// A node of a parsed boolean expression.
+type queryNode interface{}
+
+type entityNode struct {
+	item FilterItem
+}
+
+type notNode struct {
+	operand queryNode
+}
+
+// Binary operator nodes keep their (0-based) position, for reporting
+// expansion errors.
+type andNode struct {
+	operands []queryNode
+	pos      int
+}
+
+type orNode struct {
+	operands []queryNode
+	pos      int
+}
+
+type queryParser struct {
+	tokens      []queryToken
+	next        int
+	filterQuery FilterQuery
+}
+
+// Parses a text query (see above) into a FilterQuery.  Errors are reported as
+// a *QueryParseError.
+func parseTextQuery(query string) (FilterQuery, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return FilterQuery{}, err
+	}
+
+	parser := &queryParser{tokens: tokens}
+	var expr queryNode
+	for parser.peek().kind != endToken {
+		token := parser.peek()
+		if isClause(token) {
+			if err := parser.parseClause(); err != nil {
+				return FilterQuery{}, err
+			}
+			continue
+		}
+		if expr != nil {
+			return FilterQuery{}, parser.errorAt(token, fmt.Sprintf("Unexpected '%v' (expected AND, OR or a clause)", token.text))
+		}
+		if expr, err = parser.parseOr(); err != nil {
+			return FilterQuery{}, err
+		}
+	}
+
+	if expr != nil {
+		disjuncts, err := toDisjunctiveNormalForm(expr, false)
+		if err != nil {
+			return FilterQuery{}, err
+		}
+		parser.filterQuery.Or = disjuncts
+	}
+	return parser.filterQuery, nil
+}
+
+func (me *queryParser) peek() queryToken {
+	return me.tokens[me.next]
+}
+
+func (me *queryParser) advance() queryToken {
+	token := me.tokens[me.next]
+	if token.kind != endToken {
+		me.next++
+	}
+	return token
+}
+
+func (me *queryParser) isOperator(operator string) bool {
+	token := me.peek()
+	return token.kind == wordToken && strings.EqualFold(token.text, operator)
+}
+
+func (me *queryParser) errorAt(token queryToken, message string) error {
+	return &QueryParseError{token.pos + 1, message}
+}
+
+// orExpr := andExpr (OR andExpr)*
+func (me *queryParser) parseOr() (queryNode, error) {
+	pos := me.peek().pos
+	operands := []queryNode{}
+	for {
+		operand, err := me.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !me.isOperator("OR") {
+			break
+		}
+		me.advance()
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &orNode{operands: operands, pos: pos}, nil
+}
+
+// andExpr := unaryExpr (AND unaryExpr)*
+func (me *queryParser) parseAnd() (queryNode, error) {
+	pos := me.peek().pos
+	operands := []queryNode{}
+	for {
+		operand, err := me.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !me.isOperator("AND") {
+			break
+		}
+		me.advance()
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &andNode{operands: operands, pos: pos}, nil
+}
+
+// unaryExpr := NOT unaryExpr | '(' orExpr ')' | <entity type>:<entity id>
+func (me *queryParser) parseUnary() (queryNode, error) {
+	if me.isOperator("NOT") {
+		me.advance()
+		operand, err := me.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+
+	token := me.advance()
+	switch {
+	case token.kind == leftParenToken:
+		expr, err := me.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := me.advance(); closing.kind != rightParenToken {
+			return nil, me.errorAt(closing, "Expected ')'")
+		}
+		return expr, nil
+	case token.kind == endToken:
+		return nil, me.errorAt(token, "Unexpected end of query (expected an entity)")
+	case token.kind != wordToken || isClause(token) || isOperatorWord(token.text):
+		return nil, me.errorAt(token, fmt.Sprintf("Unexpected '%v' (expected an entity)", token.text))
+	}
+
+	item := FilterItem{Id: token.text}
+	if _, _, err := parseFilterItem(item); err != nil {
+		return nil, me.errorAt(token, fmt.Sprintf("Invalid entity '%v' (expected <entity type>:<entity id>, e.g. Person:175952)", token.text))
+	}
+	return &entityNode{item}, nil
+}
+
+func isOperatorWord(text string) bool {
+	return strings.EqualFold(text, "AND") || strings.EqualFold(text, "OR") || strings.EqualFold(text, "NOT")
+}
+
+// Prefixes of the clauses whose value follows a colon, e.g. source:Reuters.
+var queryClausePrefixes = []string{"headline:", "source:", "-source:", "within:", "bbox:", "top:", "bucket:"}
+
+// Clauses whose value is the following word, e.g. last 8h.
+var queryClauseWords = []string{"last", "from", "to"}
+
+func isClause(token queryToken) bool {
+	if token.kind != wordToken {
+		return false
+	}
+	_, _, isClause := splitClause(token.text)
+	return isClause
+}
+
+// Splits a clause token into its (lower-case) name and its value, if it's a
+// clause.
+func splitClause(text string) (name string, value string, isClause bool) {
+	for _, word := range queryClauseWords {
+		if strings.EqualFold(text, word) {
+			return word, "", true
+		}
+	}
+	for _, prefix := range queryClausePrefixes {
+		if len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			return strings.TrimSuffix(prefix, ":"), text[len(prefix):], true
+		}
+	}
+	return "", "", false
+}
+
+func (me *queryParser) parseClause() error {
+	token := me.advance()
+	name, value, _ := splitClause(token.text)
+
+	// The value of a word clause is the following word.
+	valueToken := token
+	if value == "" && (name == "last" || name == "from" || name == "to") {
+		valueToken = me.advance()
+		if valueToken.kind != wordToken {
+			return me.errorAt(valueToken, fmt.Sprintf("Expected a value after '%v'", token.text))
+		}
+		value = valueToken.text
+	}
+	if value == "" {
+		return me.errorAt(token, fmt.Sprintf("Expected a value after '%v'", token.text))
+	}
+
+	fq := &me.filterQuery
+	switch name {
+	case "last":
+		if fq.TimeRangeInHours != 0 {
+			return me.errorAt(token, "Duplicate 'last' clause")
+		}
+		hours, err := parseQueryHours(value)
+		if err != nil {
+			return me.errorAt(valueToken, err.Error())
+		}
+		fq.TimeRangeInHours = hours
+	case "from", "to":
+		bound := &fq.StartTime
+		if name == "to" {
+			bound = &fq.EndTime
+		}
+		if *bound != nil {
+			return me.errorAt(token, fmt.Sprintf("Duplicate '%v' clause", name))
+		}
+		t, err := parseReportDate(value)
+		if err != nil {
+			return me.errorAt(valueToken, fmt.Sprintf("Invalid time '%v' (expected YYYY-MM-DD or RFC 3339)", value))
+		}
+		*bound = &t
+	case "headline":
+		if _, err := parseKeywordQuery(value); err != nil {
+			return me.errorAt(token, err.Error())
+		}
+		fq.Keywords = strings.TrimSpace(fq.Keywords + " " + value)
+	case "source":
+		fq.Sources = append(fq.Sources, unquote(value))
+	case "-source":
+		fq.ExcludedSources = append(fq.ExcludedSources, unquote(value))
+	case "within":
+		if fq.GeoRadius != nil {
+			return me.errorAt(token, "Duplicate 'within' clause")
+		}
+		coords, err := parseQueryNumbers(strings.TrimSuffix(strings.ToLower(value), "km"), 3)
+		if err != nil {
+			return me.errorAt(token, fmt.Sprintf("Invalid 'within' clause (expected within:<lat>,<lng>,<radius>km): %v", err))
+		}
+		fq.GeoRadius = &GeoRadius{Lat: coords[0], Lng: coords[1], RadiusKm: coords[2]}
+		if err := fq.GeoRadius.Validate(); err != nil {
+			return me.errorAt(token, err.Error())
+		}
+	case "bbox":
+		if fq.GeoBoundingBox != nil {
+			return me.errorAt(token, "Duplicate 'bbox' clause")
+		}
+		coords, err := parseQueryNumbers(value, 4)
+		if err != nil {
+			return me.errorAt(token, fmt.Sprintf("Invalid 'bbox' clause (expected bbox:<minLat>,<minLng>,<maxLat>,<maxLng>): %v", err))
+		}
+		fq.GeoBoundingBox = &GeoBoundingBox{MinLat: coords[0], MinLng: coords[1], MaxLat: coords[2], MaxLng: coords[3]}
+		if err := fq.GeoBoundingBox.Validate(); err != nil {
+			return me.errorAt(token, err.Error())
+		}
+	case "top":
+		if fq.TopN != 0 {
+			return me.errorAt(token, "Duplicate 'top' clause")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxTopN {
+			return me.errorAt(token, fmt.Sprintf("Invalid 'top' clause (expected top:<n>, with n within [1, %v])", maxTopN))
+		}
+		fq.TopN = n
+	case "bucket":
+		if fq.TrendBucket != "" {
+			return me.errorAt(token, "Duplicate 'bucket' clause")
+		}
+		fq.TrendBucket = value
+		if _, err := fq.TrendBucketDuration(); err != nil {
+			return me.errorAt(token, err.Error())
+		}
+	}
+	return nil
+}
+
+// Parses a duration of the form <n>h or <n>d into a number of hours.
+func parseQueryHours(value string) (int, error) {
+	lower := strings.ToLower(value)
+	multiplier := 0
+	switch {
+	case strings.HasSuffix(lower, "h"):
+		multiplier = 1
+	case strings.HasSuffix(lower, "d"):
+		multiplier = 24
+	}
+	n, err := strconv.Atoi(lower[:len(lower)-1])
+	if multiplier == 0 || err != nil || n <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid duration '%v' (expected e.g. 8h or 2d)", value))
+	}
+	return n * multiplier, nil
+}
+
+// Parses a comma-separated list of exactly count numbers.
+func parseQueryNumbers(value string, count int) ([]float64, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != count {
+		return nil, errors.New(fmt.Sprintf("expected %v comma-separated numbers", count))
+	}
+	numbers := []float64{}
+	for _, field := range fields {
+		n, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("'%v' isn't a number", field))
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Converts the expression to disjunctive normal form, i.e. an OR of ANDs of
+// (possibly negated) entities.  Negations are pushed down to the entities
+// with De Morgan's laws.
+func toDisjunctiveNormalForm(node queryNode, negated bool) ([]ConjunctiveExpr, error) {
+	switch n := node.(type) {
+	case *entityNode:
+		if negated {
+			return []ConjunctiveExpr{ConjunctiveExpr{And: []FilterItem{}, Not: []FilterItem{n.item}}}, nil
+		}
+		return []ConjunctiveExpr{ConjunctiveExpr{And: []FilterItem{n.item}}}, nil
+	case *notNode:
+		return toDisjunctiveNormalForm(n.operand, !negated)
+	case *andNode:
+		if negated {
+			return disjoin(n.operands, negated, n.pos)
+		}
+		return conjoin(n.operands, negated, n.pos)
+	case *orNode:
+		if negated {
+			return conjoin(n.operands, negated, n.pos)
+		}
+		return disjoin(n.operands, negated, n.pos)
+	}
+	return nil, errors.New(fmt.Sprintf("Unexpected query node: %T", node))
+}
+
+// Returns the union of the operands' disjuncts.
+func disjoin(operands []queryNode, negated bool, pos int) ([]ConjunctiveExpr, error) {
+	disjuncts := []ConjunctiveExpr{}
+	for _, operand := range operands {
+		operandDisjuncts, err := toDisjunctiveNormalForm(operand, negated)
+		if err != nil {
+			return nil, err
+		}
+		disjuncts = append(disjuncts, operandDisjuncts...)
+	}
+	if len(disjuncts) > maxQueryDisjuncts {
+		return nil, &QueryParseError{pos + 1, fmt.Sprintf("Query expands to more than %v OR terms", maxQueryDisjuncts)}
+	}
+	return disjuncts, nil
+}
+
+// Returns the cross product of the operands' disjuncts, i.e. distributes AND
+// over OR.
+func conjoin(operands []queryNode, negated bool, pos int) ([]ConjunctiveExpr, error) {
+	disjuncts := []ConjunctiveExpr{ConjunctiveExpr{And: []FilterItem{}}}
+	for _, operand := range operands {
+		operandDisjuncts, err := toDisjunctiveNormalForm(operand, negated)
+		if err != nil {
+			return nil, err
+		}
+		if len(disjuncts)*len(operandDisjuncts) > maxQueryDisjuncts {
+			return nil, &QueryParseError{pos + 1, fmt.Sprintf("Query expands to more than %v OR terms", maxQueryDisjuncts)}
+		}
+
+		product := []ConjunctiveExpr{}
+		for _, left := range disjuncts {
+			for _, right := range operandDisjuncts {
+				product = append(product, ConjunctiveExpr{
+					And: append(append([]FilterItem{}, left.And...), right.And...),
+					Not: append(append([]FilterItem{}, left.Not...), right.Not...),
+				})
+			}
+		}
+		disjuncts = product
+	}
+	return disjuncts, nil
+}
+
+// Formats the filter query as a text query that parses back to an equivalent
+// FilterQuery (see parseTextQuery).  Entity labels aren't part of the text.
+func formatFilterQuery(filterQuery FilterQuery) (string, error) {
+	parts := []string{}
+
+	disjuncts := []string{}
+	for _, expr := range filterQuery.Or {
+		conjuncts := []string{}
+		for _, item := range append(append([]FilterItem{}, expr.And...), expr.Not...) {
+			if item.IsUnresolved() {
+				return "", errors.New(fmt.Sprintf("Can't format %v '%v', which has no Id", item.Type, item.Label))
+			}
+		}
+		for _, item := range expr.And {
+			conjuncts = append(conjuncts, item.Id)
+		}
+		for _, item := range expr.Not {
+			conjuncts = append(conjuncts, "NOT "+item.Id)
+		}
+		if len(conjuncts) == 0 {
+			return "", errors.New("Can't format an empty conjunctive expression")
+		}
+		conjunction := strings.Join(conjuncts, " AND ")
+		if len(conjuncts) > 1 && len(filterQuery.Or) > 1 {
+			conjunction = "(" + conjunction + ")"
+		}
+		disjuncts = append(disjuncts, conjunction)
+	}
+	if len(disjuncts) > 0 {
+		parts = append(parts, strings.Join(disjuncts, " OR "))
+	}
+
+	if filterQuery.IsTimeRangeSpecified() {
+		parts = append(parts, fmt.Sprintf("last %vh", filterQuery.TimeRangeInHours))
+	}
+	if filterQuery.StartTime != nil {
+		parts = append(parts, "from "+filterQuery.StartTime.Format(time.RFC3339))
+	}
+	if filterQuery.EndTime != nil {
+		parts = append(parts, "to "+filterQuery.EndTime.Format(time.RFC3339))
+	}
+	if filterQuery.IsKeywordFilterSpecified() {
+		keywords, err := parseKeywordQuery(filterQuery.Keywords)
+		if err != nil {
+			return "", err
+		}
+		for _, term := range keywords.terms {
+			parts = append(parts, "headline:"+term.String())
+		}
+	}
+	for _, source := range filterQuery.Sources {
+		parts = append(parts, "source:"+quoteIfNeeded(source))
+	}
+	for _, source := range filterQuery.ExcludedSources {
+		parts = append(parts, "-source:"+quoteIfNeeded(source))
+	}
+	if r := filterQuery.GeoRadius; r != nil {
+		parts = append(parts, fmt.Sprintf("within:%v,%v,%vkm", formatFloat(r.Lat), formatFloat(r.Lng), formatFloat(r.RadiusKm)))
+	}
+	if b := filterQuery.GeoBoundingBox; b != nil {
+		parts = append(parts, fmt.Sprintf("bbox:%v,%v,%v,%v", formatFloat(b.MinLat), formatFloat(b.MinLng), formatFloat(b.MaxLat), formatFloat(b.MaxLng)))
+	}
+	if filterQuery.TopN != 0 {
+		parts = append(parts, fmt.Sprintf("top:%v", filterQuery.TopN))
+	}
+	if filterQuery.IsTrendBucketSpecified() {
+		parts = append(parts, "bucket:"+strings.TrimSpace(filterQuery.TrendBucket))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+func quoteIfNeeded(value string) string {
+	if strings.IndexFunc(value, func(r rune) bool { return unicode.IsSpace(r) || r == '(' || r == ')' }) >= 0 {
+		return "\"" + value + "\""
+	}
+	return value
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
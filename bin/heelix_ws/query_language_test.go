@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseTextQuery(t *testing.T) {
+	filterQuery, err := parseTextQuery("(Person:175952 AND Org:22198950) OR Person:624426 last 8h")
+	assert.Nil(t, err)
+	assert.Equal(t, 8, filterQuery.TimeRangeInHours)
+	assert.Equal(t, []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:175952"}, FilterItem{Id: "Org:22198950"}}, Not: []FilterItem{}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:624426"}}},
+	}, filterQuery.Or)
+
+	// AND binds tighter than OR, and operators are case-insensitive.
+	filterQuery, err = parseTextQuery("Person:1 or Person:2 and not Org:3")
+	assert.Nil(t, err)
+	assert.Equal(t, "Person:1|Person:2!Org:3", dnfString(filterQuery))
+
+	// AND distributes over OR, and NOT is pushed down to the entities.
+	filterQuery, err = parseTextQuery("Org:1 AND NOT (Person:2 OR Person:3) AND (Place:4 OR Place:5)")
+	assert.Nil(t, err)
+	assert.Equal(t, "Org:1,Place:4!Person:2,Person:3|Org:1,Place:5!Person:2,Person:3", dnfString(filterQuery))
+	filterQuery, err = parseTextQuery("NOT (Person:2 AND Person:3)")
+	assert.Nil(t, err)
+	assert.Equal(t, "!Person:2|!Person:3", dnfString(filterQuery))
+}
+
+func TestParseTextQuery_clauses(t *testing.T) {
+	filterQuery, err := parseTextQuery(`from 2026-10-17 Org:1 to 2026-10-17T11:30:00Z headline:strik* headline:"labor union" ` +
+		`source:"BBC News" source:Reuters -source:"The Onion" within:47.6,-122.3,50km bbox:-20,170,-10,-170`)
+	assert.Nil(t, err)
+	assert.Equal(t, "Org:1", dnfString(filterQuery))
+	assert.Equal(t, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), *filterQuery.StartTime)
+	assert.Equal(t, time.Date(2026, 10, 17, 11, 30, 0, 0, time.UTC), *filterQuery.EndTime)
+	assert.Equal(t, `strik* "labor union"`, filterQuery.Keywords)
+	assert.Equal(t, []string{"BBC News", "Reuters"}, filterQuery.Sources)
+	assert.Equal(t, []string{"The Onion"}, filterQuery.ExcludedSources)
+	assert.Equal(t, GeoRadius{Lat: 47.6, Lng: -122.3, RadiusKm: 50}, *filterQuery.GeoRadius)
+	assert.Equal(t, GeoBoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}, *filterQuery.GeoBoundingBox)
+
+	filterQuery, err = parseTextQuery("Org:1 top:5 bucket:1m")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, filterQuery.TopN)
+	assert.Equal(t, "1m", filterQuery.TrendBucket)
+
+	filterQuery, err = parseTextQuery("last 2d")
+	assert.Nil(t, err)
+	assert.Equal(t, 48, filterQuery.TimeRangeInHours)
+	assert.Equal(t, 0, len(filterQuery.Or))
+}
+
+func TestParseTextQuery_errors(t *testing.T) {
+	testCases := []struct {
+		query    string
+		position int
+	}{
+		{"Person:1 AND", 13},
+		{"Person:1 AND (Org:2 OR Org:3", 29},
+		{"Person:1 Org:2", 10},
+		{"Person:1 AND Persn:2", 14},
+		{"Person:1 OR )", 13},
+		{`Person:1 source:"BBC News`, 17},
+		{"Person:1 last 8x", 15},
+		{"Person:1 last", 14},
+		{"Person:1 last 8h last 2h", 18},
+		{"Person:1 from yesterday", 15},
+		{"Person:1 within:47.6,-122.3", 10},
+		{`Person:1 headline:"labor`, 19},
+		{"Person:1 top:0", 10},
+		{"Person:1 bucket:30s", 10},
+		{"(Person:1 OR Person:2) AND (Org:1 OR Org:2) AND (Place:1 OR Place:2) AND (Place:3 OR Place:4) AND " +
+			"(Place:5 OR Place:6) AND (Place:7 OR Place:8) AND (Place:9 OR Place:10) AND (Place:11 OR Place:12)", 1},
+	}
+
+	for _, testCase := range testCases {
+		_, err := parseTextQuery(testCase.query)
+		parseErr, ok := err.(*QueryParseError)
+		if assert.True(t, ok, testCase.query) {
+			assert.Equal(t, testCase.position, parseErr.Position, testCase.query)
+		}
+	}
+}
+
+func TestFormatFilterQuery(t *testing.T) {
+	startTime := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	filterQuery := FilterQuery{
+		StartTime: &startTime,
+		Keywords:  `Strike "labor uni*"`,
+		Sources:   []string{"BBC News"},
+		GeoRadius: &GeoRadius{Lat: 47.6, Lng: -122.3, RadiusKm: 50},
+		Or: []ConjunctiveExpr{
+			ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:1", Label: "Joe"}, FilterItem{Id: "Org:2"}}, Not: []FilterItem{FilterItem{Id: "Org:3"}}},
+			ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:4"}}},
+		},
+	}
+
+	textQuery, err := formatFilterQuery(filterQuery)
+	assert.Nil(t, err)
+	assert.Equal(t, `(Person:1 AND Org:2 AND NOT Org:3) OR Place:4 from 2026-10-17T09:00:00Z headline:strike headline:"labor uni*" `+
+		`source:"BBC News" within:47.6,-122.3,50km`, textQuery)
+
+	// The text query parses back to the same filter (minus the labels).
+	parsedQuery, err := parseTextQuery(textQuery)
+	assert.Nil(t, err)
+	assert.Equal(t, dnfString(filterQuery), dnfString(parsedQuery))
+	assert.Equal(t, startTime, *parsedQuery.StartTime)
+	assert.Equal(t, `strike "labor uni*"`, parsedQuery.Keywords)
+	assert.Equal(t, filterQuery.Sources, parsedQuery.Sources)
+	assert.Equal(t, *filterQuery.GeoRadius, *parsedQuery.GeoRadius)
+
+	textQuery, err = formatFilterQuery(FilterQuery{TimeRangeInHours: 8, Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:1"}, FilterItem{Id: "Org:2"}}},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Person:1 AND Org:2 last 8h", textQuery)
+}
+
+//
+// TEST HELPERS
+//
+
+// Returns a compact representation of the filter's DNF: disjuncts are
+// separated by '|', and each disjunct's negated entities follow a '!'.
+func dnfString(filterQuery FilterQuery) string {
+	s := ""
+	for i, expr := range filterQuery.Or {
+		if i > 0 {
+			s += "|"
+		}
+		for j, item := range expr.And {
+			if j > 0 {
+				s += ","
+			}
+			s += item.Id
+		}
+		for j, item := range expr.Not {
+			if j == 0 {
+				s += "!"
+			} else {
+				s += ","
+			}
+			s += item.Id
+		}
+	}
+	return s
+}
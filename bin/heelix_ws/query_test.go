@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	mock "qbase/synthos/heelix_ws/mock"
+	"qbase/synthos/synthos_core/unixtime"
+	server "qbase/synthos/synthos_svr"
+	"testing"
+	"time"
+)
+
+func TestCalcConjunctiveExpr(t *testing.T) {
+	g := newContentBufferForTest()
+
+	// Org:1 is mentioned by docs 1-3, and Org:2 by docs 2 and 4.
+	result, err := calcConjunctiveExpr(context.Background(), g, ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:1"}}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.DocumentCount())
+
+	result, err = calcConjunctiveExpr(context.Background(), g, ConjunctiveExpr{
+		And: []FilterItem{FilterItem{Id: "Org:1"}},
+		Not: []FilterItem{FilterItem{Id: "Org:2"}},
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.DocumentCount())
+	assert.Equal(t, 0, result.OrgGraph.DocumentIdsForEntity(2).Size())
+
+	// Excluding an entity that isn't mentioned has no effect.
+	result, err = calcConjunctiveExpr(context.Background(), g, ConjunctiveExpr{
+		And: []FilterItem{FilterItem{Id: "Org:1"}},
+		Not: []FilterItem{FilterItem{Id: "Person:99"}},
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.DocumentCount())
+
+	// The original content is untouched.
+	assert.Equal(t, 4, g.DocumentCount())
+
+	// error case: malformed negated item
+	_, err = calcConjunctiveExpr(context.Background(), g, ConjunctiveExpr{
+		And: []FilterItem{FilterItem{Id: "Org:1"}},
+		Not: []FilterItem{FilterItem{Id: "Org:abc"}},
+	}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestCalcDisjunctiveExpr(t *testing.T) {
+	g := newContentBufferForTest()
+	disjuncts := []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:1"}}, Not: []FilterItem{FilterItem{Id: "Org:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:2"}}, Not: []FilterItem{FilterItem{Id: "Org:1"}}},
+	}
+
+	// Docs 1 and 3, and doc 4.
+	result, err := calcDisjunctiveExpr(context.Background(), g, disjuncts, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.DocumentCount())
+
+	// error case: the query is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = calcDisjunctiveExpr(ctx, g, disjuncts, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCalcDisjunctiveExprConcurrently(t *testing.T) {
+	g := newContentBufferForTest()
+	disjuncts := []ConjunctiveExpr{}
+	for _, id := range []string{"Org:1", "Org:2", "Org:1", "Person:9", "Org:2"} {
+		disjuncts = append(disjuncts, ConjunctiveExpr{And: []FilterItem{FilterItem{Id: id}}})
+	}
+
+	for workers := 1; workers <= 8; workers++ {
+		result, err := calcDisjunctiveExprConcurrently(context.Background(), g, disjuncts, workers, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, result.DocumentCount())
+		assert.Equal(t, []int{1, 2, 3}, sortedItems(result.OrgGraph.DocumentIdsForEntity(1)))
+	}
+
+	result, err := calcDisjunctiveExprConcurrently(context.Background(), g, []ConjunctiveExpr{}, 4, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.DocumentCount())
+
+	// error case: a malformed item fails the whole query
+	disjuncts[3].And[0].Id = "Person:abc"
+	_, err = calcDisjunctiveExprConcurrently(context.Background(), g, disjuncts, 4, nil)
+	assert.NotNil(t, err)
+}
+
+func TestCalcDisjunctiveExprConcurrently_leavesBaseBufferUnchanged(t *testing.T) {
+	g := newContentBufferForTest()
+	// Org:99 isn't mentioned, so excluding it leaves g itself as the result of
+	// each disjunct.
+	notOnly := ConjunctiveExpr{Not: []FilterItem{FilterItem{Id: "Org:99"}}}
+
+	for _, disjuncts := range [][]ConjunctiveExpr{{notOnly}, {notOnly, notOnly, notOnly}} {
+		result, err := calcDisjunctiveExprConcurrently(context.Background(), g, disjuncts, 2, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, result.DocumentCount())
+		assert.True(t, result != g)
+
+		result.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: 99}, Orgs: []server.Entity{server.DisplayEntity{Id: 1}}})
+		assert.Equal(t, 4, g.DocumentCount())
+		assert.Equal(t, []int{1, 2, 3}, sortedItems(g.OrgGraph.DocumentIdsForEntity(1)))
+	}
+}
+
+func TestCalcDisjunctiveExpr_explain(t *testing.T) {
+	g := newContentBufferForTest()
+	disjuncts := []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:1"}}, Not: []FilterItem{FilterItem{Id: "Org:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:9"}}},
+	}
+
+	explanation := &QueryExplanation{}
+	_, err := calcDisjunctiveExprConcurrently(context.Background(), g, disjuncts, 2, explanation)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(explanation.Disjuncts)) {
+		steps := explanation.Disjuncts[0].Steps
+		assert.Equal(t, 2, len(steps))
+		assert.Equal(t, QueryStep{Step: "FilterOnEntity", Id: "Org:1", DocumentCount: 3, Duration: steps[0].Duration}, steps[0])
+		assert.Equal(t, QueryStep{Step: "ExcludeEntity", Id: "Org:2", DocumentCount: 2, Duration: steps[1].Duration}, steps[1])
+		assert.Equal(t, 2, explanation.Disjuncts[0].DocumentCount)
+		assert.Equal(t, 0, explanation.Disjuncts[2].DocumentCount)
+	}
+
+	// 3 results are merged in 2 unions.
+	if assert.Equal(t, 2, len(explanation.Unions)) {
+		assert.Equal(t, 4, explanation.Unions[1].DocumentCount)
+	}
+}
+
+func BenchmarkCalcDisjunctiveExpr_serial(b *testing.B) {
+	benchmarkCalcDisjunctiveExpr(b, 1)
+}
+
+func BenchmarkCalcDisjunctiveExpr_parallel(b *testing.B) {
+	benchmarkCalcDisjunctiveExpr(b, maxDisjunctWorkers())
+}
+
+func TestQueryBudget_Check(t *testing.T) {
+	budget := QueryBudget{MaxDisjuncts: 2, MaxConjuncts: 2}
+	disjunct := ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:1"}}}
+	assert.Nil(t, budget.Check(FilterQuery{}))
+	assert.Nil(t, budget.Check(FilterQuery{Or: []ConjunctiveExpr{disjunct, disjunct}}))
+
+	// error case: too many disjuncts
+	err := budget.Check(FilterQuery{Or: []ConjunctiveExpr{disjunct, disjunct, disjunct}})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, 3, err.(*QueryBudgetError).Disjuncts)
+	}
+
+	// error case: too many conjuncts
+	disjunct.Not = []FilterItem{FilterItem{Id: "Org:2"}, FilterItem{Id: "Org:3"}}
+	err = budget.Check(FilterQuery{Or: []ConjunctiveExpr{disjunct}})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, 3, err.(*QueryBudgetError).Conjuncts)
+	}
+}
+
+func TestResolveTimeWindow(t *testing.T) {
+	retained := server.EntityStats{OldestContent: unixtime.Unix(int32(testContentStartTime.Unix()))}
+	now := testContentStartTime.Add(24 * time.Hour)
+	at := func(hours int) *time.Time {
+		t := testContentStartTime.Add(time.Duration(hours) * time.Hour)
+		return &t
+	}
+
+	start, end, err := resolveTimeWindow(FilterQuery{StartTime: at(2), EndTime: at(4)}, retained, now)
+	assert.Nil(t, err)
+	assert.Equal(t, *at(2), start)
+	assert.Equal(t, *at(4), end)
+
+	// Open-ended windows extend to the oldest content, or to now.
+	start, end, err = resolveTimeWindow(FilterQuery{EndTime: at(4)}, retained, now)
+	assert.Nil(t, err)
+	assert.Equal(t, testContentStartTime, start)
+	start, end, err = resolveTimeWindow(FilterQuery{StartTime: at(2)}, retained, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, end)
+
+	// error cases
+	_, _, err = resolveTimeWindow(FilterQuery{StartTime: at(4), EndTime: at(2)}, retained, now)
+	assert.NotNil(t, err)
+	_, _, err = resolveTimeWindow(FilterQuery{StartTime: at(-1), EndTime: at(2)}, retained, now)
+	windowErr, ok := err.(*TimeWindowError)
+	assert.True(t, ok)
+	assert.Equal(t, testContentStartTime, windowErr.RetainedFrom)
+	assert.Equal(t, now, windowErr.RetainedTo)
+	_, _, err = resolveTimeWindow(FilterQuery{StartTime: at(2), EndTime: at(25)}, retained, now)
+	assert.NotNil(t, err)
+	_, _, err = resolveTimeWindow(FilterQuery{TimeRangeInHours: 1, StartTime: at(2)}, retained, now)
+	assert.NotNil(t, err)
+	_, _, err = resolveTimeWindow(FilterQuery{StartTime: at(2)}, server.EntityStats{}, now)
+	assert.NotNil(t, err)
+}
+
+func TestContentInTimeWindow(t *testing.T) {
+	g := newContentBufferForTest()
+	docIndex := newDocumentIndexForTest(g)
+
+	// Doc 5 doesn't mention any entity, so it's only known to the index.
+	entityLess := server.Document{Id: 5, InsertDate: unixtime.Unix(int32(testContentStartTime.Add(5 * time.Hour).Unix()))}
+	g.AddNewsArticle(server.NewsArticle{Document: entityLess})
+	docIndex.AddDocuments([]server.Document{entityLess})
+
+	// Docs 2 and 3, since the end of the window is exclusive.
+	window := contentInTimeWindow(g, docIndex, testContentStartTime.Add(2*time.Hour), testContentStartTime.Add(4*time.Hour))
+	assert.Equal(t, 2, window.DocumentCount())
+	assert.Equal(t, []int{2}, window.OrgGraph.DocumentIdsForEntity(2).Items())
+	assert.Equal(t, 5, g.DocumentCount())
+}
+
+//
+// TEST HELPERS
+//
+
+// Evaluates a query like a large watchlist's (13 disjuncts, each of 1-2 of
+// the most-mentioned entities) against an hour of mock content, on the
+// specified number of workers.
+func benchmarkCalcDisjunctiveExpr(b *testing.B, workers int) {
+	g := server.NewContentBuffer()
+	now := unixtime.Now()
+	for _, newsArticle := range mock.NewMockContentSource().FetchNewsArticles(now.Subtract(time.Hour), now) {
+		g.AddNewsArticle(newsArticle)
+	}
+
+	topOrgs, topPlaces := calcTopEntities(g.OrgGraph, 13), calcTopEntities(g.PlaceGraph, 13)
+	disjuncts := []ConjunctiveExpr{}
+	for i, org := range topOrgs {
+		expr := ConjunctiveExpr{And: []FilterItem{FilterItem{Id: fmt.Sprintf("Org:%v", org.GetId())}}}
+		if i%2 == 1 && i < len(topPlaces) {
+			expr.And = append(expr.And, FilterItem{Id: fmt.Sprintf("Place:%v", topPlaces[i].GetId())})
+		}
+		disjuncts = append(disjuncts, expr)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := calcDisjunctiveExprConcurrently(context.Background(), g, disjuncts, workers, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var testContentStartTime = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+// Creates a content buffer with 4 docs: docs 1-3 mention Org:1, and docs 2
+// and 4 mention Org:2.  Doc n was inserted n hours after testContentStartTime.
+func newContentBufferForTest() *server.ContentBuffer {
+	g := server.NewContentBuffer()
+	orgsByDoc := map[int][]int{1: {1}, 2: {1, 2}, 3: {1}, 4: {2}}
+	for docId, orgIds := range orgsByDoc {
+		orgs := []server.Entity{}
+		for _, orgId := range orgIds {
+			orgs = append(orgs, server.DisplayEntity{Id: orgId})
+		}
+		insertDate := unixtime.Unix(int32(testContentStartTime.Add(time.Duration(docId) * time.Hour).Unix()))
+		g.AddNewsArticle(server.NewsArticle{Document: server.Document{Id: docId, InsertDate: insertDate}, Orgs: orgs})
+	}
+	return g
+}
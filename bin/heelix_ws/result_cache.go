@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Caches the responses of the all_entity_info endpoint, keyed by their
+// (normalized) filter query, so that popular queries (e.g. a shared default
+// watchlist) aren't recalculated for each user.  The cache holds at most
+// maxBytes of keys and responses, evicting the least recently used ones, and
+// is emptied whenever the content buffer changes (see Invalidate).
+type ResultCache struct {
+	lock     sync.Mutex
+	maxBytes int
+	// Size of the cached keys and responses.
+	sizeBytes int
+	// Incremented by each Invalidate(), so that responses calculated from
+	// the previous content aren't cached after it.
+	generation int
+	// Cached entries, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+}
+
+type resultCacheEntry struct {
+	key      string
+	response []byte
+}
+
+// Creates a ResultCache that holds at most maxBytes.  A cache with a
+// maxBytes of 0 doesn't cache anything.
+func NewResultCache(maxBytes int) *ResultCache {
+	return &ResultCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// Returns the cached response for the key, if there is one.  Otherwise, the
+// response should be calculated and passed to Put() along with the returned
+// generation.
+func (me *ResultCache) Get(key string) (response []byte, generation int, found bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	element, found := me.entries[key]
+	if !found {
+		me.misses++
+		return nil, me.generation, false
+	}
+	me.hits++
+	me.lru.MoveToFront(element)
+	return element.Value.(*resultCacheEntry).response, me.generation, true
+}
+
+// Returns true if a response is cached for the key.  Unlike Get(), this
+// doesn't count as a use of the cache.
+func (me *ResultCache) Contains(key string) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	_, found := me.entries[key]
+	return found
+}
+
+// Caches the response for the key, unless the cache has been invalidated
+// since the generation was returned by Get(), or the response is too large
+// to cache.
+func (me *ResultCache) Put(key string, generation int, response []byte) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	size := len(key) + len(response)
+	if generation != me.generation || size > me.maxBytes {
+		return
+	}
+	if element, exists := me.entries[key]; exists {
+		me.removeElement(element)
+	}
+
+	me.entries[key] = me.lru.PushFront(&resultCacheEntry{key: key, response: response})
+	me.sizeBytes += size
+	for me.sizeBytes > me.maxBytes {
+		me.removeElement(me.lru.Back())
+	}
+}
+
+func (me *ResultCache) removeElement(element *list.Element) {
+	entry := me.lru.Remove(element).(*resultCacheEntry)
+	delete(me.entries, entry.key)
+	me.sizeBytes -= len(entry.key) + len(entry.response)
+}
+
+// Empties the cache.  Called whenever the content buffer moves forward,
+// since every cached response is then out of date.
+func (me *ResultCache) Invalidate() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.generation++
+	me.lru.Init()
+	me.entries = map[string]*list.Element{}
+	me.sizeBytes = 0
+}
+
+// The size and effectiveness of a ResultCache, as reported by the system_info
+// endpoint.  HitRate is the fraction of lookups that were hits.
+type ResultCacheStats struct {
+	Entries   int
+	SizeBytes int
+	MaxBytes  int
+	Hits      int64
+	Misses    int64
+	HitRate   float64
+}
+
+func (me *ResultCache) Stats() ResultCacheStats {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	stats := ResultCacheStats{
+		Entries:   len(me.entries),
+		SizeBytes: me.sizeBytes,
+		MaxBytes:  me.maxBytes,
+		Hits:      me.hits,
+		Misses:    me.misses,
+	}
+	if lookups := me.hits + me.misses; lookups > 0 {
+		stats.HitRate = float64(me.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// Returns a copy of the filter query with the entities of each conjunctive
+// expression sorted by id, and the disjuncts sorted, without duplicates of
+// either.  The normalized query selects the same content.
+func normalizeFilterQuery(filterQuery FilterQuery) FilterQuery {
+	normalizeItems := func(items []FilterItem) []FilterItem {
+		seen := map[string]bool{}
+		normalized := []FilterItem{}
+		for _, item := range items {
+			if !seen[item.Id] {
+				seen[item.Id] = true
+				normalized = append(normalized, item)
+			}
+		}
+		sort.Sort(byFilterItemId(normalized))
+		return normalized
+	}
+
+	exprKey := func(expr ConjunctiveExpr) string {
+		ids := []string{}
+		for _, item := range expr.And {
+			ids = append(ids, item.Id)
+		}
+		ids = append(ids, "!")
+		for _, item := range expr.Not {
+			ids = append(ids, item.Id)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	disjuncts := map[string]ConjunctiveExpr{}
+	keys := []string{}
+	for _, expr := range filterQuery.Or {
+		normalized := ConjunctiveExpr{And: normalizeItems(expr.And)}
+		if len(expr.Not) > 0 {
+			normalized.Not = normalizeItems(expr.Not)
+		}
+		key := exprKey(normalized)
+		if _, exists := disjuncts[key]; !exists {
+			disjuncts[key] = normalized
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	normalized := filterQuery
+	if filterQuery.Or != nil {
+		normalized.Or = []ConjunctiveExpr{}
+		for _, key := range keys {
+			normalized.Or = append(normalized.Or, disjuncts[key])
+		}
+	}
+	return normalized
+}
+
+// Sorts filter items by id.
+type byFilterItemId []FilterItem
+
+func (a byFilterItemId) Len() int           { return len(a) }
+func (a byFilterItemId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byFilterItemId) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+// Returns the result cache key of the (normalized) filter query and news
+// page request.  Queries that differ only in their entities' labels, their
+// source order or their keyword whitespace share a key.
+func resultCacheKey(filterQuery FilterQuery, newsPageRequest *NewsPageRequest) string {
+	disjuncts := []ConjunctiveExpr{}
+	for _, expr := range filterQuery.Or {
+		disjuncts = append(disjuncts, ConjunctiveExpr{And: withoutLabels(expr.And), Not: withoutLabels(expr.Not)})
+	}
+	filterQuery.Or = disjuncts
+	normalizeSources := func(sources []string) []string {
+		normalized := []string{}
+		for _, source := range sources {
+			normalized = append(normalized, normalizeSource(source))
+		}
+		sort.Strings(normalized)
+		return normalized
+	}
+	filterQuery.Sources = normalizeSources(filterQuery.Sources)
+	filterQuery.ExcludedSources = normalizeSources(filterQuery.ExcludedSources)
+	filterQuery.Keywords = strings.Join(strings.Fields(filterQuery.Keywords), " ")
+	if filterQuery.StartTime != nil {
+		startTime := filterQuery.StartTime.UTC()
+		filterQuery.StartTime = &startTime
+	}
+	if filterQuery.EndTime != nil {
+		endTime := filterQuery.EndTime.UTC()
+		filterQuery.EndTime = &endTime
+	}
+	if filterQuery.TopN == defaultTopN {
+		filterQuery.TopN = 0
+	}
+	if bucket, err := filterQuery.TrendBucketDuration(); err == nil {
+		filterQuery.TrendBucket = bucket.String()
+	}
+
+	b, _ := json.Marshal(struct {
+		Query FilterQuery
+		Page  *NewsPageRequest
+	}{filterQuery, newsPageRequest})
+	return string(b)
+}
+
+func withoutLabels(items []FilterItem) []FilterItem {
+	if items == nil {
+		return nil
+	}
+	unlabeled := []FilterItem{}
+	for _, item := range items {
+		unlabeled = append(unlabeled, FilterItem{Id: item.Id})
+	}
+	return unlabeled
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestResultCache(t *testing.T) {
+	resultCache := NewResultCache(20)
+
+	_, generation, found := resultCache.Get("a")
+	assert.False(t, found)
+	resultCache.Put("a", generation, []byte("111111111"))
+	response, _, found := resultCache.Get("a")
+	assert.True(t, found)
+	assert.Equal(t, "111111111", string(response))
+
+	// Adding "c" evicts "b", the least recently used entry.
+	resultCache.Put("b", generation, []byte("222222222"))
+	resultCache.Get("a")
+	resultCache.Put("c", generation, []byte("333333333"))
+	_, _, found = resultCache.Get("b")
+	assert.False(t, found)
+	_, _, found = resultCache.Get("a")
+	assert.True(t, found)
+
+	// Responses that are too large aren't cached.
+	resultCache.Put("d", generation, []byte("this response is too large"))
+	_, _, found = resultCache.Get("d")
+	assert.False(t, found)
+
+	stats := resultCache.Stats()
+	assert.Equal(t, ResultCacheStats{Entries: 2, SizeBytes: 20, MaxBytes: 20, Hits: 3, Misses: 3, HitRate: 0.5}, stats)
+}
+
+func TestResultCache_Invalidate(t *testing.T) {
+	resultCache := NewResultCache(100)
+	_, generation, _ := resultCache.Get("a")
+	resultCache.Put("a", generation, []byte("1"))
+
+	resultCache.Invalidate()
+	_, _, found := resultCache.Get("a")
+	assert.False(t, found)
+	assert.Equal(t, 0, resultCache.Stats().SizeBytes)
+
+	// A response calculated before the invalidation isn't cached after it.
+	resultCache.Put("a", generation, []byte("1"))
+	_, _, found = resultCache.Get("a")
+	assert.False(t, found)
+}
+
+func TestNormalizeFilterQuery(t *testing.T) {
+	filterQuery := FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:2"}, FilterItem{Id: "Org:1"}, FilterItem{Id: "Person:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}, Not: []FilterItem{FilterItem{Id: "Org:4"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:1"}, FilterItem{Id: "Person:2"}}},
+	}}
+
+	normalized := normalizeFilterQuery(filterQuery)
+	assert.Equal(t, "Org:1,Person:2|Place:3!Org:4", dnfString(normalized))
+	assert.Equal(t, "Person:2", filterQuery.Or[0].And[0].Id)
+
+	// Equivalent queries share a cache key.
+	equivalentQuery := FilterQuery{
+		Sources: []string{"bbc news", "Reuters"},
+		Or: []ConjunctiveExpr{
+			ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}, Not: []FilterItem{FilterItem{Id: "Org:4", Label: "Acme"}}},
+			ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:2"}, FilterItem{Id: "Org:1"}}},
+		},
+	}
+	filterQuery.Sources = []string{"Reuters", "BBC News"}
+	assert.Equal(t, resultCacheKey(normalizeFilterQuery(filterQuery), nil), resultCacheKey(normalizeFilterQuery(equivalentQuery), nil))
+	assert.Equal(t, "Acme", equivalentQuery.Or[0].Not[0].Label)
+
+	filterQuery.TimeRangeInHours = 8
+	assert.NotEqual(t, resultCacheKey(normalizeFilterQuery(filterQuery), nil), resultCacheKey(normalizeFilterQuery(equivalentQuery), nil))
+	assert.NotEqual(t, resultCacheKey(equivalentQuery, nil), resultCacheKey(equivalentQuery, &NewsPageRequest{Limit: 10, Sort: NewestFirst}))
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	migrate "qbase/synthos/heelix_ws/datamigrate"
+	server "qbase/synthos/synthos_svr"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the directory (within AppConfig.DataDir) that holds the data snapshots.
+const snapshotsDirName = "snapshots"
+
+// Name of the file within each snapshot directory that describes its contents.
+const snapshotManifestFileName = "manifest.json"
+
+// Snapshot directories are named after the (UTC) time they were created.
+const snapshotNameFormat = "20060102T150405.000Z"
+
+// Identifies which of the application's save operations wrote a given file
+// into a snapshot.
+const (
+	globalDataKind = "global" // content buffer and entity DAOs (see SaveGlobalData)
+	userDataKind   = "user"   // user db (see SaveUserData)
+)
+
+var dataKinds = []string{globalDataKind, userDataKind}
+
+// Describes a single file within a snapshot.
+type SnapshotFile struct {
+	// Path of the file, relative to the snapshot directory.
+	Name string
+	// Which save operation wrote this file (globalDataKind or userDataKind).
+	Kind   string
+	Size   int64
+	SHA256 string
+}
+
+// Describes the contents of a snapshot directory.  Written to the snapshot's
+// manifest.json file.
+type SnapshotManifest struct {
+	Name      string
+	CreatedAt time.Time
+	// If this snapshot was created by restoring an older one, this is the name
+	// of the older snapshot.
+	RestoredFrom string `json:",omitempty"`
+	Files        []SnapshotFile
+}
+
+// Returns true if the snapshot contains files written by the specified kind
+// of save operation.
+func (me *SnapshotManifest) Contains(kind string) bool {
+	for _, f := range me.Files {
+		if f.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// A point-in-time copy of the application's persisted data.
+type Snapshot struct {
+	Name string
+	Dir  string
+}
+
+// Manages the timestamped snapshot directories under <DataDir>/snapshots.
+// Every save creates a new, complete snapshot: files written by the save go
+// into a fresh directory, and files of the other kind are carried forward
+// (hard-linked) from the previous snapshot or, if it has none, from the
+// legacy data saved directly in DataDir.  Old snapshots are pruned after
+// each save, keeping the most recent keepLast snapshots plus the newest
+// snapshot of each of the last keepDays days.
+type SnapshotStore struct {
+	dataDir  string
+	rootDir  string
+	keepLast int
+	keepDays int
+	lock     sync.Mutex
+
+	// Returns the current time.  Tests may override this.
+	now func() time.Time
+}
+
+// Creates a SnapshotStore that keeps its snapshots under <dataDir>/snapshots.
+func NewSnapshotStore(dataDir string, keepLast int, keepDays int) *SnapshotStore {
+	return &SnapshotStore{
+		dataDir:  dataDir,
+		rootDir:  filepath.Join(dataDir, snapshotsDirName),
+		keepLast: keepLast,
+		keepDays: keepDays,
+		now:      time.Now,
+	}
+}
+
+// Creates a new snapshot.  The write func is expected to write all files of
+// the specified kind into the directory it's given.
+func (me *SnapshotStore) Save(kind string, write func(dir string) error) (Snapshot, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	var previous *SnapshotManifest
+	if latest, exists := me.latest(); exists {
+		manifest, err := readSnapshotManifest(latest.Dir)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		previous = &manifest
+	}
+
+	snapshot, err := me.create(func(stagingDir string, manifest *SnapshotManifest) error {
+		if err := write(stagingDir); err != nil {
+			return err
+		}
+		if err := manifest.addFiles(stagingDir, kind); err != nil {
+			return err
+		}
+
+		// Carry forward the files of every other kind, so that this snapshot is
+		// complete on its own.  Once a snapshot exists, the legacy data in the
+		// data directory is no longer loaded, so the first snapshot after an
+		// upgrade (or any snapshot without the other kind) takes it from there.
+		for _, otherKind := range dataKinds {
+			if otherKind == kind {
+				continue
+			}
+			if previous != nil && previous.Contains(otherKind) {
+				for _, f := range previous.Files {
+					isOverwritten := server.FileExists(filepath.Join(stagingDir, f.Name))
+					if f.Kind == otherKind && !isOverwritten {
+						if err := linkOrCopyFile(filepath.Join(me.rootDir, previous.Name, f.Name), filepath.Join(stagingDir, f.Name)); err != nil {
+							return err
+						}
+						manifest.Files = append(manifest.Files, f)
+					}
+				}
+				continue
+			}
+
+			names, err := legacyDataFiles(me.dataDir, otherKind)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if server.FileExists(filepath.Join(stagingDir, name)) {
+					continue
+				}
+				logger.Printf("Carrying forward legacy %v data file %v into the snapshot", otherKind, name)
+				if err := linkOrCopyFile(filepath.Join(me.dataDir, name), filepath.Join(stagingDir, name)); err != nil {
+					return err
+				}
+				if err := manifest.addFile(stagingDir, name, otherKind); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if err := me.prune(); err != nil {
+		logger.Printf("WARN: error pruning old snapshots in %v: %v", me.rootDir, err)
+	}
+
+	return snapshot, nil
+}
+
+// Creates a new snapshot whose content is identical to the named snapshot,
+// making it the latest snapshot.  This way, subsequent saves build on the
+// restored data rather than on whatever was saved most recently.
+func (me *SnapshotStore) Restore(name string) (Snapshot, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	source, err := me.find(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := verifySnapshot(source); err != nil {
+		return Snapshot{}, err
+	}
+	sourceManifest, err := readSnapshotManifest(source.Dir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return me.create(func(stagingDir string, manifest *SnapshotManifest) error {
+		manifest.RestoredFrom = sourceManifest.Name
+		for _, f := range sourceManifest.Files {
+			if err := linkOrCopyFile(filepath.Join(source.Dir, f.Name), filepath.Join(stagingDir, f.Name)); err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, f)
+		}
+		return nil
+	})
+}
+
+// Migrates the global data of the latest snapshot (or, if there are no
+// snapshots, of the legacy data directory) with the migrate func, and saves
+// the result as a new snapshot.  Snapshot files are shared with older
+// snapshots, so they're migrated in a private, decrypted working copy rather
+// than in place, and encrypted again with the keyring's active key when
+// they're saved.  Returns false if migrate found nothing to migrate.
+func (me *SnapshotStore) MigrateLatest(keyring *Keyring, migrate func(dataDir string) bool) (Snapshot, bool, error) {
+	sourceDir := me.dataDir
+	var names []string
+	var err error
+	if latest, exists := me.Latest(); exists {
+		sourceDir = latest.Dir
+		manifest, err := readSnapshotManifest(latest.Dir)
+		if err != nil {
+			return Snapshot{}, false, err
+		}
+		for _, f := range manifest.Files {
+			if f.Kind == globalDataKind {
+				names = append(names, f.Name)
+			}
+		}
+	} else if names, err = legacyDataFiles(me.dataDir, globalDataKind); err != nil {
+		return Snapshot{}, false, err
+	}
+	logger.Printf("Migrating the global data in %v", sourceDir)
+
+	decryptedDir, cleanup, err := keyring.DecryptedDir(sourceDir)
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	defer cleanup()
+
+	workDir, err := ioutil.TempDir("", "heelix_migrate")
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	defer os.RemoveAll(workDir)
+
+	versionFileName := "version.txt"
+	for _, name := range append(names, versionFileName) {
+		err := copyFile(filepath.Join(decryptedDir, name), filepath.Join(workDir, name))
+		if err != nil && !(name == versionFileName && os.IsNotExist(err)) {
+			return Snapshot{}, false, err
+		}
+	}
+
+	if !migrate(workDir) {
+		return Snapshot{}, false, nil
+	}
+
+	snapshot, err := me.Save(globalDataKind, func(dir string) error {
+		err := walkDataFiles(workDir, func(path string, name string) error {
+			// The new snapshot is stamped with the current data version.
+			if name == versionFileName {
+				return nil
+			}
+			return copyFile(path, filepath.Join(dir, name))
+		})
+		if err != nil {
+			return err
+		}
+		return keyring.EncryptFilesInDir(dir)
+	})
+	return snapshot, err == nil, err
+}
+
+// Returns the most recent snapshot, if there is one.
+func (me *SnapshotStore) Latest() (Snapshot, bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.latest()
+}
+
+// Returns all snapshots, newest first.
+func (me *SnapshotStore) List() ([]Snapshot, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.list()
+}
+
+// Returns the directory from which application data should be loaded at
+// startup.  If restoreName is non-empty, the named snapshot is restored (see
+// Restore()) and used.  Otherwise the latest snapshot is used, falling back
+// to legacyDataDir for data saved before snapshots were introduced.
+func (me *SnapshotStore) ResolveLoadDir(restoreName string, legacyDataDir string) (string, error) {
+	if restoreName != "" {
+		logger.Printf("Restoring data snapshot '%v'", restoreName)
+		snapshot, err := me.Restore(restoreName)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Error restoring snapshot '%v': %v", restoreName, err))
+		}
+		return snapshot.Dir, nil
+	}
+
+	if snapshot, exists := me.Latest(); exists {
+		return snapshot.Dir, nil
+	}
+
+	return legacyDataDir, nil
+}
+
+// Creates a new snapshot directory by way of a staging directory that the
+// populate func fills with files and manifest entries.  The staging directory
+// is only renamed into place once it's complete, so a failed or interrupted
+// save never leaves behind a partial snapshot.
+func (me *SnapshotStore) create(populate func(stagingDir string, manifest *SnapshotManifest) error) (snapshot Snapshot, err error) {
+	createdAt := me.now().UTC()
+	name := me.uniqueName(createdAt)
+
+	stagingDir := filepath.Join(me.rootDir, ".staging-"+name)
+	if err = os.MkdirAll(stagingDir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			os.RemoveAll(stagingDir)
+			panic(r)
+		}
+		if err != nil {
+			os.RemoveAll(stagingDir)
+		}
+	}()
+
+	manifest := SnapshotManifest{Name: name, CreatedAt: createdAt, Files: []SnapshotFile{}}
+	if err = populate(stagingDir, &manifest); err != nil {
+		return Snapshot{}, err
+	}
+
+	// Snapshots carry their own data version stamp, which the migration tool
+	// checks (see MigrateLatest).
+	versionFilePath := filepath.Join(stagingDir, "version.txt")
+	if !server.FileExists(versionFilePath) {
+		migrate.WriteDataVersion(stagingDir)
+	}
+
+	if err = writeSnapshotManifest(stagingDir, manifest); err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshotDir := filepath.Join(me.rootDir, name)
+	if err = os.Rename(stagingDir, snapshotDir); err != nil {
+		return Snapshot{}, err
+	}
+
+	logger.Printf("Created data snapshot %v (%v files)", snapshotDir, len(manifest.Files))
+	return Snapshot{Name: name, Dir: snapshotDir}, nil
+}
+
+// Returns a snapshot name for the specified time that isn't already in use.
+func (me *SnapshotStore) uniqueName(t time.Time) string {
+	name := t.Format(snapshotNameFormat)
+	for i := 2; server.FileExists(filepath.Join(me.rootDir, name)); i++ {
+		name = fmt.Sprintf("%v-%v", t.Format(snapshotNameFormat), i)
+	}
+	return name
+}
+
+func (me *SnapshotStore) latest() (Snapshot, bool) {
+	snapshots, err := me.list()
+	if err != nil || len(snapshots) == 0 {
+		return Snapshot{}, false
+	}
+	return snapshots[0], true
+}
+
+func (me *SnapshotStore) find(name string) (Snapshot, error) {
+	snapshots, err := me.list()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, errors.New(fmt.Sprintf("Snapshot '%v' doesn't exist in %v", name, me.rootDir))
+}
+
+func (me *SnapshotStore) list() ([]Snapshot, error) {
+	if !server.FileExists(me.rootDir) {
+		return []Snapshot{}, nil
+	}
+
+	entries, err := ioutil.ReadDir(me.rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, entry := range entries {
+		isSnapshotDir := entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") &&
+			server.FileExists(filepath.Join(me.rootDir, entry.Name(), snapshotManifestFileName))
+		if isSnapshotDir {
+			snapshots = append(snapshots, Snapshot{Name: entry.Name(), Dir: filepath.Join(me.rootDir, entry.Name())})
+		}
+	}
+
+	// Snapshot names sort chronologically.
+	sort.Sort(sort.Reverse(byName(snapshots)))
+	return snapshots, nil
+}
+
+// Deletes the snapshots that fall outside of the retention policy.
+func (me *SnapshotStore) prune() error {
+	snapshots, err := me.list()
+	if err != nil {
+		return err
+	}
+
+	now := me.now().UTC()
+	oldestDayToKeep := now.AddDate(0, 0, -me.keepDays).Format("20060102")
+	keptDays := map[string]bool{}
+
+	for i, snapshot := range snapshots {
+		day := snapshot.Name[:len("20060102")]
+		isRecent := i < me.keepLast
+		isNewestOfRetainedDay := day > oldestDayToKeep && !keptDays[day]
+		keptDays[day] = true
+
+		if !isRecent && !isNewestOfRetainedDay {
+			logger.Printf("Pruning data snapshot %v", snapshot.Dir)
+			if err := os.RemoveAll(snapshot.Dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Verifies that every file listed in the snapshot's manifest is present and
+// has the expected size and checksum.
+func verifySnapshot(snapshot Snapshot) error {
+	manifest, err := readSnapshotManifest(snapshot.Dir)
+	if err != nil {
+		return err
+	}
+
+	corruptFiles := findCorruptFiles(snapshot.Dir, manifest, "")
+	if len(corruptFiles) > 0 {
+		return errors.New(fmt.Sprintf("Snapshot %v: checksum mismatch for %v", snapshot.Name, strings.Join(corruptFiles, ", ")))
+	}
+	return nil
+}
+
+// Returns the names of the snapshot's files (of the specified kind, or of
+// every kind if kind is empty) that are missing or don't have the size and
+// checksum listed in the manifest.
+func findCorruptFiles(snapshotDir string, manifest SnapshotManifest, kind string) []string {
+	corruptFiles := []string{}
+	for _, f := range manifest.Files {
+		if kind != "" && f.Kind != kind {
+			continue
+		}
+		size, checksum, err := checksumFile(filepath.Join(snapshotDir, f.Name))
+		if err != nil || size != f.Size || checksum != f.SHA256 {
+			corruptFiles = append(corruptFiles, f.Name)
+		}
+	}
+	return corruptFiles
+}
+
+// Moves the named files out of the snapshot and into destDir, and removes
+// them from the snapshot's manifest.  The snapshot remains valid, but no
+// longer contains the moved files.
+func (me *SnapshotStore) RemoveFiles(snapshotDir string, names []string, destDir string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	manifest, err := readSnapshotManifest(snapshotDir)
+	if err != nil {
+		return err
+	}
+
+	removed := map[string]bool{}
+	for _, name := range names {
+		if err := moveFile(filepath.Join(snapshotDir, name), filepath.Join(destDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed[name] = true
+	}
+
+	remainingFiles := []SnapshotFile{}
+	for _, f := range manifest.Files {
+		if !removed[f.Name] {
+			remainingFiles = append(remainingFiles, f)
+		}
+	}
+	manifest.Files = remainingFiles
+	return writeSnapshotManifest(snapshotDir, manifest)
+}
+
+// Moves the entire snapshot directory into destDir.
+func (me *SnapshotStore) RemoveSnapshot(snapshotDir string, destDir string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return moveFile(snapshotDir, filepath.Join(destDir, filepath.Base(snapshotDir)))
+}
+
+// Returns true if the directory contains data of the specified kind (i.e.
+// data saved by SaveGlobalData or SaveUserData).  Directories that aren't
+// snapshots are checked for legacy data files (see legacyDataFiles).
+func containsData(dataDir string, kind string) bool {
+	if manifest, err := readSnapshotManifest(dataDir); err == nil {
+		return manifest.Contains(kind)
+	}
+	names, err := legacyDataFiles(dataDir, kind)
+	return err == nil && len(names) > 0
+}
+
+// Adds a manifest entry for each file under dir.
+func (me *SnapshotManifest) addFiles(dir string, kind string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return me.addFile(dir, name, kind)
+	})
+}
+
+// Adds a manifest entry for the named file (relative to dir).
+func (me *SnapshotManifest) addFile(dir string, name string, kind string) error {
+	size, checksum, err := checksumFile(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	me.Files = append(me.Files, SnapshotFile{Name: name, Kind: kind, Size: size, SHA256: checksum})
+	return nil
+}
+
+// Returns the names of the files of the specified kind that were saved
+// directly in the data directory, before snapshots were introduced.
+func legacyDataFiles(dataDir string, kind string) ([]string, error) {
+	if !server.FileExists(dataDir) {
+		return []string{}, nil
+	}
+	if kind == userDataKind {
+		if server.FileExists(filepath.Join(dataDir, userDataFileName)) {
+			return []string{userDataFileName}, nil
+		}
+		return []string{}, nil
+	}
+	return legacyGlobalDataFiles(dataDir)
+}
+
+func readSnapshotManifest(snapshotDir string) (SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	b, err := ioutil.ReadFile(filepath.Join(snapshotDir, snapshotManifestFileName))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(b, &manifest)
+	return manifest, err
+}
+
+func writeSnapshotManifest(snapshotDir string, manifest SnapshotManifest) error {
+	b, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(snapshotDir, snapshotManifestFileName), b, 0644)
+}
+
+// Returns the size and hex-encoded SHA-256 checksum of the file's content.
+func checksumFile(filePath string) (size int64, checksum string, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err = io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Hard-links src to dest, falling back to a plain copy if the filesystem
+// doesn't support hard links.  Snapshot files are never modified once the
+// snapshot has been created, so sharing them between snapshots is safe.
+func linkOrCopyFile(src string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+// Copies src to dest, creating dest's parent directory if needed.
+func copyFile(src string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// Moves (renames) src to dest, creating dest's parent directory if needed.
+func moveFile(src string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	return os.Rename(src, dest)
+}
+
+type byName []Snapshot
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStore_Save(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	// A user data save followed by a global data save...
+	userSnapshot, err := store.Save(userDataKind, writeTestFile("user_data.json", "users-v1"))
+	assert.Nil(t, err)
+	store.now = advanceClock(store.now, time.Minute)
+	globalSnapshot, err := store.Save(globalDataKind, writeTestFile("docs.dat", "docs-v1"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, userSnapshot.Name, globalSnapshot.Name)
+
+	// ...results in a latest snapshot that contains both, with the user data
+	// carried forward from the previous snapshot.
+	latest, exists := store.Latest()
+	assert.True(t, exists)
+	assert.Equal(t, globalSnapshot, latest)
+	assert.Equal(t, "users-v1", readTestFile(t, latest.Dir, "user_data.json"))
+	assert.Equal(t, "docs-v1", readTestFile(t, latest.Dir, "docs.dat"))
+	assert.True(t, containsData(latest.Dir, globalDataKind))
+	assert.True(t, containsData(latest.Dir, userDataKind))
+	assert.False(t, containsData(userSnapshot.Dir, globalDataKind))
+	assert.Nil(t, verifySnapshot(latest))
+
+	// The original snapshot is untouched.
+	assert.Equal(t, "users-v1", readTestFile(t, userSnapshot.Dir, "user_data.json"))
+	assert.False(t, fileExists(filepath.Join(userSnapshot.Dir, "docs.dat")))
+}
+
+func TestSnapshotStore_Save_failedWrite(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	_, err := store.Save(userDataKind, func(dir string) error {
+		return errors.New("disk full")
+	})
+	assert.NotNil(t, err)
+
+	// No snapshot, and no staging directory left behind.
+	_, exists := store.Latest()
+	assert.False(t, exists)
+	entries, _ := ioutil.ReadDir(filepath.Join(dataDir, snapshotsDirName))
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestVerifySnapshot_detectsCorruption(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	snapshot, _ := store.Save(userDataKind, writeTestFile("user_data.json", "users-v1"))
+	assert.Nil(t, verifySnapshot(snapshot))
+
+	ioutil.WriteFile(filepath.Join(snapshot.Dir, "user_data.json"), []byte("users-XX"), 0644)
+	assert.NotNil(t, verifySnapshot(snapshot))
+}
+
+func TestSnapshotStore_Restore(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	v1, _ := store.Save(userDataKind, writeTestFile("user_data.json", "users-v1"))
+	store.now = advanceClock(store.now, time.Minute)
+	store.Save(userDataKind, writeTestFile("user_data.json", "users-v2"))
+	store.now = advanceClock(store.now, time.Minute)
+
+	loadDir, err := store.ResolveLoadDir(v1.Name, dataDir)
+	assert.Nil(t, err)
+	assert.Equal(t, "users-v1", readTestFile(t, loadDir, "user_data.json"))
+
+	// The restored snapshot is now the latest one.
+	latest, _ := store.Latest()
+	assert.Equal(t, loadDir, latest.Dir)
+	manifest, _ := readSnapshotManifest(latest.Dir)
+	assert.Equal(t, v1.Name, manifest.RestoredFrom)
+
+	_, err = store.ResolveLoadDir("no-such-snapshot", dataDir)
+	assert.NotNil(t, err)
+}
+
+func TestSnapshotStore_ResolveLoadDir_legacy(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+
+	// No snapshots yet, so data is loaded straight from the data directory.
+	loadDir, err := store.ResolveLoadDir("", dataDir)
+	assert.Nil(t, err)
+	assert.Equal(t, dataDir, loadDir)
+}
+
+func TestSnapshotStore_prune(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 2, 3)
+	defer os.RemoveAll(dataDir)
+
+	// Two snapshots per day over 5 days.
+	for day := 0; day < 5; day++ {
+		store.Save(userDataKind, writeTestFile("user_data.json", "morning"))
+		store.now = advanceClock(store.now, 12*time.Hour)
+		store.Save(userDataKind, writeTestFile("user_data.json", "evening"))
+		store.now = advanceClock(store.now, 12*time.Hour)
+	}
+
+	snapshots, _ := store.List()
+	names := []string{}
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+
+	// The 2 most recent snapshots, plus the newest of each of the 2 days before.
+	assert.Equal(t, []string{
+		"20261005T120000.000Z",
+		"20261005T000000.000Z",
+		"20261004T120000.000Z",
+		"20261003T120000.000Z",
+	}, names)
+}
+
+func TestSnapshotStore_MigrateLatest(t *testing.T) {
+	store, dataDir := newSnapshotStoreForTest(t, 10, 7)
+	defer os.RemoveAll(dataDir)
+	keyring := newKeyringForTest(t, testKey1)
+
+	original, _ := store.Save(globalDataKind, func(dir string) error {
+		writeTestFile("personGraph.dat", "graph-v0")(dir)
+		return keyring.EncryptFilesInDir(dir)
+	})
+	store.now = advanceClock(store.now, time.Minute)
+	store.Save(userDataKind, writeTestFile("user_data.json", "users-v1"))
+	store.now = advanceClock(store.now, time.Minute)
+
+	// The migration sees a decrypted copy of the latest global data.
+	snapshot, migrated, err := store.MigrateLatest(keyring, func(dir string) bool {
+		assert.Equal(t, "graph-v0", readTestFile(t, dir, "personGraph.dat"))
+		assert.True(t, fileExists(filepath.Join(dir, "version.txt")))
+		assert.False(t, fileExists(filepath.Join(dir, "user_data.json")))
+		writeTestFile("personGraph.dat", "graph-v1")(dir)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+
+	// The migrated data is saved, encrypted, as the latest snapshot, and the
+	// original snapshot is untouched.
+	latest, _ := store.Latest()
+	assert.Equal(t, snapshot, latest)
+	assert.Nil(t, verifySnapshot(latest))
+	b, err := keyring.ReadFile(filepath.Join(latest.Dir, "personGraph.dat"))
+	assert.Nil(t, err)
+	assert.Equal(t, "graph-v1", string(b))
+	isEncrypted, _ := isEncryptedFile(filepath.Join(latest.Dir, "personGraph.dat"))
+	assert.True(t, isEncrypted)
+	assert.Equal(t, "users-v1", readTestFile(t, latest.Dir, "user_data.json"))
+	b, _ = keyring.ReadFile(filepath.Join(original.Dir, "personGraph.dat"))
+	assert.Equal(t, "graph-v0", string(b))
+
+	// Nothing to migrate, so no new snapshot.
+	_, migrated, err = store.MigrateLatest(keyring, func(dir string) bool { return false })
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+	latest, _ = store.Latest()
+	assert.Equal(t, snapshot, latest)
+}
+
+//
+// TEST HELPERS
+//
+
+func newSnapshotStoreForTest(t *testing.T, keepLast int, keepDays int) (*SnapshotStore, string) {
+	dataDir, err := ioutil.TempDir("", "heelix_snapshots")
+	assert.Nil(t, err)
+
+	store := NewSnapshotStore(dataDir, keepLast, keepDays)
+	startTime := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return startTime }
+	return store, dataDir
+}
+
+func advanceClock(now func() time.Time, d time.Duration) func() time.Time {
+	t := now().Add(d)
+	return func() time.Time { return t }
+}
+
+func writeTestFile(name string, content string) func(dir string) error {
+	return func(dir string) error {
+		return ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+}
+
+func readTestFile(t *testing.T, dir string, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"qbase/synthos/synthos_core/unixtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format of the day keys in UserActivity.Days, and of the date-range filters
+// accepted by the usage analytics endpoint.
+const activityDayFormat = "2006-01-02"
+
+// Endpoint name under which dashboard queries were counted (see TrackUsage)
+// before they were recorded as DailyActivity.EntityInfoQueries, which is
+// still how they're counted on the days recorded before then.
+const entityInfoEndpoint = "POST /api/all_entity_info"
+
+// Default number of watchlists listed in each user's UsageAnalytics.
+const defaultTopWatchListCount = 5
+
+// Records how a user has been using the app.  Activity is bucketed by (UTC)
+// day, so that it can be aggregated over arbitrary date ranges.
+type UserActivity struct {
+	LastActivity unixtime.Time
+	// Keyed by day, in activityDayFormat.
+	Days map[string]*DailyActivity
+}
+
+// A user's activity on a single day.
+type DailyActivity struct {
+	// Number of requests, keyed by endpoint (e.g. "GET /api/watchlists").
+	Requests map[string]int
+	// Number of dashboard queries filtered by each watchlist, keyed by
+	// watchlist id.
+	WatchListUses map[int]int `json:",omitempty"`
+	// Number of dashboard queries, whichever endpoint ran them (see
+	// RecordEntityInfoQuery).
+	EntityInfoQueries int `json:",omitempty"`
+}
+
+// Returns the activity for the specified day, creating it if necessary.
+func (me *UserActivity) day(t time.Time) *DailyActivity {
+	if me.Days == nil {
+		me.Days = map[string]*DailyActivity{}
+	}
+
+	key := t.UTC().Format(activityDayFormat)
+	daily, exists := me.Days[key]
+	if !exists {
+		daily = &DailyActivity{Requests: map[string]int{}}
+		me.Days[key] = daily
+	}
+	return daily
+}
+
+// Counts a request to the specified endpoint, made at time t.
+func (me *UserDb) RecordRequest(userId int, endpoint string, t time.Time) {
+	me.updateActivity(userId, func(activity *UserActivity) {
+		activity.LastActivity = unixtime.Unix(int32(t.Unix()))
+		activity.day(t).Requests[endpoint]++
+	})
+}
+
+// Counts a dashboard query (e.g. of all_entity_info, a watchlist's results or
+// a comparison) made at time t.
+func (me *UserDb) RecordEntityInfoQuery(userId int, t time.Time) {
+	me.updateActivity(userId, func(activity *UserActivity) {
+		activity.day(t).EntityInfoQueries++
+	})
+}
+
+// Counts a use of the user's watchlist whose filter matches the filter
+// query, if there is one.  Watchlists are run by posting their filter to the
+// all_entity_info endpoint, so this is how watchlist usage is detected.
+func (me *UserDb) RecordFilterUse(userId int, filterQuery FilterQuery, t time.Time) {
+	if !filterQuery.IsEntityFilterSpecified() {
+		return
+	}
+
+	filterKey := entityFilterKey(filterQuery)
+	me.updateActivity(userId, func(activity *UserActivity) {
+		user := me.findUserBy(func(u *User) bool { return u.Id == userId })
+		for _, watchList := range user.WatchLists {
+			if entityFilterKey(watchList.Filter) == filterKey {
+				daily := activity.day(t)
+				if daily.WatchListUses == nil {
+					daily.WatchListUses = map[int]int{}
+				}
+				daily.WatchListUses[watchList.Id]++
+				return
+			}
+		}
+	})
+}
+
+// Applies the update func to the specified user's activity.  Does nothing if
+// the user doesn't exist.
+func (me *UserDb) updateActivity(userId int, update func(activity *UserActivity)) {
+	me.activityLock.Lock()
+	defer me.activityLock.Unlock()
+
+	user := me.findUserBy(func(u *User) bool { return u.Id == userId })
+	if user == nil {
+		return
+	}
+	if user.Activity == nil {
+		user.Activity = &UserActivity{}
+	}
+	update(user.Activity)
+}
+
+// Returns a copy of the users in which each user's activity is reduced to
+// its LastActivity.  The copy is taken under the activityLock, so that it may
+// be read while requests are being recorded.
+func (me *UserDb) usersWithLastActivity() []User {
+	me.activityLock.Lock()
+	defer me.activityLock.Unlock()
+
+	users := make([]User, len(me.users))
+	for i, user := range me.users {
+		if user.Activity != nil {
+			user.Activity = &UserActivity{LastActivity: user.Activity.LastActivity}
+		}
+		users[i] = user
+	}
+	return users
+}
+
+// Returns a key that's identical for filter queries that select the same
+// entities, keywords, sources and areas, regardless of the order of their disjuncts and
+// conjuncts, and of their time range and labels.
+func entityFilterKey(filterQuery FilterQuery) string {
+	disjuncts := []string{}
+	for _, expr := range filterQuery.Or {
+		conjuncts := []string{}
+		for _, item := range expr.And {
+			conjuncts = append(conjuncts, item.Id)
+		}
+		for _, item := range expr.Not {
+			conjuncts = append(conjuncts, "!"+item.Id)
+		}
+		sort.Strings(conjuncts)
+		disjuncts = append(disjuncts, strings.Join(conjuncts, "&"))
+	}
+	sort.Strings(disjuncts)
+	key := strings.Join(disjuncts, "|")
+	if filterQuery.IsKeywordFilterSpecified() {
+		key += "?" + strings.ToLower(strings.Join(strings.Fields(filterQuery.Keywords), " "))
+	}
+	sources := []string{}
+	for _, source := range filterQuery.Sources {
+		sources = append(sources, "+"+normalizeSource(source))
+	}
+	for _, source := range filterQuery.ExcludedSources {
+		sources = append(sources, "-"+normalizeSource(source))
+	}
+	if len(sources) > 0 {
+		sort.Strings(sources)
+		key += "@" + strings.Join(sources, ",")
+	}
+	if filterQuery.GeoBoundingBox != nil {
+		key += fmt.Sprintf("#%+v", *filterQuery.GeoBoundingBox)
+	}
+	if filterQuery.GeoRadius != nil {
+		key += fmt.Sprintf("#%+v", *filterQuery.GeoRadius)
+	}
+	return key
+}
+
+// A user's activity, aggregated over a date range.
+type UsageAnalytics struct {
+	UserId       int
+	Email        string
+	LastActivity unixtime.Time
+	// Total number of requests made within the date range.
+	TotalRequests int
+	// Number of requests made within the date range, keyed by endpoint.
+	Requests map[string]int
+	// Number of dashboard queries (see RecordEntityInfoQuery), keyed by day.
+	EntityInfoQueriesPerDay map[string]int
+	// The user's most-used watchlists, most-used first.
+	TopWatchLists []WatchListUsage
+}
+
+// Number of times a watchlist was used within a date range.
+type WatchListUsage struct {
+	Id    int
+	Title string
+	Uses  int
+}
+
+// Aggregates each user's activity between the from and to days (inclusive,
+// in activityDayFormat).  An empty from or to leaves that end of the range
+// open.  Users without any activity in the range are included with zero
+// counts, so that inactive users show up too.
+func (me *UserDb) CalcUsageAnalytics(from string, to string, topWatchListCount int) []UsageAnalytics {
+	me.activityLock.Lock()
+	defer me.activityLock.Unlock()
+
+	allAnalytics := []UsageAnalytics{}
+	for _, user := range me.users {
+		analytics := UsageAnalytics{
+			UserId:                  user.Id,
+			Email:                   user.Email,
+			Requests:                map[string]int{},
+			EntityInfoQueriesPerDay: map[string]int{},
+			TopWatchLists:           []WatchListUsage{},
+		}
+
+		watchListUses := map[int]int{}
+		if user.Activity != nil {
+			analytics.LastActivity = user.Activity.LastActivity
+			for day, daily := range user.Activity.Days {
+				isWithinRange := (from == "" || day >= from) && (to == "" || day <= to)
+				if !isWithinRange {
+					continue
+				}
+				for endpoint, count := range daily.Requests {
+					analytics.Requests[endpoint] += count
+					analytics.TotalRequests += count
+				}
+				count := daily.EntityInfoQueries
+				if count == 0 {
+					count = daily.Requests[entityInfoEndpoint]
+				}
+				if count > 0 {
+					analytics.EntityInfoQueriesPerDay[day] = count
+				}
+				for watchListId, count := range daily.WatchListUses {
+					watchListUses[watchListId] += count
+				}
+			}
+		}
+
+		// Watchlists that have since been deleted are left out.
+		for _, watchList := range user.WatchLists {
+			if uses := watchListUses[watchList.Id]; uses > 0 {
+				analytics.TopWatchLists = append(analytics.TopWatchLists, WatchListUsage{Id: watchList.Id, Title: watchList.Title, Uses: uses})
+			}
+		}
+		sort.Stable(byUses(analytics.TopWatchLists))
+		if len(analytics.TopWatchLists) > topWatchListCount {
+			analytics.TopWatchLists = analytics.TopWatchLists[:topWatchListCount]
+		}
+
+		allAnalytics = append(allAnalytics, analytics)
+	}
+
+	return allAnalytics
+}
+
+// Sorts watchlist usage by descending number of uses.
+type byUses []WatchListUsage
+
+func (a byUses) Len() int           { return len(a) }
+func (a byUses) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byUses) Less(i, j int) bool { return a[i].Uses > a[j].Uses }
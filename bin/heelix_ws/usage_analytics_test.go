@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRecordRequest(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	day1 := time.Date(2026, 10, 1, 23, 0, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Hour)
+
+	userDb.RecordRequest(user.Id, "GET /api/watchlists", day1)
+	userDb.RecordRequest(user.Id, "GET /api/watchlists", day1)
+	userDb.RecordRequest(user.Id, entityInfoEndpoint, day2)
+
+	// Requests by unknown users are ignored.
+	userDb.RecordRequest(99999, "GET /api/watchlists", day1)
+
+	user, _ = userDb.GetUserById(user.Id)
+	assert.Equal(t, int32(day2.Unix()), user.Activity.LastActivity.Unix())
+	assert.Equal(t, 2, user.Activity.Days["2026-10-01"].Requests["GET /api/watchlists"])
+	assert.Equal(t, 1, user.Activity.Days["2026-10-02"].Requests[entityInfoEndpoint])
+}
+
+func TestRecordFilterUse(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	watchList := makeWatchList("Acme people")
+	watchList.Filter = FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:1"}, FilterItem{Id: "Org:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}},
+	}}
+	watchList, _ = userDb.SaveWatchList(user.Id, watchList)
+
+	// Same entities, in a different order and with a time range.
+	userDb.RecordFilterUse(user.Id, FilterQuery{TimeRangeInHours: 8, Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Org:2"}, FilterItem{Id: "Person:1"}}},
+	}}, now)
+	// Doesn't match the watchlist.
+	userDb.RecordFilterUse(user.Id, FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}},
+	}}, now)
+	// Neither does the same filter with an excluded entity.
+	userDb.RecordFilterUse(user.Id, FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Person:1"}, FilterItem{Id: "Org:2"}}},
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: "Place:3"}}, Not: []FilterItem{FilterItem{Id: "Org:2"}}},
+	}}, now)
+
+	user, _ = userDb.GetUserById(user.Id)
+	assert.Equal(t, map[int]int{watchList.Id: 1}, user.Activity.Days["2026-10-01"].WatchListUses)
+}
+
+func TestCalcUsageAnalytics(t *testing.T) {
+	userDb := createUserDbForTest()
+	userDb.AddUser("inactive@example.com", "password")
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+
+	watchList1, _ := userDb.SaveWatchList(user.Id, makeWatchListWithFilter("One", "Person:1"))
+	watchList2, _ := userDb.SaveWatchList(user.Id, makeWatchListWithFilter("Two", "Person:2"))
+
+	for day := 1; day <= 3; day++ {
+		t := time.Date(2026, 10, day, 12, 0, 0, 0, time.UTC)
+		for i := 0; i < day; i++ {
+			userDb.RecordRequest(user.Id, entityInfoEndpoint, t)
+			userDb.RecordEntityInfoQuery(user.Id, t)
+			userDb.RecordFilterUse(user.Id, watchList2.Filter, t)
+		}
+		// Queries run through other endpoints count too.
+		userDb.RecordEntityInfoQuery(user.Id, t)
+		userDb.RecordRequest(user.Id, "GET /api/watchlists", t)
+		userDb.RecordFilterUse(user.Id, watchList1.Filter, t)
+	}
+
+	analytics := userDb.CalcUsageAnalytics("2026-10-02", "2026-10-03", 5)
+	assert.Equal(t, 2, len(analytics))
+
+	assert.Equal(t, "etakahashi@synthostech.com", analytics[0].Email)
+	assert.Equal(t, 7, analytics[0].TotalRequests)
+	assert.Equal(t, map[string]int{entityInfoEndpoint: 5, "GET /api/watchlists": 2}, analytics[0].Requests)
+	assert.Equal(t, map[string]int{"2026-10-02": 3, "2026-10-03": 4}, analytics[0].EntityInfoQueriesPerDay)
+	assert.Equal(t, []WatchListUsage{
+		WatchListUsage{Id: watchList2.Id, Title: "Two", Uses: 5},
+		WatchListUsage{Id: watchList1.Id, Title: "One", Uses: 2},
+	}, analytics[0].TopWatchLists)
+
+	// Inactive users are listed too.
+	assert.Equal(t, "inactive@example.com", analytics[1].Email)
+	assert.Equal(t, 0, analytics[1].TotalRequests)
+
+	// Open-ended range, limited to the top watchlist.
+	analytics = userDb.CalcUsageAnalytics("", "", 1)
+	assert.Equal(t, 9, analytics[0].TotalRequests)
+	assert.Equal(t, []WatchListUsage{WatchListUsage{Id: watchList2.Id, Title: "Two", Uses: 6}}, analytics[0].TopWatchLists)
+
+	// On days recorded before the queries were counted separately, the
+	// all_entity_info requests are counted instead.
+	legacyDay := time.Date(2026, 9, 30, 12, 0, 0, 0, time.UTC)
+	userDb.RecordRequest(user.Id, entityInfoEndpoint, legacyDay)
+	userDb.RecordRequest(user.Id, entityInfoEndpoint, legacyDay)
+	analytics = userDb.CalcUsageAnalytics("2026-09-30", "2026-09-30", 0)
+	assert.Equal(t, map[string]int{"2026-09-30": 2}, analytics[0].EntityInfoQueriesPerDay)
+}
+
+//
+// TEST HELPERS
+//
+
+func makeWatchListWithFilter(title string, entityId string) WatchList {
+	watchList := makeWatchList(title)
+	watchList.Filter = FilterQuery{Or: []ConjunctiveExpr{
+		ConjunctiveExpr{And: []FilterItem{FilterItem{Id: entityId}}},
+	}}
+	return watchList
+}
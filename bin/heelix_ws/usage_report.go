@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats supported by the usage report.
+const (
+	csvReportFormat    = "csv"
+	jsonReportFormat   = "json"
+	ndjsonReportFormat = "ndjson"
+)
+
+var reportContentTypes = map[string]string{
+	csvReportFormat:    "text/csv",
+	jsonReportFormat:   "application/json",
+	ndjsonReportFormat: "application/x-ndjson",
+}
+
+// The report is flushed to the client after this many rows, so that it's
+// streamed rather than buffered in its entirety.
+const reportFlushInterval = 100
+
+// A column of the usage report.
+type reportColumn struct {
+	name string
+	// Returns the column's value for the user, or nil if the user doesn't have
+	// one.
+	value func(user User) interface{}
+	// What nil values are written as in CSV format.
+	csvNilValue string
+}
+
+// All columns that may be selected for the usage report, in report order.
+var allReportColumns = []reportColumn{
+	{name: "id", value: func(u User) interface{} { return u.Id }},
+	{name: "email", value: func(u User) interface{} { return u.Email }},
+	{name: "role", value: func(u User) interface{} { return u.EffectiveRole() }},
+	{name: "last_login", csvNilValue: "NEVER", value: func(u User) interface{} {
+		if u.LastLogin.IsEmpty() {
+			return nil
+		}
+		return u.LastLogin.Time().UTC()
+	}},
+	{name: "terms_accepted", value: func(u User) interface{} { return u.TermsAccepted }},
+	{name: "watchlists", value: func(u User) interface{} { return len(u.WatchLists) }},
+	{name: "last_activity", csvNilValue: "NEVER", value: func(u User) interface{} {
+		if u.Activity == nil || u.Activity.LastActivity.IsEmpty() {
+			return nil
+		}
+		return u.Activity.LastActivity.Time().UTC()
+	}},
+}
+
+// Columns included in the report when none are selected.
+var defaultReportColumns = []string{"email", "last_login", "terms_accepted", "watchlists"}
+
+// Determines which users are included in the usage report.
+type reportFilter struct {
+	// If set, only users whose last login falls within [lastLoginFrom,
+	// lastLoginTo) are included.  Users who never logged in are excluded.
+	lastLoginFrom time.Time
+	lastLoginTo   time.Time
+	// If set, only users who have (or haven't) accepted the terms are included.
+	termsAccepted *bool
+	// If non-empty, only users with one of these roles are included.
+	roles map[string]bool
+}
+
+func (me *reportFilter) matches(user User) bool {
+	if !me.lastLoginFrom.IsZero() || !me.lastLoginTo.IsZero() {
+		lastLogin := user.LastLogin.Time()
+		if user.LastLogin.IsEmpty() ||
+			(!me.lastLoginFrom.IsZero() && lastLogin.Before(me.lastLoginFrom)) ||
+			(!me.lastLoginTo.IsZero() && !lastLogin.Before(me.lastLoginTo)) {
+			return false
+		}
+	}
+	if me.termsAccepted != nil && user.TermsAccepted != *me.termsAccepted {
+		return false
+	}
+	if len(me.roles) > 0 && !me.roles[user.EffectiveRole()] {
+		return false
+	}
+	return true
+}
+
+// Describes a usage report request.
+type reportSpec struct {
+	format  string
+	columns []reportColumn
+	filter  reportFilter
+}
+
+// Parses the usage report's query params and Accept header.  See
+// CreateUsageReport for the supported params.
+func parseReportSpec(r *http.Request) (reportSpec, error) {
+	queryParams := r.URL.Query()
+	spec := reportSpec{}
+
+	var err error
+	if spec.format, err = negotiateReportFormat(queryParams.Get("format"), r.Header.Get("Accept")); err != nil {
+		return spec, err
+	}
+	if spec.columns, err = parseReportColumns(queryParams.Get("columns")); err != nil {
+		return spec, err
+	}
+	if spec.filter, err = parseReportFilter(queryParams); err != nil {
+		return spec, err
+	}
+	return spec, nil
+}
+
+// Picks the report format from the 'format' query param or, if that's
+// empty, from the Accept header.  Defaults to CSV.
+func negotiateReportFormat(formatParam string, acceptHeader string) (string, error) {
+	if formatParam != "" {
+		if _, exists := reportContentTypes[formatParam]; !exists {
+			return "", errors.New(fmt.Sprintf("Unsupported format '%v' (expected csv, json or ndjson)", formatParam))
+		}
+		return formatParam, nil
+	}
+
+	for _, mediaRange := range strings.Split(acceptHeader, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		for format, contentType := range reportContentTypes {
+			if mediaType == contentType {
+				return format, nil
+			}
+		}
+	}
+	return csvReportFormat, nil
+}
+
+// Parses the comma-separated list of column names.
+func parseReportColumns(columnsParam string) ([]reportColumn, error) {
+	names := defaultReportColumns
+	if columnsParam != "" {
+		names = strings.Split(columnsParam, ",")
+	}
+
+	columns := []reportColumn{}
+	for _, name := range names {
+		column, exists := findReportColumn(strings.TrimSpace(name))
+		if !exists {
+			return nil, errors.New(fmt.Sprintf("Unknown column '%v'", name))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func findReportColumn(name string) (reportColumn, bool) {
+	for _, column := range allReportColumns {
+		if column.name == name {
+			return column, true
+		}
+	}
+	return reportColumn{}, false
+}
+
+func parseReportFilter(queryParams url.Values) (reportFilter, error) {
+	filter := reportFilter{roles: map[string]bool{}}
+
+	if within := queryParams.Get("last_login_within"); within != "" {
+		if queryParams.Get("last_login_from") != "" {
+			return filter, errors.New("last_login_within and last_login_from can't be combined")
+		}
+		d, err := time.ParseDuration(within)
+		if err != nil || d <= 0 {
+			return filter, errors.New(fmt.Sprintf("Invalid last_login_within duration: '%v'", within))
+		}
+		filter.lastLoginFrom = time.Now().Add(-d)
+	}
+	for param, bound := range map[string]*time.Time{"last_login_from": &filter.lastLoginFrom, "last_login_to": &filter.lastLoginTo} {
+		if value := queryParams.Get(param); value != "" {
+			t, err := parseReportDate(value)
+			if err != nil {
+				return filter, errors.New(fmt.Sprintf("Invalid %v date '%v' (expected YYYY-MM-DD or RFC 3339)", param, value))
+			}
+			*bound = t
+		}
+	}
+	// A date without a time refers to the whole day, so make the upper bound exclusive of the following day.
+	if value := queryParams.Get("last_login_to"); len(value) == len(activityDayFormat) {
+		filter.lastLoginTo = filter.lastLoginTo.AddDate(0, 0, 1)
+	}
+
+	if termsParam := queryParams.Get("terms_accepted"); termsParam != "" {
+		termsAccepted, err := strconv.ParseBool(termsParam)
+		if err != nil {
+			return filter, errors.New(fmt.Sprintf("Invalid terms_accepted value: '%v'", termsParam))
+		}
+		filter.termsAccepted = &termsAccepted
+	}
+
+	if roleParam := queryParams.Get("role"); roleParam != "" {
+		for _, role := range strings.Split(roleParam, ",") {
+			role = strings.TrimSpace(role)
+			if !isValidRole(role) {
+				return filter, errors.New(fmt.Sprintf("Unknown role '%v'", role))
+			}
+			filter.roles[role] = true
+		}
+	}
+
+	return filter, nil
+}
+
+func parseReportDate(value string) (time.Time, error) {
+	if t, err := time.Parse(activityDayFormat, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Writes the report rows in one of the supported formats.
+type reportWriter interface {
+	writeHeader(columns []reportColumn) error
+	writeRow(columns []reportColumn, user User) error
+	// Writes out any buffered rows.
+	flush()
+	// Completes the report, flushing any buffered output.
+	close() error
+}
+
+func newReportWriter(format string, w io.Writer) reportWriter {
+	switch format {
+	case jsonReportFormat:
+		return &jsonReportWriter{w: w}
+	case ndjsonReportFormat:
+		return &ndjsonReportWriter{w: w}
+	default:
+		return &csvReportWriter{w: csv.NewWriter(w)}
+	}
+}
+
+type csvReportWriter struct {
+	w *csv.Writer
+}
+
+func (me *csvReportWriter) writeHeader(columns []reportColumn) error {
+	header := []string{}
+	for _, column := range columns {
+		header = append(header, column.name)
+	}
+	return me.w.Write(header)
+}
+
+func (me *csvReportWriter) writeRow(columns []reportColumn, user User) error {
+	record := []string{}
+	for _, column := range columns {
+		switch value := column.value(user).(type) {
+		case nil:
+			record = append(record, column.csvNilValue)
+		case time.Time:
+			record = append(record, value.UTC().Format(time.RFC3339))
+		default:
+			record = append(record, fmt.Sprintf("%v", value))
+		}
+	}
+	return me.w.Write(record)
+}
+
+func (me *csvReportWriter) flush() {
+	me.w.Flush()
+}
+
+func (me *csvReportWriter) close() error {
+	me.w.Flush()
+	return me.w.Error()
+}
+
+// Writes the report as one JSON object per line.
+type ndjsonReportWriter struct {
+	w io.Writer
+}
+
+func (me *ndjsonReportWriter) writeHeader(columns []reportColumn) error {
+	return nil
+}
+
+func (me *ndjsonReportWriter) writeRow(columns []reportColumn, user User) error {
+	b, err := marshalReportRow(columns, user)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(me.w, "%s\n", b)
+	return err
+}
+
+func (me *ndjsonReportWriter) flush() {}
+
+func (me *ndjsonReportWriter) close() error {
+	return nil
+}
+
+// Writes the report as a JSON array of objects, one element at a time.
+type jsonReportWriter struct {
+	w        io.Writer
+	rowCount int
+}
+
+func (me *jsonReportWriter) writeHeader(columns []reportColumn) error {
+	_, err := io.WriteString(me.w, "[")
+	return err
+}
+
+func (me *jsonReportWriter) writeRow(columns []reportColumn, user User) error {
+	b, err := marshalReportRow(columns, user)
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if me.rowCount == 0 {
+		separator = "\n"
+	}
+	me.rowCount++
+	_, err = fmt.Fprintf(me.w, "%v%s", separator, b)
+	return err
+}
+
+func (me *jsonReportWriter) flush() {}
+
+func (me *jsonReportWriter) close() error {
+	_, err := io.WriteString(me.w, "\n]\n")
+	return err
+}
+
+// Marshals the user's row as a JSON object whose keys are in column order.
+// A column that's selected more than once is only written the first time.
+func marshalReportRow(columns []reportColumn, user User) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	written := map[string]bool{}
+	for _, column := range columns {
+		if written[column.name] {
+			continue
+		}
+		value, err := json.Marshal(column.value(user))
+		if err != nil {
+			return nil, err
+		}
+		if len(written) > 0 {
+			b.WriteString(",")
+		}
+		written[column.name] = true
+		name, _ := json.Marshal(column.name)
+		b.Write(name)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
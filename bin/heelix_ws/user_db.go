@@ -1,20 +1,26 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"qbase/synthos/synthos_core/unixtime"
 	"qbase/synthos/synthos_svr/stats"
+	"sort"
+	"sync"
 	"sync/atomic"
 )
 
+// Name of the file that the user db is saved to (see SaveUserData).
+const userDataFileName = "user_data.json"
+
 // Provides access to the user database (email addresses, credentials, etc.).
 type UserDb struct {
 	objectId int64 // atomically-incremented variable used for assigning new object IDs
 	users    []User
+
+	// Guards User.Activity, which is updated on every request (see RecordRequest).
+	activityLock sync.Mutex
 }
 
 // Creates a new UserDb instance.
@@ -26,21 +32,19 @@ func NewUserDb() *UserDb {
 }
 
 // Loads content from the specified data file into a new UserDb instance.
-// To save user content to file, use UserDb.Save(filePath).
-func LoadUserDb(filePath string) *UserDb {
+// The file is decrypted with the keyring if it's encrypted.  To save user
+// content to file, use UserDb.Save(filePath, keyring).
+func LoadUserDb(filePath string, keyring *Keyring) (*UserDb, error) {
 	logger.Printf("Loading user data from %v", filePath)
-	f, err := os.Open(filePath)
+	b, err := keyring.ReadFile(filePath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer f.Close()
 
 	var users []User
-	bufReader := bufio.NewReader(f)
-	decoder := json.NewDecoder(bufReader)
-	err = decoder.Decode(&users)
+	err = json.Unmarshal(b, &users)
 	if err != nil {
-		panic(err)
+		return nil, errors.New(fmt.Sprintf("Error decoding %v: %v", filePath, err))
 	}
 
 	largestId := 0
@@ -55,7 +59,7 @@ func LoadUserDb(filePath string) *UserDb {
 	userDb.users = users
 	userDb.objectId = int64(largestId + 1)
 	logger.Printf("Setting userDb.objectId to %v", userDb.objectId)
-	return userDb
+	return userDb, nil
 }
 
 // Iterates over each user in the database.
@@ -129,6 +133,20 @@ func (me *UserDb) SetLastLoginToNow(userId int) {
 	}
 }
 
+// Sets the user's role (one of the Role* constants).
+func (me *UserDb) SetRole(userId int, role string) error {
+	if !isValidRole(role) {
+		return errors.New(fmt.Sprintf("Unknown role '%v'", role))
+	}
+
+	user := me.findUserBy(func(u *User) bool { return u.Id == userId })
+	if user == nil {
+		return errors.New(fmt.Sprintf("User:%v doesn't exist", userId))
+	}
+	user.Role = role
+	return nil
+}
+
 // Sets the 'TermsAccepted' flag to true.
 func (me *UserDb) SetTermsAccepted(userId int) {
 	for i, _ := range me.users {
@@ -149,8 +167,25 @@ func (me *UserDb) GetWatchLists(userId int) (watchLists []WatchList, err error)
 	if user.WatchLists == nil {
 		return []WatchList{}, nil
 	} else {
-		return user.WatchLists, nil
+		watchLists = make([]WatchList, len(user.WatchLists))
+		copy(watchLists, user.WatchLists)
+		sort.Stable(ByDisplayOrder(watchLists))
+		return watchLists, nil
+	}
+}
+
+// Returns the specified watchlist, if it belongs to the user.
+func (me *UserDb) GetWatchList(userId int, watchListId int) (WatchList, bool) {
+	user, err := me.findWatchListOwner(userId, []int{watchListId})
+	if err != nil {
+		return WatchList{}, false
+	}
+	for _, w := range user.WatchLists {
+		if w.Id == watchListId {
+			return w, true
+		}
 	}
+	return WatchList{}, false
 }
 
 // Adds or updates the specified watchlist to a user's existing watchlists.
@@ -184,12 +219,112 @@ func (me *UserDb) SaveWatchList(userId int, w WatchList) (WatchList, error) {
 		}
 	} else { // Insert an new WatchList
 		w.Id = me.nextObjectId()
+		if w.Position == 0 {
+			// New watchlists go to the bottom of the list by default.
+			for _, existing := range watchlistOwner.WatchLists {
+				w.Position = stats.MaxInt(w.Position, existing.Position)
+			}
+			w.Position++
+		}
 		watchlistOwner.WatchLists = append(watchlistOwner.WatchLists, w)
 	}
 
 	return w, nil
 }
 
+// Assigns sort positions to the user's watchlists so that they are listed in
+// the order given by watchListIds.  Any of the user's watchlists not mentioned
+// in watchListIds keep their relative order, but are placed after the others.
+func (me *UserDb) ReorderWatchLists(userId int, watchListIds []int) error {
+	user, err := me.findWatchListOwner(userId, watchListIds)
+	if err != nil {
+		return err
+	}
+
+	newPositions := map[int]int{}
+	for i, watchListId := range watchListIds {
+		newPositions[watchListId] = i + 1
+	}
+
+	unmentioned := []WatchList{}
+	for _, w := range user.WatchLists {
+		if _, isMentioned := newPositions[w.Id]; !isMentioned {
+			unmentioned = append(unmentioned, w)
+		}
+	}
+	sort.Stable(ByDisplayOrder(unmentioned))
+	for i, w := range unmentioned {
+		newPositions[w.Id] = len(watchListIds) + i + 1
+	}
+
+	for i := 0; i < len(user.WatchLists); i++ {
+		w := &user.WatchLists[i]
+		w.Position = newPositions[w.Id]
+	}
+
+	return nil
+}
+
+// Pins (or unpins) each of the specified watchlists.
+func (me *UserDb) PinWatchLists(userId int, watchListIds []int, pinned bool) error {
+	return me.updateWatchLists(userId, watchListIds, func(w *WatchList) {
+		w.Pinned = pinned
+	})
+}
+
+// Moves each of the specified watchlists into the given folder.  An empty
+// folder name moves the watchlists back to the top level.
+func (me *UserDb) MoveWatchLists(userId int, watchListIds []int, folder string) error {
+	return me.updateWatchLists(userId, watchListIds, func(w *WatchList) {
+		w.Folder = folder
+	})
+}
+
+// Applies the update func to each of the specified watchlists.  Nothing is
+// modified if any of the watchlists doesn't belong to the user.
+func (me *UserDb) updateWatchLists(userId int, watchListIds []int, update func(w *WatchList)) error {
+	user, err := me.findWatchListOwner(userId, watchListIds)
+	if err != nil {
+		return err
+	}
+
+	selectedIds := map[int]bool{}
+	for _, watchListId := range watchListIds {
+		selectedIds[watchListId] = true
+	}
+
+	for i := 0; i < len(user.WatchLists); i++ {
+		if selectedIds[user.WatchLists[i].Id] {
+			update(&user.WatchLists[i])
+		}
+	}
+
+	return nil
+}
+
+// Returns a reference to the specified user, provided that every one of the
+// specified watchlists belongs to them.
+func (me *UserDb) findWatchListOwner(userId int, watchListIds []int) (*User, error) {
+	user := me.findUserBy(func(u *User) bool {
+		return u.Id == userId
+	})
+	if user == nil {
+		return nil, errors.New(fmt.Sprintf("User:%v doesn't exist", userId))
+	}
+
+	ownedIds := map[int]bool{}
+	for _, w := range user.WatchLists {
+		ownedIds[w.Id] = true
+	}
+	for _, watchListId := range watchListIds {
+		if !ownedIds[watchListId] {
+			return nil, errors.New(fmt.Sprintf("User:%v: WatchList:%v doesn't exist", userId, watchListId))
+		}
+	}
+
+	return user, nil
+}
+
 // Deletes the specified watchlist from the database.
 func (me *UserDb) DeleteWatchList(userId int, watchListId int) error {
 	removeWatchList := func(watchLists []WatchList, watchListId int) []WatchList {
@@ -213,27 +348,17 @@ func (me *UserDb) DeleteWatchList(userId int, watchListId int) error {
 	return errors.New(fmt.Sprintf("User:%v doesn't exist", userId))
 }
 
-// Saves the content of this user db to the specified file.
-func (me *UserDb) Save(filePath string) error {
-	outputFile, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer outputFile.Close()
-
+// Saves the content of this user db to the specified file, encrypting it
+// with the keyring's active key (if there is one).
+func (me *UserDb) Save(filePath string, keyring *Keyring) error {
+	me.activityLock.Lock()
 	b, err := json.MarshalIndent(me.users, "", "    ")
+	me.activityLock.Unlock()
 	if err != nil {
 		return err
 	}
 
-	bufWriter := bufio.NewWriter(outputFile)
-	_, err = bufWriter.Write(b)
-	if err != nil {
-		return err
-	}
-	bufWriter.Flush()
-
-	return nil
+	return keyring.WriteFile(filePath, b)
 }
 
 // Specifies a filter that returns true only if the specified User is
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"qbase/synthos/synthos_core/unixtime"
+	"strings"
 	"testing"
 )
 
@@ -262,6 +265,77 @@ func TestDeleteWatchList_nonexistentUser(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestSaveWatchList_assignsPosition(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+
+	w1, _ := userDb.SaveWatchList(user.Id, makeWatchList("First"))
+	w2, _ := userDb.SaveWatchList(user.Id, makeWatchList("Second"))
+	assert.Equal(t, 1, w1.Position)
+	assert.Equal(t, 2, w2.Position)
+}
+
+func TestReorderWatchLists(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	w1, _ := userDb.SaveWatchList(user.Id, makeWatchList("One"))
+	w2, _ := userDb.SaveWatchList(user.Id, makeWatchList("Two"))
+	w3, _ := userDb.SaveWatchList(user.Id, makeWatchList("Three"))
+
+	// Only w3 is explicitly positioned, so the others keep their relative order after it.
+	err := userDb.ReorderWatchLists(user.Id, []int{w3.Id})
+	assert.Nil(t, err)
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, []string{"Three", "One", "Two"}, watchListTitles(watchLists))
+
+	err = userDb.ReorderWatchLists(user.Id, []int{w2.Id, w1.Id, w3.Id})
+	assert.Nil(t, err)
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, []string{"Two", "One", "Three"}, watchListTitles(watchLists))
+
+	// Unknown watchlist ids are rejected, and nothing changes.
+	err = userDb.ReorderWatchLists(user.Id, []int{w3.Id, -12345})
+	assert.NotNil(t, err)
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, []string{"Two", "One", "Three"}, watchListTitles(watchLists))
+}
+
+func TestPinWatchLists(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	userDb.SaveWatchList(user.Id, makeWatchList("One"))
+	w2, _ := userDb.SaveWatchList(user.Id, makeWatchList("Two"))
+
+	assert.Nil(t, userDb.PinWatchLists(user.Id, []int{w2.Id}, true))
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, []string{"Two", "One"}, watchListTitles(watchLists))
+	assert.True(t, watchLists[0].Pinned)
+
+	assert.Nil(t, userDb.PinWatchLists(user.Id, []int{w2.Id}, false))
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, []string{"One", "Two"}, watchListTitles(watchLists))
+
+	nonexistentUserId := -9999999
+	assert.NotNil(t, userDb.PinWatchLists(nonexistentUserId, []int{w2.Id}, true))
+}
+
+func TestMoveWatchLists(t *testing.T) {
+	userDb := createUserDbForTest()
+	user, _ := userDb.GetUserByEmail("etakahashi@synthostech.com")
+	w1, _ := userDb.SaveWatchList(user.Id, makeWatchList("One"))
+	w2, _ := userDb.SaveWatchList(user.Id, makeWatchList("Two"))
+
+	assert.Nil(t, userDb.MoveWatchLists(user.Id, []int{w1.Id, w2.Id}, "Sports"))
+	watchLists, _ := userDb.GetWatchLists(user.Id)
+	assert.Equal(t, "Sports", watchLists[0].Folder)
+	assert.Equal(t, "Sports", watchLists[1].Folder)
+
+	assert.Nil(t, userDb.MoveWatchLists(user.Id, []int{w2.Id}, ""))
+	watchLists, _ = userDb.GetWatchLists(user.Id)
+	assert.Equal(t, "Sports", watchLists[0].Folder)
+	assert.Equal(t, "", watchLists[1].Folder)
+}
+
 func TestNextObjectId(t *testing.T) {
 	userDb := NewUserDb()
 	for i := 1; i < 1000; i++ {
@@ -300,11 +374,35 @@ func TestSaveAndLoadUsers(t *testing.T) {
 
 	// Save the users to a file and then reload them.
 	dataFile := "/tmp/TestSaveAndLoadUsers.json"
-	userDb.Save(dataFile)
-	userDb2 := LoadUserDb(dataFile)
+	userDb.Save(dataFile, NewKeyring())
+	userDb2, err := LoadUserDb(dataFile, NewKeyring())
+	assert.Nil(t, err)
 
 	assert.Equal(t, userDb.users, userDb2.users)
 	assert.Equal(t, int64(id+1), userDb2.objectId)
+
+	// Same again, but encrypted.
+	keyring := NewKeyring()
+	keyring.AddKeys([]string{"k1:" + strings.Repeat("ab", 32)})
+	userDb.Save(dataFile, keyring)
+	b, _ := ioutil.ReadFile(dataFile)
+	assert.False(t, strings.Contains(string(b), "user_"))
+	userDb3, err := LoadUserDb(dataFile, keyring)
+	assert.Nil(t, err)
+
+	assert.Equal(t, userDb.users, userDb3.users)
+}
+
+func TestLoadUserDb_corruptFile(t *testing.T) {
+	dataFile := "/tmp/TestLoadUserDb_corruptFile.json"
+	ioutil.WriteFile(dataFile, []byte(`[{"Id": 1, "Email": `), 0644)
+	defer os.Remove(dataFile)
+
+	_, err := LoadUserDb(dataFile, NewKeyring())
+	assert.NotNil(t, err)
+
+	_, err = LoadUserDb("/tmp/does/not/exist.json", NewKeyring())
+	assert.NotNil(t, err)
 }
 
 func TestFindUserBy_returnsReferenceAndNotCopy(t *testing.T) {
@@ -343,3 +441,12 @@ func makeWatchList(title string) WatchList {
 		Description: desc,
 	}
 }
+
+// Returns the titles of the specified watchlists, in order.
+func watchListTitles(watchLists []WatchList) []string {
+	titles := []string{}
+	for _, w := range watchLists {
+		titles = append(titles, w.Title)
+	}
+	return titles
+}